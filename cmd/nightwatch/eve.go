@@ -0,0 +1,234 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+type socketMessageFileinfo struct {
+	Filename string `json:"filename"`
+	FileID   uint64 `json:"file_id"`
+	Stored   bool   `json:"stored"`
+	Magic    string `json:"magic"`
+	Sha256   string `json:"sha256"`
+	Md5      string `json:"md5,omitempty"`
+	Sha1     string `json:"sha1,omitempty"`
+	State    string `json:"state,omitempty"`
+	Gaps     bool   `json:"gaps,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	TxID     int    `json:"tx_id,omitempty"`
+}
+
+type socketMessageHTTP struct {
+	Hostname    string `json:"hostname,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Method      string `json:"http_method,omitempty"`
+	UserAgent   string `json:"http_user_agent,omitempty"`
+	ContentType string `json:"http_content_type,omitempty"`
+	Status      int    `json:"status,omitempty"`
+}
+
+type socketMessageSMTP struct {
+	Helo     string   `json:"helo,omitempty"`
+	MailFrom string   `json:"mail_from,omitempty"`
+	RcptTo   []string `json:"rcpt_to,omitempty"`
+}
+
+type socketMessageEmail struct {
+	From    string   `json:"from,omitempty"`
+	To      []string `json:"to,omitempty"`
+	Cc      []string `json:"cc,omitempty"`
+	Subject string   `json:"subject,omitempty"`
+}
+
+type socketMessage struct {
+	Timestamp string                `json:"timestamp,omitempty"`
+	FlowID    uint64                `json:"flow_id,omitempty"`
+	EventType string                `json:"event_type"`
+	SrcIP     string                `json:"src_ip,omitempty"`
+	SrcPort   int                   `json:"src_port,omitempty"`
+	DestIP    string                `json:"dest_ip,omitempty"`
+	DestPort  int                   `json:"dest_port,omitempty"`
+	Proto     string                `json:"proto,omitempty"`
+	AppProto  string                `json:"app_proto,omitempty"`
+	TxID      *int                  `json:"tx_id,omitempty"`
+	HTTP      *socketMessageHTTP    `json:"http,omitempty"`
+	SMTP      *socketMessageSMTP    `json:"smtp,omitempty"`
+	Email     *socketMessageEmail   `json:"email,omitempty"`
+	FileInfo  socketMessageFileinfo `json:"fileinfo"`
+}
+
+// parseEVE parses an EVE JSON record, returning both the generic
+// representation of the full record and the structured fields we use.
+func parseEVE(line []byte) (interface{}, socketMessage, error) {
+	var fullMsg interface{}
+	var m socketMessage
+
+	err := json.Unmarshal(line, &fullMsg)
+	if err != nil {
+		return nil, m, err
+	}
+	err = json.Unmarshal(line, &m)
+	if err != nil {
+		return nil, m, err
+	}
+	return fullMsg, m, nil
+}
+
+// EventInfo converts the parsed fileinfo event into the representation used
+// in verdicts.
+func (m *socketMessage) EventInfo() *sampledb.EventInfo {
+	ei := &sampledb.EventInfo{
+		Timestamp: m.Timestamp,
+		FlowID:    m.FlowID,
+		SrcIP:     m.SrcIP,
+		SrcPort:   m.SrcPort,
+		DestIP:    m.DestIP,
+		DestPort:  m.DestPort,
+		Proto:     m.Proto,
+		AppProto:  m.AppProto,
+		TxID:      m.FileInfo.TxID,
+		File: sampledb.FileEventInfo{
+			Filename: m.FileInfo.Filename,
+			FileID:   m.FileInfo.FileID,
+			Stored:   m.FileInfo.Stored,
+			Magic:    m.FileInfo.Magic,
+			State:    m.FileInfo.State,
+			Gaps:     m.FileInfo.Gaps,
+			Size:     m.FileInfo.Size,
+			Md5:      m.FileInfo.Md5,
+			Sha1:     m.FileInfo.Sha1,
+			Sha256:   m.FileInfo.Sha256,
+		},
+	}
+	if m.TxID != nil {
+		ei.TxID = *m.TxID
+	}
+	if m.HTTP != nil {
+		ei.HTTP = &sampledb.HTTPInfo{
+			Hostname:    m.HTTP.Hostname,
+			URL:         m.HTTP.URL,
+			Method:      m.HTTP.Method,
+			UserAgent:   m.HTTP.UserAgent,
+			ContentType: m.HTTP.ContentType,
+			Status:      m.HTTP.Status,
+		}
+	}
+	if m.SMTP != nil {
+		ei.SMTP = &sampledb.SMTPInfo{
+			Helo:     m.SMTP.Helo,
+			MailFrom: m.SMTP.MailFrom,
+			RcptTo:   m.SMTP.RcptTo,
+		}
+	}
+	if m.Email != nil {
+		ei.Email = &sampledb.EmailInfo{
+			From:    m.Email.From,
+			To:      m.Email.To,
+			Cc:      m.Email.Cc,
+			Subject: m.Email.Subject,
+		}
+	}
+	return ei
+}
+
+// Field returns the values of the field with the given EVE name, e.g.
+// "http.hostname" or "fileinfo.gaps". File fields can also be addressed
+// without the "fileinfo." prefix. Fields with multiple values, such as
+// "smtp.rcpt_to", return all of them. The second return value is false for
+// unknown field names.
+func (m *socketMessage) Field(name string) ([]string, bool) {
+	single := func(v string) ([]string, bool) {
+		return []string{v}, true
+	}
+	switch name {
+	case "event_type":
+		return single(m.EventType)
+	case "src_ip":
+		return single(m.SrcIP)
+	case "src_port":
+		return single(strconv.Itoa(m.SrcPort))
+	case "dest_ip":
+		return single(m.DestIP)
+	case "dest_port":
+		return single(strconv.Itoa(m.DestPort))
+	case "proto":
+		return single(m.Proto)
+	case "app_proto":
+		return single(m.AppProto)
+	case "tx_id":
+		if m.TxID != nil {
+			return single(strconv.Itoa(*m.TxID))
+		}
+		return single(strconv.Itoa(m.FileInfo.TxID))
+	case "http.hostname", "http.url", "http.http_method", "http.http_user_agent",
+		"http.http_content_type", "http.status":
+		if m.HTTP == nil {
+			return []string{}, true
+		}
+		switch name {
+		case "http.hostname":
+			return single(m.HTTP.Hostname)
+		case "http.url":
+			return single(m.HTTP.URL)
+		case "http.http_method":
+			return single(m.HTTP.Method)
+		case "http.http_user_agent":
+			return single(m.HTTP.UserAgent)
+		case "http.http_content_type":
+			return single(m.HTTP.ContentType)
+		default:
+			return single(strconv.Itoa(m.HTTP.Status))
+		}
+	case "smtp.helo", "smtp.mail_from", "smtp.rcpt_to":
+		if m.SMTP == nil {
+			return []string{}, true
+		}
+		switch name {
+		case "smtp.helo":
+			return single(m.SMTP.Helo)
+		case "smtp.mail_from":
+			return single(m.SMTP.MailFrom)
+		default:
+			return m.SMTP.RcptTo, true
+		}
+	case "email.from", "email.to", "email.cc", "email.subject":
+		if m.Email == nil {
+			return []string{}, true
+		}
+		switch name {
+		case "email.from":
+			return single(m.Email.From)
+		case "email.to":
+			return m.Email.To, true
+		case "email.cc":
+			return m.Email.Cc, true
+		default:
+			return single(m.Email.Subject)
+		}
+	case "fileinfo.filename", "filename":
+		return single(m.FileInfo.Filename)
+	case "fileinfo.magic", "magic":
+		return single(m.FileInfo.Magic)
+	case "fileinfo.state", "state":
+		return single(m.FileInfo.State)
+	case "fileinfo.gaps", "gaps":
+		return single(strconv.FormatBool(m.FileInfo.Gaps))
+	case "fileinfo.stored", "stored":
+		return single(strconv.FormatBool(m.FileInfo.Stored))
+	case "fileinfo.size", "size":
+		return single(strconv.FormatInt(m.FileInfo.Size, 10))
+	case "fileinfo.sha256", "sha256":
+		return single(m.FileInfo.Sha256)
+	case "fileinfo.md5", "md5":
+		return single(m.FileInfo.Md5)
+	case "fileinfo.sha1", "sha1":
+		return single(m.FileInfo.Sha1)
+	}
+	return nil, false
+}
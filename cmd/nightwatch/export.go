@@ -0,0 +1,64 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/DCSO/nightwatch/sampledb"
+	"github.com/DCSO/nightwatch/stix"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// exportSTIXPath is the file to export the verdicts in the database to.
+var exportSTIXPath = flag.String("exportstix", "", "Write all verdicts in the database as STIX 2.1 bundle to file (- for stdout) and exit")
+
+// exportSTIX writes all verdicts in the database at dataPath as STIX bundle
+// to the file at path, or to stdout if path is "-". As verdicts are ordered
+// by hash, the same database always results in the same bundle.
+func exportSTIX(dataPath, path string) error {
+	err := sampledb.InitDB(dataPath)
+	if err != nil {
+		return err
+	}
+	defer sampledb.CloseDB()
+	verdicts, err := sampledb.SampleEntries()
+	if err != nil {
+		return err
+	}
+	vs := make([]*sampledb.FileVerdict, len(verdicts))
+	for i := range verdicts {
+		vs[i] = &verdicts[i]
+	}
+
+	bundle := stix.MakeBundle(vs...)
+	if path == "-" {
+		err = writeJSON(os.Stdout, bundle)
+	} else {
+		var f *os.File
+		f, err = os.Create(path)
+		if err != nil {
+			return err
+		}
+		err = writeJSON(f, bundle)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("exported %d verdicts as STIX bundle", len(verdicts))
+	return nil
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,80 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+func TestExportSTIX(t *testing.T) {
+	dbdir := t.TempDir()
+	err := sampledb.InitDB(dbdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []sampledb.FileVerdict{
+		{
+			Suspicious:    true,
+			SuspiciousVia: []string{"YARA"},
+			Reasons:       map[string]interface{}{"YARA": `{"MatchedRules":["Rule1"]}`},
+			Time:          time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+			Hashes:        sampledb.HashInfo{Sha256: "a256", Sha512: "a512"},
+		},
+		{
+			Time:   time.Date(2025, 1, 2, 3, 4, 6, 0, time.UTC),
+			Hashes: sampledb.HashInfo{Sha256: "b256", Sha512: "b512"},
+		},
+	} {
+		err = sampledb.CreateSampleEntry(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sampledb.CloseDB()
+
+	var outputs []string
+	for _, name := range []string{"1.json", "2.json"} {
+		path := filepath.Join(t.TempDir(), name)
+		err = exportSTIX(dbdir, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, string(out))
+	}
+	if outputs[0] != outputs[1] {
+		t.Fatalf("export not deterministic:\n%s\n%s", outputs[0], outputs[1])
+	}
+
+	var bundle struct {
+		Type    string `json:"type"`
+		Objects []struct {
+			Type string `json:"type"`
+		} `json:"objects"`
+	}
+	err = json.Unmarshal([]byte(outputs[0]), &bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, o := range bundle.Objects {
+		types = append(types, o.Type)
+	}
+	// suspicious sample with analysis, indicator and relationships first,
+	// then the clean one without any plugin results
+	expected := "file,malware-analysis,indicator,relationship,relationship,file"
+	if bundle.Type != "bundle" || strings.Join(types, ",") != expected {
+		t.Fatalf("unexpected objects %v", types)
+	}
+}
@@ -0,0 +1,105 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/DCSO/nightwatch/sampledb"
+	"github.com/DCSO/nightwatch/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Input is a source of EVE fileinfo events, feeding FileInfoEvents for files
+// in the filestore into a Watcher.
+type Input interface {
+	// Run starts reading events in the background.
+	Run()
+	// Stop causes the Input to cease reading events and closes the passed
+	// notification channel once it has done so.
+	Stop(stoppedChan chan bool)
+	// SetVerbose sets the input's verbosity level.
+	SetVerbose(verbose bool)
+	// String returns a human readable description of the input.
+	String() string
+}
+
+// InputMaker creates an Input writing events for files in fileDir to outChan,
+// adding one to wg for each event emitted.
+type InputMaker func(outChan chan sampledb.FileInfoEvent, fileDir string,
+	wg *sync.WaitGroup, version util.FilestoreVersion) (Input, error)
+
+// handleEVELine parses a single EVE JSON record and, if it is a fileinfo event
+// describing a stored file of interest, emits a FileInfoEvent for it on
+// eventChan. Files with uninteresting magic are removed from the filestore.
+func handleEVELine(line []byte, eventChan chan sampledb.FileInfoEvent,
+	wg *sync.WaitGroup, fileDir string, version util.FilestoreVersion) {
+	fullMsg, m, err := parseEVE(line)
+	if err != nil {
+		log.Errorf("could not unmarshal JSON '%s': %s", string(line), err)
+		return
+	}
+
+	if m.EventType != "fileinfo" {
+		return
+	}
+
+	log.Debugf("received fileinfo: %v", m)
+	if rule, drop := dropRules.Match(&m); drop {
+		log.Infof("dropping fileinfo event for '%s' (%s) matching filter rule '%s'",
+			m.FileInfo.Filename, m.FileInfo.Sha256, rule.Text)
+		return
+	}
+	isAllowedFiletype := AllowedMagicPattern(m.FileInfo.Magic)
+
+	switch version {
+	case util.V1:
+		filePath := filepath.Join(fileDir, fmt.Sprintf("file.%v", m.FileInfo.FileID))
+		if !isAllowedFiletype {
+			log.Infof("file %s: filemagic '%s' did not match interesting pattern", filePath, m.FileInfo.Magic)
+			err = DeleteFileSet(filePath, util.V1)
+			if err != nil {
+				log.Error(err)
+			}
+			return
+		}
+		if m.FileInfo.Stored && m.FileInfo.FileID > 0 {
+			wg.Add(1)
+			eventChan <- sampledb.FileInfoEvent{
+				StoreVersion: util.V1,
+				JSONMessage:  fullMsg,
+				FilePath:     filePath,
+				Event:        m.EventInfo(),
+			}
+		} else {
+			log.Debugf("ignoring file %d (filename: %s, stored: %v)",
+				m.FileInfo.FileID, m.FileInfo.Filename, m.FileInfo.Stored)
+		}
+	case util.V2:
+		if m.FileInfo.Stored && len(m.FileInfo.Sha256) > 2 {
+			fileBasePath := filepath.Join(fileDir, m.FileInfo.Sha256[:2], m.FileInfo.Sha256)
+			if !isAllowedFiletype {
+				log.Infof("file %s: filemagic '%s' did not match interesting pattern", fileBasePath, m.FileInfo.Magic)
+				err = DeleteFileSet(fileBasePath, util.V2)
+				if err != nil {
+					log.Error(err)
+				}
+				return
+			}
+			wg.Add(1)
+			eventChan <- sampledb.FileInfoEvent{
+				StoreVersion: util.V2,
+				JSONMessage:  fullMsg,
+				FilePath:     fileBasePath,
+				Event:        m.EventInfo(),
+			}
+		} else {
+			log.Debugf("ignoring file %s (filename: '%s', stored: %v)",
+				m.FileInfo.Sha256, m.FileInfo.Filename, m.FileInfo.Stored)
+		}
+	}
+}
@@ -4,10 +4,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/DCSO/nightwatch/util"
 
@@ -16,10 +19,156 @@ import (
 
 var (
 	allowedMagicPatterns = make(map[string]*regexp.Regexp)
+	dropRules            FilterRules
 )
 
 func init() {
 	allowedMagicPatterns["WinExecutables"] = regexp.MustCompile("(for MS Windows|(ELF|Mach-O).*(executable|shared object))")
+	flag.Var(&dropRules, "filter", "Drop fileinfo events matching rule, e.g. 'gaps==true' (can be given multiple times)")
+}
+
+// filterOps lists the supported comparison operators. Two-character operators
+// need to come first so they are not mistaken for their one-character
+// prefixes.
+var filterOps = []string{"==", "!=", "=~", "!~", "<=", ">=", "<", ">"}
+
+type filterCondition struct {
+	Field  string
+	Op     string
+	Value  string
+	Regex  *regexp.Regexp
+	Number float64
+}
+
+// FilterRule is a set of conditions on fields of EVE fileinfo events, joined
+// by '&&'. A rule matches an event if all of its conditions are met.
+type FilterRule struct {
+	Text       string
+	Conditions []filterCondition
+}
+
+// ParseFilterRule parses a rule such as 'app_proto==smtp && gaps==true'.
+// Supported operators are == and != for string comparison, =~ and !~ for
+// regular expression matching and <, <=, > and >= for numeric comparison.
+func ParseFilterRule(text string) (FilterRule, error) {
+	rule := FilterRule{
+		Text:       text,
+		Conditions: make([]filterCondition, 0),
+	}
+	for _, part := range strings.Split(text, "&&") {
+		var cond filterCondition
+		pos := -1
+		for i := 0; i < len(part) && pos < 0; i++ {
+			for _, op := range filterOps {
+				if strings.HasPrefix(part[i:], op) {
+					pos = i
+					cond.Op = op
+					break
+				}
+			}
+		}
+		if pos < 0 {
+			return rule, fmt.Errorf("no operator in filter condition '%s'", part)
+		}
+		cond.Field = strings.TrimSpace(part[:pos])
+		cond.Value = strings.Trim(strings.TrimSpace(part[pos+len(cond.Op):]), `"'`)
+		if _, ok := (&socketMessage{}).Field(cond.Field); !ok {
+			return rule, fmt.Errorf("unknown field '%s' in filter rule", cond.Field)
+		}
+		var err error
+		switch cond.Op {
+		case "=~", "!~":
+			cond.Regex, err = regexp.Compile(cond.Value)
+		case "<", "<=", ">", ">=":
+			cond.Number, err = strconv.ParseFloat(cond.Value, 64)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("invalid value in filter condition '%s': %s", part, err)
+		}
+		rule.Conditions = append(rule.Conditions, cond)
+	}
+	return rule, nil
+}
+
+func (c *filterCondition) matchValue(v string) bool {
+	switch c.Op {
+	case "==", "!=":
+		return v == c.Value
+	case "=~", "!~":
+		return c.Regex.MatchString(v)
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return false
+	}
+	switch c.Op {
+	case "<":
+		return n < c.Number
+	case "<=":
+		return n <= c.Number
+	case ">":
+		return n > c.Number
+	default:
+		return n >= c.Number
+	}
+}
+
+func (c *filterCondition) match(m *socketMessage) bool {
+	values, _ := m.Field(c.Field)
+	matched := false
+	for _, v := range values {
+		if c.matchValue(v) {
+			matched = true
+			break
+		}
+	}
+	// negated operators match if none of the values do
+	if c.Op == "!=" || c.Op == "!~" {
+		return !matched
+	}
+	return matched
+}
+
+// Match returns true if the given event satisfies all conditions of the rule.
+func (r *FilterRule) Match(m *socketMessage) bool {
+	for i := range r.Conditions {
+		if !r.Conditions[i].match(m) {
+			return false
+		}
+	}
+	return len(r.Conditions) > 0
+}
+
+// FilterRules is a list of FilterRule, usable as a repeatable flag.
+type FilterRules []FilterRule
+
+// String returns the textual representation of all rules.
+func (r *FilterRules) String() string {
+	texts := make([]string, 0)
+	for _, rule := range *r {
+		texts = append(texts, rule.Text)
+	}
+	return strings.Join(texts, ", ")
+}
+
+// Set parses and adds a new rule.
+func (r *FilterRules) Set(text string) error {
+	rule, err := ParseFilterRule(text)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// Match returns the first rule matching the given event, if any.
+func (r FilterRules) Match(m *socketMessage) (*FilterRule, bool) {
+	for i := range r {
+		if r[i].Match(m) {
+			return &r[i], true
+		}
+	}
+	return nil, false
 }
 
 // AllowedMagicPattern checks whether a magic string is within the definition
@@ -0,0 +1,123 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+const fullFileinfoStr = `{"timestamp":"2024-03-06T09:03:48.355600+0000","flow_id":1234,` +
+	`"event_type":"fileinfo","src_ip":"10.0.0.1","src_port":80,"dest_ip":"10.0.0.2",` +
+	`"dest_port":4711,"proto":"TCP","app_proto":"http",` +
+	`"http":{"hostname":"example.com","url":"/foo.exe","http_method":"GET","status":200},` +
+	`"smtp":{"helo":"mx","mail_from":"<a@example.com>","rcpt_to":["<b@example.com>","<c@example.com>"]},` +
+	`"fileinfo":{"filename":"/foo.exe","gaps":true,"state":"TRUNCATED","stored":true,` +
+	`"size":4096,"tx_id":3,"file_id":23,` +
+	`"magic":"PE32 executable (GUI) Intel 80386, for MS Windows",` +
+	`"sha256":"40c38478248ab915fc6d988b54860d0eec3f1e6ff3c968d65ff8d0840614382f"}}`
+
+func TestFilterRuleMatch(t *testing.T) {
+	_, m, err := parseEVE([]byte(fullFileinfoStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rule, expected := range map[string]bool{
+		"gaps==true":                          true,
+		"gaps == false":                       false,
+		"fileinfo.state!=CLOSED":              true,
+		"app_proto==http && gaps==true":       true,
+		"app_proto==smtp && gaps==true":       false,
+		"http.hostname=~^example\\.":          true,
+		"http.hostname!~^example\\.":          false,
+		"http.url==\"/foo.exe\"":              true,
+		"size>1000":                           true,
+		"size<=1000":                          false,
+		"tx_id>=3":                            true,
+		"smtp.rcpt_to==<c@example.com>":       true,
+		"smtp.rcpt_to!=<c@example.com>":       false,
+		"email.from==foo":                     false,
+		"email.from!=foo":                     true,
+		"src_ip==10.0.0.1 && dest_port==4711": true,
+	} {
+		r, err := ParseFilterRule(rule)
+		if err != nil {
+			t.Fatalf("could not parse rule '%s': %s", rule, err)
+		}
+		if r.Match(&m) != expected {
+			t.Errorf("rule '%s' match result != %v", rule, expected)
+		}
+	}
+}
+
+func TestFilterRuleInvalid(t *testing.T) {
+	for _, rule := range []string{
+		"gaps",
+		"foo.bar==baz",
+		"size>large",
+		"filename=~[",
+	} {
+		if _, err := ParseFilterRule(rule); err == nil {
+			t.Errorf("invalid rule '%s' accepted", rule)
+		}
+	}
+}
+
+func TestEVELineEventInfo(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldRules := dropRules
+	defer func() {
+		dropRules = oldRules
+	}()
+	dropRules = FilterRules{}
+
+	var wg sync.WaitGroup
+	eventChan := make(chan sampledb.FileInfoEvent, 1)
+	handleEVELine([]byte(fullFileinfoStr), eventChan, &wg, dir, 2)
+	if len(eventChan) != 1 {
+		t.Fatal("expected file event")
+	}
+	fiev := <-eventChan
+	wg.Done()
+	ei := fiev.Event
+	if ei == nil {
+		t.Fatal("missing event info")
+	}
+	if ei.AppProto != "http" || ei.SrcIP != "10.0.0.1" || ei.DestIP != "10.0.0.2" ||
+		ei.TxID != 3 || ei.FlowID != 1234 {
+		t.Fatalf("wrong flow context: %+v", ei)
+	}
+	if ei.HTTP == nil || ei.HTTP.Hostname != "example.com" || ei.HTTP.URL != "/foo.exe" {
+		t.Fatalf("wrong HTTP context: %+v", ei.HTTP)
+	}
+	if ei.SMTP == nil || len(ei.SMTP.RcptTo) != 2 {
+		t.Fatalf("wrong SMTP context: %+v", ei.SMTP)
+	}
+	if !ei.File.Gaps || ei.File.State != "TRUNCATED" || ei.File.Size != 4096 {
+		t.Fatalf("wrong file info: %+v", ei.File)
+	}
+	if fiev.FilePath != filepath.Join(dir, "40", ei.File.Sha256) {
+		t.Fatalf("wrong file path: %s", fiev.FilePath)
+	}
+
+	err = dropRules.Set("gaps==true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleEVELine([]byte(fullFileinfoStr), eventChan, &wg, dir, 2)
+	if len(eventChan) != 0 {
+		t.Fatal("event matching filter rule not dropped")
+	}
+	wg.Wait()
+}
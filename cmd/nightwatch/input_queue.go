@@ -0,0 +1,366 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QueuePolicy determines what happens to incoming events when the scan
+// queue is full.
+type QueuePolicy string
+
+const (
+	// QueueBlock makes inputs wait until there is room in the queue.
+	QueueBlock QueuePolicy = "block"
+	// QueueDropOldest discards the oldest queued event to make room.
+	QueueDropOldest QueuePolicy = "drop-oldest"
+	// QueueSpill writes events to the spill directory, feeding them back
+	// into the queue once there is room again.
+	QueueSpill QueuePolicy = "spill"
+)
+
+// String returns the policy name.
+func (p *QueuePolicy) String() string {
+	return string(*p)
+}
+
+// Set sets the policy from its name.
+func (p *QueuePolicy) Set(s string) error {
+	switch QueuePolicy(s) {
+	case QueueBlock, QueueDropOldest, QueueSpill:
+		*p = QueuePolicy(s)
+		return nil
+	}
+	return fmt.Errorf("invalid queue policy: %s", s)
+}
+
+const queueReportInterval = 10 * time.Second
+
+// InputQueue passes events read by an Input on to the workers' queue,
+// applying the configured policy whenever that queue is full.
+type InputQueue struct {
+	InChan      chan sampledb.FileInfoEvent
+	OutChan     chan sampledb.FileInfoEvent
+	WaitGroup   *sync.WaitGroup
+	Policy      QueuePolicy
+	Persist     bool
+	SpillDir    string
+	SpillSeq    uint64
+	Spilled     []string
+	SpillNotify chan bool
+	Lock        sync.Mutex
+	FullCount   int
+	LastReport  time.Time
+	StopChan    chan bool
+	Running     sync.WaitGroup
+}
+
+// MakeInputQueue returns a new InputQueue forwarding events to outChan.
+// Events keep their count in wg while they are queued or spilled. If persist
+// is set, events are stored in the persistent scan queue before being
+// forwarded. Events spilled by a previous run are picked up again, unless
+// they are replayed from the persistent scan queue anyway.
+func MakeInputQueue(outChan chan sampledb.FileInfoEvent, wg *sync.WaitGroup,
+	policy QueuePolicy, spillDir string, persist bool) *InputQueue {
+	q := &InputQueue{
+		InChan:      make(chan sampledb.FileInfoEvent),
+		OutChan:     outChan,
+		WaitGroup:   wg,
+		Policy:      policy,
+		Persist:     persist,
+		SpillDir:    spillDir,
+		Spilled:     make([]string, 0),
+		SpillNotify: make(chan bool, 1),
+		StopChan:    make(chan bool),
+	}
+	if policy == QueueSpill {
+		q.loadSpilled()
+	}
+	return q
+}
+
+func (q *InputQueue) loadSpilled() {
+	files, err := filepath.Glob(filepath.Join(q.SpillDir, "*.json"))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(f), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq >= q.SpillSeq {
+			q.SpillSeq = seq + 1
+		}
+		if q.Persist && spilledQueueID(f) != 0 {
+			err = os.Remove(f)
+			if err != nil {
+				log.Error(err)
+			}
+			continue
+		}
+		q.Spilled = append(q.Spilled, f)
+	}
+	if len(q.Spilled) > 0 {
+		log.Infof("found %d spilled events in %s", len(q.Spilled), q.SpillDir)
+		q.WaitGroup.Add(len(q.Spilled))
+	}
+}
+
+func spilledQueueID(path string) uint64 {
+	var fiev sampledb.FileInfoEvent
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	if json.Unmarshal(data, &fiev) != nil {
+		return 0
+	}
+	return fiev.QueueID
+}
+
+// dequeueEvent removes a completely handled event from the persistent scan
+// queue.
+func dequeueEvent(fiev sampledb.FileInfoEvent) {
+	if fiev.QueueID == 0 {
+		return
+	}
+	err := sampledb.DequeueEvent(fiev.QueueID)
+	if err != nil {
+		log.Errorf("could not remove event for %s from queue: %s", fiev.FilePath, err)
+	}
+}
+
+func (q *InputQueue) spilledCount() int {
+	q.Lock.Lock()
+	defer q.Lock.Unlock()
+	return len(q.Spilled)
+}
+
+// spill writes the event to the spill directory.
+func (q *InputQueue) spill(fiev sampledb.FileInfoEvent) error {
+	data, err := json.Marshal(fiev)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(q.SpillDir, 0700)
+	if err != nil {
+		return err
+	}
+	q.Lock.Lock()
+	defer q.Lock.Unlock()
+	path := filepath.Join(q.SpillDir, fmt.Sprintf("%020d.json", q.SpillSeq))
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		return err
+	}
+	q.SpillSeq++
+	q.Spilled = append(q.Spilled, path)
+	metricQueueSpilled.Add(1)
+	select {
+	case q.SpillNotify <- true:
+	default:
+	}
+	return nil
+}
+
+func (q *InputQueue) reportFull() {
+	metricQueueFull.Add(1)
+	q.FullCount++
+	if time.Since(q.LastReport) >= queueReportInterval {
+		log.Warnf("scan queue full (%d times since last report), applying policy %s",
+			q.FullCount, q.Policy)
+		q.FullCount = 0
+		q.LastReport = time.Now()
+	}
+}
+
+func (q *InputQueue) drop(fiev sampledb.FileInfoEvent) {
+	metricQueueDropped.Add(1)
+	log.Debugf("dropped queued event for %s", fiev.FilePath)
+	dequeueEvent(fiev)
+	q.WaitGroup.Done()
+}
+
+func (q *InputQueue) blockingSend(fiev sampledb.FileInfoEvent) {
+	select {
+	case q.OutChan <- fiev:
+	case <-q.StopChan:
+		log.Warnf("discarding event for %s on shutdown", fiev.FilePath)
+		q.WaitGroup.Done()
+	}
+}
+
+func (q *InputQueue) push(fiev sampledb.FileInfoEvent) {
+	// replayed events are in the persistent scan queue already
+	if q.Persist && fiev.QueueID == 0 {
+		err := sampledb.EnqueueEvent(&fiev)
+		if err != nil {
+			log.Errorf("could not persist event for %s: %s", fiev.FilePath, err)
+		}
+	}
+
+	// keep order while there are spilled events left
+	if q.Policy == QueueSpill && q.spilledCount() > 0 {
+		err := q.spill(fiev)
+		if err == nil {
+			return
+		}
+		log.Errorf("could not spill event for %s: %s", fiev.FilePath, err)
+		q.blockingSend(fiev)
+		return
+	}
+
+	select {
+	case q.OutChan <- fiev:
+		return
+	default:
+	}
+	q.reportFull()
+
+	switch q.Policy {
+	case QueueDropOldest:
+		for {
+			select {
+			case q.OutChan <- fiev:
+				return
+			default:
+			}
+			select {
+			case old := <-q.OutChan:
+				q.drop(old)
+			default:
+			}
+		}
+	case QueueSpill:
+		err := q.spill(fiev)
+		if err == nil {
+			return
+		}
+		log.Errorf("could not spill event for %s: %s", fiev.FilePath, err)
+		q.blockingSend(fiev)
+	default:
+		q.blockingSend(fiev)
+	}
+}
+
+// unspill feeds spilled events back into the queue, oldest first.
+func (q *InputQueue) unspill() {
+	defer q.Running.Done()
+	for {
+		q.Lock.Lock()
+		if len(q.Spilled) == 0 {
+			q.Lock.Unlock()
+			select {
+			case <-q.SpillNotify:
+				continue
+			case <-q.StopChan:
+				return
+			}
+		}
+		path := q.Spilled[0]
+		q.Lock.Unlock()
+
+		var fiev sampledb.FileInfoEvent
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &fiev)
+		}
+		if err == nil {
+			select {
+			case q.OutChan <- fiev:
+			case <-q.StopChan:
+				return
+			}
+		} else {
+			log.Errorf("could not read spilled event %s: %s", path, err)
+		}
+		q.Lock.Lock()
+		q.Spilled = q.Spilled[1:]
+		q.Lock.Unlock()
+		if err != nil {
+			// unreadable event, no longer tracked
+			q.WaitGroup.Done()
+		}
+		if rmErr := os.Remove(path); rmErr != nil {
+			log.Error(rmErr)
+		}
+	}
+}
+
+// Run starts forwarding events in the background.
+func (q *InputQueue) Run() {
+	q.Running.Add(1)
+	go func() {
+		defer q.Running.Done()
+		for {
+			select {
+			case <-q.StopChan:
+				return
+			case fiev := <-q.InChan:
+				q.push(fiev)
+			}
+		}
+	}()
+	if q.Policy == QueueSpill {
+		q.Running.Add(1)
+		go q.unspill()
+	}
+}
+
+// Stop stops forwarding events. Spilled events remain on disk to be picked
+// up on the next start. Events still arriving from the input until
+// inputStopped is closed are persisted or spilled as well if possible, or
+// discarded otherwise. A nil inputStopped means that no input is sending
+// events anymore.
+func (q *InputQueue) Stop(inputStopped chan bool) {
+	close(q.StopChan)
+	q.Running.Wait()
+	q.Lock.Lock()
+	q.WaitGroup.Add(-len(q.Spilled))
+	q.Lock.Unlock()
+	if inputStopped == nil {
+		return
+	}
+	q.Running.Add(1)
+	go func() {
+		defer q.Running.Done()
+		for {
+			select {
+			case fiev := <-q.InChan:
+				q.shelve(fiev)
+			case <-inputStopped:
+				return
+			}
+		}
+	}()
+}
+
+// shelve keeps an event arriving after Stop for the next start, if possible.
+func (q *InputQueue) shelve(fiev sampledb.FileInfoEvent) {
+	if q.Persist && sampledb.EnqueueEvent(&fiev) == nil {
+		log.Debugf("persisted event for %s on shutdown", fiev.FilePath)
+	} else if q.Policy == QueueSpill && q.spill(fiev) == nil {
+		log.Debugf("spilled event for %s on shutdown", fiev.FilePath)
+	} else {
+		metricQueueDropped.Add(1)
+		log.Warnf("discarding event for %s on shutdown", fiev.FilePath)
+	}
+	q.WaitGroup.Done()
+}
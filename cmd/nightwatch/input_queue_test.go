@@ -0,0 +1,239 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+func pushEvents(q *InputQueue, wg *sync.WaitGroup, from, to int) {
+	for i := from; i < to; i++ {
+		wg.Add(1)
+		q.InChan <- sampledb.FileInfoEvent{
+			FilePath: fmt.Sprintf("file.%d", i),
+		}
+	}
+}
+
+func TestInputQueueDropOldest(t *testing.T) {
+	outChan := make(chan sampledb.FileInfoEvent, 3)
+	var wg sync.WaitGroup
+	q := MakeInputQueue(outChan, &wg, QueueDropOldest, "", false)
+	q.Run()
+	defer q.Stop(nil)
+
+	full := metricQueueFull.Value()
+	dropped := metricQueueDropped.Value()
+	pushEvents(q, &wg, 0, 5)
+
+	// wait for the last event to be queued
+	deadline := time.Now().Add(5 * time.Second)
+	for metricQueueDropped.Value() != dropped+2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for events to be dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if metricQueueFull.Value() != full+2 {
+		t.Fatalf("expected 2 queue full events, got %d", metricQueueFull.Value()-full)
+	}
+	for i := 2; i < 5; i++ {
+		fiev := <-outChan
+		if fiev.FilePath != fmt.Sprintf("file.%d", i) {
+			t.Fatalf("unexpected event for %s", fiev.FilePath)
+		}
+		wg.Done()
+	}
+	wg.Wait()
+}
+
+func TestInputQueueSpill(t *testing.T) {
+	dir, err := os.MkdirTemp("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outChan := make(chan sampledb.FileInfoEvent, 2)
+	var wg sync.WaitGroup
+	q := MakeInputQueue(outChan, &wg, QueueSpill, dir, false)
+	q.Run()
+
+	pushEvents(q, &wg, 0, 6)
+
+	// two events in the channel, the remaining ones spilled to disk
+	deadline := time.Now().Add(5 * time.Second)
+	for q.spilledCount() != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for events to be spilled, %d spilled",
+				q.spilledCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fiev := <-outChan
+	if fiev.FilePath != "file.0" {
+		t.Fatalf("unexpected event for %s", fiev.FilePath)
+	}
+	wg.Done()
+
+	// make room for one spilled event, then stop with the rest on disk
+	deadline = time.Now().Add(5 * time.Second)
+	for q.spilledCount() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for spilled event to be requeued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.Stop(nil)
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expected 3 spilled files, got %d", len(files))
+	}
+	for i := 1; i < 3; i++ {
+		fiev = <-outChan
+		if fiev.FilePath != fmt.Sprintf("file.%d", i) {
+			t.Fatalf("unexpected event for %s", fiev.FilePath)
+		}
+		wg.Done()
+	}
+	wg.Wait()
+
+	// spilled events are picked up again after a restart
+	q = MakeInputQueue(outChan, &wg, QueueSpill, dir, false)
+	q.Run()
+	defer q.Stop(nil)
+	for i := 3; i < 6; i++ {
+		select {
+		case fiev = <-outChan:
+			if fiev.FilePath != fmt.Sprintf("file.%d", i) {
+				t.Fatalf("unexpected event for %s", fiev.FilePath)
+			}
+			wg.Done()
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for spilled event")
+		}
+	}
+	wg.Wait()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		files, err = filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("spilled files not removed: %v", files)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInputQueuePersist(t *testing.T) {
+	dbdir, err := os.MkdirTemp("", "dbdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbdir)
+	err = sampledb.InitDB(dbdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	outChan := make(chan sampledb.FileInfoEvent, 3)
+	var wg sync.WaitGroup
+	q := MakeInputQueue(outChan, &wg, QueueBlock, "", true)
+	q.Run()
+	defer q.Stop(nil)
+
+	pushEvents(q, &wg, 0, 3)
+	ids := make([]uint64, 0)
+	for i := 0; i < 3; i++ {
+		fiev := <-outChan
+		if fiev.QueueID == 0 {
+			t.Fatalf("event for %s not persisted", fiev.FilePath)
+		}
+		ids = append(ids, fiev.QueueID)
+		if i == 1 {
+			dequeueEvent(fiev)
+		}
+		wg.Done()
+	}
+
+	// unfinished events are replayed in order through the queue, without
+	// persisting them again
+	w := &Watcher{
+		ScanCandidateChan: make(chan sampledb.FileInfoEvent, 3),
+	}
+	w.InputQueue = MakeInputQueue(w.ScanCandidateChan, &w.WaitGroup, QueueBlock, "", true)
+	w.InputQueue.Run()
+	defer w.InputQueue.Stop(nil)
+	w.replayQueue()
+	for _, i := range []int{0, 2} {
+		fiev := <-w.ScanCandidateChan
+		if fiev.QueueID != ids[i] || fiev.FilePath != fmt.Sprintf("file.%d", i) {
+			t.Fatalf("unexpected replayed event %d for %s", fiev.QueueID, fiev.FilePath)
+		}
+		dequeueEvent(fiev)
+		w.WaitGroup.Done()
+	}
+	events, err := sampledb.QueuedEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected empty queue, got %d events", len(events))
+	}
+}
+
+func TestInputQueueStop(t *testing.T) {
+	dir, err := os.MkdirTemp("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outChan := make(chan sampledb.FileInfoEvent, 1)
+	var wg sync.WaitGroup
+	q := MakeInputQueue(outChan, &wg, QueueSpill, dir, false)
+	q.Run()
+	inputStopped := make(chan bool)
+	q.Stop(inputStopped)
+
+	// the input is still sending until it is stopped
+	pushEvents(q, &wg, 0, 2)
+	close(inputStopped)
+	wg.Wait()
+	q.Running.Wait()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 events spilled on shutdown, got %d", len(files))
+	}
+}
+
+func TestQueuePolicyFlag(t *testing.T) {
+	var p QueuePolicy
+	if p.Set("drop-oldest") != nil || p != QueueDropOldest {
+		t.Fatal("valid policy rejected")
+	}
+	if p.Set("drop-newest") == nil {
+		t.Fatal("invalid policy accepted")
+	}
+}
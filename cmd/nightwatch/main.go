@@ -19,13 +19,11 @@ import (
 	"github.com/DCSO/nightwatch/sampledb"
 	"github.com/DCSO/nightwatch/submitter"
 	"github.com/DCSO/nightwatch/uploader"
+	"github.com/DCSO/nightwatch/util"
 
 	// Plugins are registered using the following imports
 	_ "github.com/DCSO/nightwatch/plugins/yarascanner"
 
-	"github.com/NeowayLabs/wabbit"
-	"github.com/NeowayLabs/wabbit/amqp"
-	"github.com/NeowayLabs/wabbit/amqptest"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -75,23 +73,33 @@ func main() {
 	var u *uploader.Uploader
 	var filestoreVersion = flag.Int("storeversion", 2, "Filestore version")
 	var sockPath = flag.String("socket", "/tmp/files.sock", "Path for fileinfo EVE input socket")
+	var redisAddr = flag.String("redis", "", "Address of Redis server to read fileinfo EVE input from instead of socket")
+	var redisPass = flag.String("redispass", "", "Password for the Redis connection")
+	var redisDB = flag.Int("redisdb", 0, "Redis database number")
+	var redisKey = flag.String("rediskey", "suricata", "Redis list or channel key to read EVE input from")
+	var redisMode = flag.String("redismode", RedisModeList, "Redis EVE input mode (list or channel)")
 	var suriFilesDir = flag.String("dir", "/var/log/suricata/filestore", "Directory where suricata stores files")
 	var logPath = flag.String("log", "/var/log/", "Path for nightwatch log files")
 	var dataPath = flag.String("data", "/var/lib/nightwatch/", "Path for the file database")
-	var amqpURI = flag.String("amqpuri", "localhost:5672", "Endpoint and port for the AMQP connection")
-	var amqpExchange = flag.String("amqpexch", "nightwatch", "Exchange to post messages to")
-	var amqpUser = flag.String("amqpuser", "sensor", "User name for the AMQP connection")
-	var amqpPass = flag.String("amqppass", "sensor", "Password for the AMQP connection")
-	var dummy = flag.Bool("dummy", false, "Log verdicts to file instead of submitting to AMQP")
+	var truncatedConfig = registry.DefaultTruncatedConfig()
+	flag.Var(&truncatedConfig.Policy, "truncated", "Policy for truncated files (scan, skip or quarantine)")
+	flag.StringVar(&truncatedConfig.QuarantineDir, "quarantinedir", truncatedConfig.QuarantineDir, "Directory to move truncated files to")
+	var watcherConfig = DefaultWatcherConfig()
+	flag.IntVar(&watcherConfig.Workers, "workers", watcherConfig.Workers, "number of workers scanning files")
+	flag.IntVar(&watcherConfig.HeavyWorkers, "heavyworkers", watcherConfig.HeavyWorkers, "number of separate workers for expensive plugins (0 to use the regular workers)")
+	flag.IntVar(&watcherConfig.QueueSize, "queuesize", watcherConfig.QueueSize, "number of events queued for scanning")
+	flag.Var(&watcherConfig.QueuePolicy, "queuepolicy", "Policy when the scan queue is full (block, drop-oldest or spill)")
+	flag.StringVar(&watcherConfig.SpillDir, "spilldir", watcherConfig.SpillDir, "Directory to spill queued events to")
+	flag.BoolVar(&watcherConfig.PersistQueue, "persistqueue", watcherConfig.PersistQueue, "keep queued events in the database until they are processed")
+	flag.IntVar(&watcherConfig.RetryMax, "retrymax", watcherConfig.RetryMax, "max number of rechecks for files not yet completely written")
+	flag.DurationVar(&watcherConfig.RetryDelay, "retrydelay", watcherConfig.RetryDelay, "initial delay before rechecking files not yet completely written")
+	flag.BoolVar(&watcherConfig.RetryWaitMeta, "retrywaitmeta", watcherConfig.RetryWaitMeta, "wait for metafiles to appear before scanning files")
 	var profileFile = flag.String("proffile", "", "Dump profiling information to file")
 	var memProfileFile = flag.String("mproffile", "", "Dump memory profiling information to file")
-	var uploadEndpoint = flag.String("uploadendpoint", "", "Endpoint for suspicious file S3 upload")
-	var uploadAccessKey = flag.String("uploadaccesskey", "", "Access key for S3 upload")
-	var uploadSecretAccessKey = flag.String("uploadsecretaccesskey", "", "Secret access key for S3 upload")
-	var uploadBucketName = flag.String("uploadbucket", "", "Bucket name for S3 upload")
-	var uploadRegion = flag.String("uploadregion", "", "Region for S3 upload")
-	var uploadScratchDir = flag.String("uploadscratchdir", "/tmp/nightwatch_scratch", "Temp directory for S3 upload")
-	var uploadSSL = flag.Bool("uploadssl", false, "Use SSL for S3 upload")
+	var outbox = flag.Bool("outbox", true, "Store verdicts in the database until they are submitted")
+	var outboxAttempts = flag.Int("outboxattempts", 20, "Max number of attempts to submit a verdict from the outbox before moving it to the dead letters, 0 for no limit")
+	var outboxRequeue = flag.Bool("outboxrequeue", false, "Move dead letters back into the outbox on startup")
+	var backlog = flag.Bool("backlog", true, "Walk the filestore on startup to pick up files not processed before")
 	var profSrv = flag.Bool("profsrv", false, "Enable profiling server on port 6060")
 	var verbose = flag.Bool("verbose", false, "Verbose output")
 	var logJSON = flag.Bool("logjson", false, "JSON log output")
@@ -154,43 +162,13 @@ func main() {
 		}()
 	}
 
-	// Create submitter
-	if *dummy {
-		log.Info("disabling verdict submission")
-		s = submitter.MakeDummySubmitter()
-	} else {
-		s, err = submitter.MakeAMQPSubmitterWithReconnector(*amqpURI, *amqpUser, *amqpPass,
-			*amqpExchange, *verbose, func(url string) (wabbit.Conn, string, error) {
-				log.Info(url)
-				if testMode {
-					c, e := amqptest.Dial(url)
-					return c, "direct", e
-				}
-				c, e := amqp.Dial(url)
-				return c, "fanout", e
-			})
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	defer s.Finish()
-
-	// Create uploader
-	if len(*uploadEndpoint) > 0 {
-		err = os.MkdirAll(*uploadScratchDir, os.ModePerm)
-		if err != nil {
-			log.Fatal(err)
-		}
-		u, err = uploader.MakeS3Uploader(uploader.S3Credentials{
-			Endpoint:        *uploadEndpoint,
-			AccessKey:       *uploadAccessKey,
-			SecretAccessKey: *uploadSecretAccessKey,
-			BucketName:      *uploadBucketName,
-			Region:          *uploadRegion,
-		}, *uploadSSL, *suriFilesDir, *uploadScratchDir, s)
+	// Export verdicts instead of processing files
+	if len(*exportSTIXPath) > 0 {
+		err = exportSTIX(*dataPath, *exportSTIXPath)
 		if err != nil {
 			log.Fatal(err)
 		}
+		return
 	}
 
 	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
@@ -212,12 +190,57 @@ func main() {
 	}
 	defer sampledb.CloseDB()
 
+	// Create submitter
+	s, err = makeSubmitter(*verbose, *outbox, *outboxAttempts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Keep verdicts in the outbox until they are submitted; several sinks
+	// have their own outboxes already
+	if *outbox {
+		if m, ok := s.(*submitter.MultiSubmitter); ok {
+			err = m.Sweep()
+			if err == nil && *outboxRequeue {
+				err = m.Requeue()
+			}
+			if err != nil {
+				log.Error(err)
+			}
+		} else {
+			o := submitter.MakeOutboxSubmitter(s)
+			o.MaxAttempts = *outboxAttempts
+			err = o.Sweep()
+			if err == nil && *outboxRequeue {
+				err = o.Requeue()
+			}
+			if err != nil {
+				log.Error(err)
+			}
+			o.Run()
+			s = o
+		}
+	}
+	defer s.Finish()
+
+	// Create uploader
+	if uploadEnabled() {
+		u, err = makeUploader(s, *suriFilesDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	InitializePlugins()
+	registry.SetTruncatedConfig(truncatedConfig)
 
 	// Prepare watcher
 	finishNotify := make(chan bool)
-	w := MakeWatcher(finishNotify, s, u)
-	w.backlogBuilder(*suriFilesDir, s, *filestoreVersion)
+	w := MakeWatcher(finishNotify, s, u, watcherConfig)
+	w.replayQueue()
+	if *backlog {
+		w.backlogBuilder(*suriFilesDir, s, *filestoreVersion)
+	}
 
 	janitorNotify := make(chan bool)
 	j := MakeJanitor(janitorNotify)
@@ -245,19 +268,14 @@ func main() {
 				w.backlogBuilder(*suriFilesDir, s, *filestoreVersion)
 			case syscall.SIGUSR2:
 				log.Info("Received SIGUSR2, rescanning from scratch", *suriFilesDir)
-				sampledb.CloseDB()
-				err = os.Remove(filepath.Join(*dataPath, sampledb.DatabaseName))
-				if err != nil {
-					log.Fatal(err)
-				}
-				err = sampledb.InitDB(*dataPath)
+				err = sampledb.ResetSamples()
 				if err != nil {
 					log.Fatal(err)
 				}
 				w.backlogBuilder(*suriFilesDir, s, *filestoreVersion)
 			case os.Interrupt, syscall.SIGTERM:
 				log.Info("Received request to stop, stopping janitor and watcher...")
-				if len(*uploadEndpoint) > 0 {
+				if u != nil {
 					u.Stop()
 				}
 				w.Finish()
@@ -269,7 +287,15 @@ func main() {
 	}()
 
 	// start watching directory events...
-	err = w.Run(*suriFilesDir, *filestoreVersion, *sockPath)
+	if len(*redisAddr) > 0 {
+		err = w.RunInput(*suriFilesDir, *filestoreVersion, func(outChan chan sampledb.FileInfoEvent,
+			fileDir string, wg *sync.WaitGroup, version util.FilestoreVersion) (Input, error) {
+			return MakeRedisInput(*redisAddr, *redisPass, *redisDB, *redisKey, *redisMode,
+				outChan, fileDir, wg, version)
+		})
+	} else {
+		err = w.Run(*suriFilesDir, *filestoreVersion, *sockPath)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
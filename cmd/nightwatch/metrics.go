@@ -0,0 +1,25 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"expvar"
+)
+
+// Counters exported via expvar, available at /debug/vars when the profiling
+// server is enabled.
+var (
+	// metricRetryDeferred counts events deferred because their file was not
+	// yet completely written.
+	metricRetryDeferred = expvar.NewInt("retry_deferred")
+	// metricRetryDropped counts events dropped after exceeding the maximum
+	// number of retries.
+	metricRetryDropped = expvar.NewInt("retry_dropped")
+	// metricQueueFull counts events arriving while the scan queue was full.
+	metricQueueFull = expvar.NewInt("queue_full")
+	// metricQueueDropped counts events dropped from the full scan queue.
+	metricQueueDropped = expvar.NewInt("queue_dropped")
+	// metricQueueSpilled counts events spilled to disk.
+	metricQueueSpilled = expvar.NewInt("queue_spilled")
+)
@@ -0,0 +1,361 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+	"github.com/DCSO/nightwatch/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RedisModeList makes a RedisInput pop events from a list, matching
+	// Suricata's 'list' Redis EVE output mode.
+	RedisModeList = "list"
+	// RedisModeChannel makes a RedisInput subscribe to a pub/sub channel,
+	// matching Suricata's 'channel' Redis EVE output mode.
+	RedisModeChannel = "channel"
+
+	redisReconnDelay = 2 * time.Second
+	redisDialTimeout = 5 * time.Second
+)
+
+// RedisInput is an Input reading JSON EVE input from a Redis list or pub/sub
+// channel, as written by Suricata's Redis EVE output.
+type RedisInput struct {
+	EventChan    chan sampledb.FileInfoEvent
+	Verbose      bool
+	Running      bool
+	StoreVersion util.FilestoreVersion
+	StopChan     chan bool
+	StoppedChan  chan bool
+	WaitGroup    *sync.WaitGroup
+	FileDir      string
+	Addr         string
+	Password     string
+	DB           int
+	Key          string
+	Mode         string
+	Conn         net.Conn
+	ConnMutex    sync.Mutex
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// writeRedisCommand sends a command in RESP array notation.
+func writeRedisCommand(w io.Writer, args ...string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readRedisReply reads a single RESP value. Simple strings are returned as
+// string, bulk strings as []byte, integers as int64 and arrays as
+// []interface{}. Null bulk strings and arrays are returned as nil, error
+// replies as redisError.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty RESP line")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], err = readRedisReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected RESP type '%c'", line[0])
+}
+
+// redisCall sends a command and returns its reply, turning error replies into
+// errors.
+func redisCall(c net.Conn, r *bufio.Reader, args ...string) (interface{}, error) {
+	err := writeRedisCommand(c, args...)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := readRedisReply(r)
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := reply.(redisError); ok {
+		return nil, rerr
+	}
+	return reply, nil
+}
+
+func (ri *RedisInput) stopping() bool {
+	select {
+	case <-ri.StopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ri *RedisInput) connect() (*bufio.Reader, error) {
+	c, err := net.DialTimeout("tcp", ri.Addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(c)
+	if ri.Password != "" {
+		_, err = redisCall(c, reader, "AUTH", ri.Password)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if ri.DB != 0 {
+		_, err = redisCall(c, reader, "SELECT", strconv.Itoa(ri.DB))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	ri.ConnMutex.Lock()
+	ri.Conn = c
+	ri.ConnMutex.Unlock()
+	// Stop() might have been called while we were dialing
+	if ri.stopping() {
+		c.Close()
+		return nil, fmt.Errorf("input stopped")
+	}
+	return reader, nil
+}
+
+func (ri *RedisInput) closeConn() {
+	ri.ConnMutex.Lock()
+	if ri.Conn != nil {
+		ri.Conn.Close()
+		ri.Conn = nil
+	}
+	ri.ConnMutex.Unlock()
+}
+
+// consumeList pops events from the configured list until the connection
+// fails or the input is stopped.
+func (ri *RedisInput) consumeList(reader *bufio.Reader) error {
+	for !ri.stopping() {
+		ri.ConnMutex.Lock()
+		c := ri.Conn
+		ri.ConnMutex.Unlock()
+		if c == nil {
+			return nil
+		}
+		reply, err := redisCall(c, reader, "BLPOP", ri.Key, "1")
+		if err != nil {
+			return err
+		}
+		if reply == nil {
+			// timeout, nothing to read
+			continue
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return fmt.Errorf("unexpected BLPOP reply: %v", reply)
+		}
+		line, ok := items[1].([]byte)
+		if !ok {
+			return fmt.Errorf("unexpected BLPOP value: %v", items[1])
+		}
+		handleEVELine(line, ri.EventChan, ri.WaitGroup, ri.FileDir, ri.StoreVersion)
+	}
+	return nil
+}
+
+// consumeChannel subscribes to the configured channel, or channel pattern if
+// the key contains a '*', and processes published events until the
+// connection fails or the input is stopped.
+func (ri *RedisInput) consumeChannel(reader *bufio.Reader) error {
+	cmd := "SUBSCRIBE"
+	if strings.Contains(ri.Key, "*") {
+		cmd = "PSUBSCRIBE"
+	}
+	ri.ConnMutex.Lock()
+	c := ri.Conn
+	ri.ConnMutex.Unlock()
+	if c == nil {
+		return nil
+	}
+	err := writeRedisCommand(c, cmd, ri.Key)
+	if err != nil {
+		return err
+	}
+	for !ri.stopping() {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return err
+		}
+		if rerr, ok := reply.(redisError); ok {
+			return rerr
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) < 3 {
+			return fmt.Errorf("unexpected pub/sub reply: %v", reply)
+		}
+		kind, _ := items[0].([]byte)
+		switch string(kind) {
+		case "message":
+			if line, ok := items[2].([]byte); ok {
+				handleEVELine(line, ri.EventChan, ri.WaitGroup, ri.FileDir, ri.StoreVersion)
+			}
+		case "pmessage":
+			if len(items) == 4 {
+				if line, ok := items[3].([]byte); ok {
+					handleEVELine(line, ri.EventChan, ri.WaitGroup, ri.FileDir, ri.StoreVersion)
+				}
+			}
+		case "subscribe", "psubscribe":
+			log.Debugf("subscribed to Redis channel %s", ri.Key)
+		}
+	}
+	return nil
+}
+
+func (ri *RedisInput) handleServerConnection() {
+	for {
+		if ri.stopping() {
+			close(ri.StoppedChan)
+			return
+		}
+		reader, err := ri.connect()
+		if err == nil {
+			log.Debugf("connected to Redis at %s", ri.Addr)
+			switch ri.Mode {
+			case RedisModeChannel:
+				err = ri.consumeChannel(reader)
+			default:
+				err = ri.consumeList(reader)
+			}
+			ri.closeConn()
+		}
+		if ri.stopping() {
+			close(ri.StoppedChan)
+			return
+		}
+		if err != nil {
+			log.Warnf("Redis input error: %s", err)
+		}
+		select {
+		case <-ri.StopChan:
+		case <-time.After(redisReconnDelay):
+		}
+	}
+}
+
+// MakeRedisInput returns a new RedisInput reading from the list or channel
+// key on the Redis server at addr and writing parsed events to outChan.
+func MakeRedisInput(addr, password string, db int, key string, mode string,
+	outChan chan sampledb.FileInfoEvent, fileDir string, wg *sync.WaitGroup,
+	version util.FilestoreVersion) (*RedisInput, error) {
+	if mode != RedisModeList && mode != RedisModeChannel {
+		return nil, fmt.Errorf("invalid Redis input mode: %s", mode)
+	}
+	if key == "" {
+		return nil, errors.New("empty Redis key")
+	}
+	ri := &RedisInput{
+		EventChan:    outChan,
+		Verbose:      false,
+		StopChan:     make(chan bool),
+		WaitGroup:    wg,
+		FileDir:      fileDir,
+		StoreVersion: version,
+		Addr:         addr,
+		Password:     password,
+		DB:           db,
+		Key:          key,
+		Mode:         mode,
+	}
+	return ri, nil
+}
+
+// Run starts the RedisInput
+func (ri *RedisInput) Run() {
+	if !ri.Running {
+		ri.Running = true
+		ri.StopChan = make(chan bool)
+		go ri.handleServerConnection()
+	}
+}
+
+// Stop causes the RedisInput to stop reading from Redis and close all
+// associated channels, including the passed notification channel.
+func (ri *RedisInput) Stop(stoppedChan chan bool) {
+	if ri != nil && ri.Running {
+		ri.StoppedChan = stoppedChan
+		close(ri.StopChan)
+		ri.closeConn()
+		ri.Running = false
+	} else {
+		close(stoppedChan)
+	}
+}
+
+// SetVerbose sets the input's verbosity level
+func (ri *RedisInput) SetVerbose(verbose bool) {
+	ri.Verbose = verbose
+}
+
+// String returns a description of the RedisInput.
+func (ri *RedisInput) String() string {
+	return fmt.Sprintf("Redis %s %s at %s", ri.Mode, ri.Key, ri.Addr)
+}
@@ -0,0 +1,211 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeRedis is a minimal stand-in for a Redis server, answering BLPOP from an
+// in-memory list and delivering published messages to SUBSCRIBE clients.
+type fakeRedis struct {
+	Listener net.Listener
+	Lock     sync.Mutex
+	List     [][]byte
+	Messages chan []byte
+	Commands []string
+}
+
+func makeFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{
+		Listener: l,
+		Messages: make(chan []byte, 10),
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(c)
+		}
+	}()
+	return fr
+}
+
+func writeBulk(c net.Conn, data []byte) {
+	fmt.Fprintf(c, "$%d\r\n%s\r\n", len(data), data)
+}
+
+func (fr *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		req, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		items, ok := req.([]interface{})
+		if !ok || len(items) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(string(items[0].([]byte)))
+		fr.Lock.Lock()
+		fr.Commands = append(fr.Commands, cmd)
+		fr.Lock.Unlock()
+		switch cmd {
+		case "AUTH", "SELECT":
+			c.Write([]byte("+OK\r\n"))
+		case "BLPOP":
+			var val []byte
+			fr.Lock.Lock()
+			if len(fr.List) > 0 {
+				val = fr.List[0]
+				fr.List = fr.List[1:]
+			}
+			fr.Lock.Unlock()
+			if val == nil {
+				time.Sleep(100 * time.Millisecond)
+				c.Write([]byte("*-1\r\n"))
+				continue
+			}
+			c.Write([]byte("*2\r\n"))
+			writeBulk(c, items[1].([]byte))
+			writeBulk(c, val)
+		case "SUBSCRIBE":
+			c.Write([]byte("*3\r\n"))
+			writeBulk(c, []byte("subscribe"))
+			writeBulk(c, items[1].([]byte))
+			c.Write([]byte(":1\r\n"))
+			for msg := range fr.Messages {
+				c.Write([]byte("*3\r\n"))
+				writeBulk(c, []byte("message"))
+				writeBulk(c, items[1].([]byte))
+				writeBulk(c, msg)
+			}
+			return
+		default:
+			c.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+func (fr *fakeRedis) Close() {
+	fr.Listener.Close()
+	close(fr.Messages)
+}
+
+func makeRedisTestFile(t *testing.T, dir string) (socketMessage, string) {
+	msg := socketMessage{
+		EventType: "fileinfo",
+		FileInfo: socketMessageFileinfo{
+			Filename: "foo",
+			FileID:   23,
+			Stored:   true,
+			Magic:    "PE32 executable (GUI) Intel 80386, for MS Windows",
+			Sha256:   "40c38478248ab915fc6d988b54860d0eec3f1e6ff3c968d65ff8d0840614382f",
+		},
+	}
+	err := os.MkdirAll(filepath.Join(dir, "files", "40"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseFileName := filepath.Join(dir, "files", "40", msg.FileInfo.Sha256)
+	err = os.WriteFile(baseFileName, []byte("123"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, baseFileName
+}
+
+func _TestRedisInput(t *testing.T, mode string) {
+	dir, err := os.MkdirTemp("", "test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	message1, baseFileName := makeRedisTestFile(t, dir)
+	msgBytes, err := json.Marshal(message1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr := makeFakeRedis(t)
+	defer fr.Close()
+	if mode == RedisModeList {
+		fr.List = append(fr.List, []byte(`{"event_type":"flow"}`), msgBytes)
+	} else {
+		fr.Messages <- []byte(`{"event_type":"flow"}`)
+		fr.Messages <- msgBytes
+	}
+
+	fileEventChan := make(chan sampledb.FileInfoEvent)
+	var wg sync.WaitGroup
+	ri, err := MakeRedisInput(fr.Listener.Addr().String(), "secret", 2, "suricata",
+		mode, fileEventChan, filepath.Join(dir, "files"), &wg, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ri.Run()
+
+	select {
+	case fe := <-fileEventChan:
+		if fe.FilePath != baseFileName {
+			t.Fatalf("wrong file path: %s != %s", fe.FilePath, baseFileName)
+		}
+		wg.Done()
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for file event")
+	}
+
+	stopped := make(chan bool)
+	ri.Stop(stopped)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for input to stop")
+	}
+	wg.Wait()
+
+	fr.Lock.Lock()
+	defer fr.Lock.Unlock()
+	if len(fr.Commands) < 3 || fr.Commands[0] != "AUTH" || fr.Commands[1] != "SELECT" {
+		t.Fatalf("unexpected command sequence: %v", fr.Commands)
+	}
+}
+
+func TestRedisInputList(t *testing.T) {
+	_TestRedisInput(t, RedisModeList)
+}
+
+func TestRedisInputChannel(t *testing.T) {
+	_TestRedisInput(t, RedisModeChannel)
+}
+
+func TestRedisInputInvalidMode(t *testing.T) {
+	var wg sync.WaitGroup
+	_, err := MakeRedisInput("localhost:6379", "", 0, "suricata", "stream",
+		make(chan sampledb.FileInfoEvent), "/tmp", &wg, 2)
+	if err == nil {
+		t.Fatal("expected error for invalid mode")
+	}
+}
@@ -0,0 +1,260 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+	"github.com/DCSO/nightwatch/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const maxRetryDelay = 1 * time.Minute
+
+type retryEntry struct {
+	Event     sampledb.FileInfoEvent
+	NextCheck time.Time
+	LastSize  int64
+}
+
+// RetryQueue holds FileInfoEvents for files which are not present or are
+// still being written, rechecking them with exponential backoff until they
+// are complete or the maximum number of attempts is exceeded.
+type RetryQueue struct {
+	OutChan     chan sampledb.FileInfoEvent
+	WaitGroup   *sync.WaitGroup
+	MaxAttempts int
+	BaseDelay   time.Duration
+	WaitMeta    bool
+	CheckTick   time.Duration
+	Lock        sync.Mutex
+	Entries     []retryEntry
+	Stopped     bool
+	StopChan    chan bool
+	StoppedChan chan bool
+}
+
+// MakeRetryQueue returns a new RetryQueue emitting ready events on outChan.
+// Each event held in the queue keeps its count in wg until it is emitted or
+// dropped.
+func MakeRetryQueue(outChan chan sampledb.FileInfoEvent, wg *sync.WaitGroup,
+	maxAttempts int, baseDelay time.Duration, waitMeta bool) *RetryQueue {
+	return &RetryQueue{
+		OutChan:     outChan,
+		WaitGroup:   wg,
+		MaxAttempts: maxAttempts,
+		BaseDelay:   baseDelay,
+		WaitMeta:    waitMeta,
+		CheckTick:   100 * time.Millisecond,
+		Entries:     make([]retryEntry, 0),
+		StopChan:    make(chan bool),
+		StoppedChan: make(chan bool),
+	}
+}
+
+// expectedFileSize returns the file size given in the fileinfo event, or -1
+// if it is not known. Files with gaps or not properly closed by Suricata will
+// likely never reach the size given, so we do not expect any size for them.
+func expectedFileSize(fiev sampledb.FileInfoEvent) int64 {
+	if fiev.Event == nil {
+		return -1
+	}
+	if fiev.Event.File.Gaps || fiev.Event.File.State != "CLOSED" {
+		return -1
+	}
+	return fiev.Event.File.Size
+}
+
+func metaFilePresent(fiev sampledb.FileInfoEvent) bool {
+	switch fiev.StoreVersion {
+	case util.V1:
+		_, err := os.Stat(fmt.Sprintf("%s.meta", fiev.FilePath))
+		return err == nil
+	case util.V2:
+		metaFiles, err := filepath.Glob(fmt.Sprintf("%s.*.json", fiev.FilePath))
+		return err == nil && len(metaFiles) > 0
+	}
+	return true
+}
+
+// check returns whether the file referenced by the event looks complete,
+// along with its current size. If no size is known from the fileinfo event,
+// the file is only considered complete once its size has not changed since
+// lastSize was observed.
+func (q *RetryQueue) check(fiev sampledb.FileInfoEvent, lastSize int64) (bool, int64) {
+	fi, err := os.Stat(fiev.FilePath)
+	if err != nil {
+		return false, -1
+	}
+	if expected := expectedFileSize(fiev); expected > 0 {
+		if fi.Size() < expected {
+			return false, fi.Size()
+		}
+	} else if fi.Size() != lastSize {
+		return false, fi.Size()
+	}
+	if q.WaitMeta && !metaFilePresent(fiev) {
+		return false, fi.Size()
+	}
+	return true, fi.Size()
+}
+
+// Ready checks whether the file referenced by the event is ready to be
+// processed. If it is not, the event is taken over by the queue and will be
+// emitted on the queue's output channel once the file is complete.
+func (q *RetryQueue) Ready(fiev sampledb.FileInfoEvent) bool {
+	lastSize := int64(-1)
+	if fiev.Event == nil || fiev.Retries > 0 {
+		// Events found by walking the filestore refer to files written
+		// long ago, and requeued events have already been seen to be
+		// stable, so there is no need to watch them grow.
+		lastSize = currentFileSize(fiev.FilePath)
+	}
+	ok, size := q.check(fiev, lastSize)
+	if ok {
+		return true
+	}
+	q.add(fiev, size)
+	return false
+}
+
+func currentFileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+func (q *RetryQueue) delay(attempt int) time.Duration {
+	d := q.BaseDelay
+	for i := 1; i < attempt && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+func (q *RetryQueue) drop(fiev sampledb.FileInfoEvent, reason string) {
+	metricRetryDropped.Add(1)
+	log.Warnf("dropping event for file %s after %d attempts: %s", fiev.FilePath,
+		fiev.Retries, reason)
+	q.WaitGroup.Done()
+}
+
+func (q *RetryQueue) add(fiev sampledb.FileInfoEvent, size int64) {
+	fiev.Retries++
+	q.Lock.Lock()
+	defer q.Lock.Unlock()
+	if q.Stopped {
+		q.drop(fiev, "retry queue stopped")
+		return
+	}
+	if fiev.Retries > q.MaxAttempts {
+		dequeueEvent(fiev)
+		q.drop(fiev, "file not complete")
+		return
+	}
+	metricRetryDeferred.Add(1)
+	log.Debugf("file %s not complete yet, rechecking (attempt %d)", fiev.FilePath, fiev.Retries)
+	q.Entries = append(q.Entries, retryEntry{
+		Event:     fiev,
+		NextCheck: time.Now().Add(q.delay(fiev.Retries)),
+		LastSize:  size,
+	})
+}
+
+// due removes and returns all entries which are due for a recheck.
+func (q *RetryQueue) due() []retryEntry {
+	now := time.Now()
+	q.Lock.Lock()
+	defer q.Lock.Unlock()
+	var due []retryEntry
+	remaining := q.Entries[:0]
+	for _, e := range q.Entries {
+		if now.After(e.NextCheck) {
+			due = append(due, e)
+		} else {
+			remaining = append(remaining, e)
+		}
+	}
+	q.Entries = remaining
+	return due
+}
+
+func (q *RetryQueue) emit(fiev sampledb.FileInfoEvent) {
+	select {
+	case q.OutChan <- fiev:
+	case <-q.StopChan:
+		q.drop(fiev, "retry queue stopped")
+	}
+}
+
+// Run starts rechecking queued events in the background.
+func (q *RetryQueue) Run() {
+	go func() {
+		for {
+			select {
+			case <-q.StopChan:
+				close(q.StoppedChan)
+				return
+			case <-time.After(q.CheckTick):
+				for _, e := range q.due() {
+					// check only waits for the size to settle if no size
+					// is expected, a file which has reached it is complete
+					ok, size := q.check(e.Event, e.LastSize)
+					if ok {
+						log.Debugf("file %s complete, requeueing", e.Event.FilePath)
+						q.emit(e.Event)
+					} else if e.Event.Retries >= q.MaxAttempts && size >= 0 && size == e.LastSize {
+						// The file is there but did not reach the expected
+						// size. It is not growing anymore, so we pass it on
+						// to be handled as truncated file.
+						log.Infof("file %s did not reach expected size, requeueing as is",
+							e.Event.FilePath)
+						q.emit(e.Event)
+					} else {
+						q.add(e.Event, size)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Stop causes the RetryQueue to cease rechecking files. All events still held
+// are dropped, but remain in the persistent scan queue if they were stored
+// there.
+func (q *RetryQueue) Stop() {
+	q.Lock.Lock()
+	if q.Stopped {
+		q.Lock.Unlock()
+		return
+	}
+	q.Stopped = true
+	close(q.StopChan)
+	q.Lock.Unlock()
+	<-q.StoppedChan
+	q.Lock.Lock()
+	for _, e := range q.Entries {
+		q.drop(e.Event, "retry queue stopped")
+	}
+	q.Entries = nil
+	q.Lock.Unlock()
+}
+
+// Len returns the number of events currently held in the queue.
+func (q *RetryQueue) Len() int {
+	q.Lock.Lock()
+	defer q.Lock.Unlock()
+	return len(q.Entries)
+}
@@ -0,0 +1,252 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+	"github.com/DCSO/nightwatch/util"
+)
+
+func TestRetryQueueLateFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outChan := make(chan sampledb.FileInfoEvent, 1)
+	var wg sync.WaitGroup
+	q := MakeRetryQueue(outChan, &wg, 5, 100*time.Millisecond, false)
+	q.Run()
+	defer q.Stop()
+
+	fiev := sampledb.FileInfoEvent{
+		StoreVersion: util.V1,
+		FilePath:     filepath.Join(dir, "file.1"),
+		Event: &sampledb.EventInfo{
+			File: sampledb.FileEventInfo{
+				State: "CLOSED",
+				Size:  6,
+			},
+		},
+	}
+	wg.Add(1)
+	if q.Ready(fiev) {
+		t.Fatal("missing file reported as ready")
+	}
+
+	// file appears, but is not completely written yet
+	err = os.WriteFile(fiev.FilePath, []byte("foo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-outChan:
+		t.Fatal("incomplete file requeued")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	err = os.WriteFile(fiev.FilePath, []byte("foobar"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-outChan:
+		if e.FilePath != fiev.FilePath {
+			t.Fatalf("wrong file path: %s", e.FilePath)
+		}
+		if e.Retries == 0 {
+			t.Fatal("retries not counted")
+		}
+		if !q.Ready(e) {
+			t.Fatal("complete file not reported as ready")
+		}
+		wg.Done()
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for requeued event")
+	}
+	wg.Wait()
+}
+
+func TestRetryQueueDrop(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outChan := make(chan sampledb.FileInfoEvent, 1)
+	var wg sync.WaitGroup
+	q := MakeRetryQueue(outChan, &wg, 2, 50*time.Millisecond, false)
+	q.Run()
+	defer q.Stop()
+
+	dropped := metricRetryDropped.Value()
+	wg.Add(1)
+	if q.Ready(sampledb.FileInfoEvent{
+		FilePath: filepath.Join(dir, "file.2"),
+	}) {
+		t.Fatal("missing file reported as ready")
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event to be dropped")
+	}
+	if metricRetryDropped.Value() != dropped+1 {
+		t.Fatal("dropped event not counted")
+	}
+	if q.Len() != 0 {
+		t.Fatalf("unexpected queue length %d", q.Len())
+	}
+}
+
+func TestRetryQueueWaitMeta(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outChan := make(chan sampledb.FileInfoEvent, 1)
+	var wg sync.WaitGroup
+	q := MakeRetryQueue(outChan, &wg, 5, 50*time.Millisecond, true)
+	q.Run()
+	defer q.Stop()
+
+	util.CreateFilePair(3, []byte("foo bar"), 10, dir)
+	fiev := sampledb.FileInfoEvent{
+		StoreVersion: util.V1,
+		FilePath:     filepath.Join(dir, "file.3"),
+	}
+	if !q.Ready(fiev) {
+		t.Fatal("complete file pair not reported as ready")
+	}
+
+	err = os.Remove(filepath.Join(dir, "file.3.meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Add(1)
+	if q.Ready(fiev) {
+		t.Fatal("file without metafile reported as ready")
+	}
+	q.Stop()
+	wg.Wait()
+}
+
+func TestRetryQueueGrowingFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outChan := make(chan sampledb.FileInfoEvent, 1)
+	var wg sync.WaitGroup
+	q := MakeRetryQueue(outChan, &wg, 5, 200*time.Millisecond, false)
+	q.Run()
+	defer q.Stop()
+
+	// no size is known for files Suricata has not closed yet
+	fiev := sampledb.FileInfoEvent{
+		StoreVersion: util.V1,
+		FilePath:     filepath.Join(dir, "file.4"),
+		Event: &sampledb.EventInfo{
+			File: sampledb.FileEventInfo{
+				State: "OPEN",
+			},
+		},
+	}
+	err = os.WriteFile(fiev.FilePath, []byte("foo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Add(1)
+	if q.Ready(fiev) {
+		t.Fatal("file of unknown size reported as ready before it was seen twice")
+	}
+
+	f, err := os.OpenFile(fiev.FilePath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("bar"))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-outChan:
+		if e.Retries < 2 {
+			t.Fatalf("growing file requeued after %d attempts", e.Retries)
+		}
+		if !q.Ready(e) {
+			t.Fatal("stable file not reported as ready")
+		}
+		wg.Done()
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for requeued event")
+	}
+	wg.Wait()
+}
+
+func TestRetryQueueExpectedSize(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outChan := make(chan sampledb.FileInfoEvent, 1)
+	var wg sync.WaitGroup
+	q := MakeRetryQueue(outChan, &wg, 5, 300*time.Millisecond, false)
+	q.Run()
+	defer q.Stop()
+
+	fiev := sampledb.FileInfoEvent{
+		StoreVersion: util.V1,
+		FilePath:     filepath.Join(dir, "file.5"),
+		Event: &sampledb.EventInfo{
+			File: sampledb.FileEventInfo{
+				State: "CLOSED",
+				Size:  6,
+			},
+		},
+	}
+	wg.Add(1)
+	if q.Ready(fiev) {
+		t.Fatal("missing file reported as ready")
+	}
+
+	// a file which has reached the expected size by the first recheck is
+	// requeued right away, without waiting for its size to settle
+	err = os.WriteFile(fiev.FilePath, []byte("foobar"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-outChan:
+		if e.Retries != 1 {
+			t.Fatalf("complete file requeued after %d attempts", e.Retries)
+		}
+		wg.Done()
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for requeued event")
+	}
+	wg.Wait()
+}
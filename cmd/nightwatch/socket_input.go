@@ -5,12 +5,9 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
-	"fmt"
 	"io"
 	"net"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
 
@@ -35,19 +32,6 @@ type SocketInput struct {
 	Conn          net.Conn
 }
 
-type socketMessageFileinfo struct {
-	Filename string `json:"filename"`
-	FileID   uint64 `json:"file_id"`
-	Stored   bool   `json:"stored"`
-	Magic    string `json:"magic"`
-	Sha256   string `json:"sha256"`
-}
-
-type socketMessage struct {
-	EventType string                `json:"event_type"`
-	FileInfo  socketMessageFileinfo `json:"fileinfo"`
-}
-
 func (si *SocketInput) handleServerConnection() {
 	for {
 		log.Debug("waiting for new connection")
@@ -79,75 +63,7 @@ func (si *SocketInput) handleServerConnection() {
 					break
 				}
 
-				var fullMsg interface{}
-				var m socketMessage
-
-				err = json.Unmarshal(line, &fullMsg)
-				if err != nil {
-					log.Errorf("could not unmarshal JSON '%s': %s", string(line), err)
-					continue
-				}
-				err = json.Unmarshal(line, &m)
-				if err != nil {
-					log.Errorf("could not unmarshal JSON '%s': %s", string(line), err)
-					continue
-				}
-
-				if m.EventType == "fileinfo" {
-					log.Debugf("received fileinfo: %v", m)
-					isAllowedFiletype := AllowedMagicPattern(m.FileInfo.Magic)
-
-					switch ver := si.StoreVersion; ver {
-					case util.V1:
-						filePath := filepath.Join(si.FileDir, fmt.Sprintf("file.%v", m.FileInfo.FileID))
-						if !isAllowedFiletype {
-							log.Infof("file %s: filemagic '%s' did not match interesting pattern", filePath, m.FileInfo.Magic)
-							err = DeleteFileSet(filePath, util.V1)
-							if err != nil {
-								log.Error(err)
-								continue
-							}
-						} else {
-							if m.FileInfo.Stored && m.FileInfo.FileID > 0 {
-								si.WaitGroup.Add(1)
-								fiev := sampledb.FileInfoEvent{
-									StoreVersion: util.V1,
-									JSONMessage:  fullMsg,
-									FilePath:     filePath,
-								}
-								si.EventChan <- fiev
-							} else {
-								log.Debugf("ignoring file %d (filename: %s, stored: %v)",
-									m.FileInfo.FileID, m.FileInfo.Filename, m.FileInfo.Stored)
-							}
-						}
-					case util.V2:
-						if m.FileInfo.Stored && len(m.FileInfo.Sha256) > 2 {
-							fileBasePath := filepath.Join(si.FileDir, m.FileInfo.Sha256[:2], m.FileInfo.Sha256)
-							if !isAllowedFiletype {
-								log.Infof("file %s: filemagic '%s' did not match interesting pattern", fileBasePath, m.FileInfo.Magic)
-								err = DeleteFileSet(fileBasePath, util.V2)
-								if err != nil {
-									log.Error(err)
-									continue
-								}
-							} else {
-
-								si.WaitGroup.Add(1)
-								fiev := sampledb.FileInfoEvent{
-									StoreVersion: util.V2,
-									JSONMessage:  fullMsg,
-									FilePath:     fileBasePath,
-								}
-								si.EventChan <- fiev
-							}
-						} else {
-							log.Debugf("ignoring file %s (filename: '%s', stored: %v)",
-								m.FileInfo.Sha256, m.FileInfo.Filename, m.FileInfo.Stored)
-						}
-					default:
-					}
-				}
+				handleEVELine(line, si.EventChan, si.WaitGroup, si.FileDir, si.StoreVersion)
 			}
 		}
 	}
@@ -214,3 +130,8 @@ func (si *SocketInput) Stop(stoppedChan chan bool) {
 func (si *SocketInput) SetVerbose(verbose bool) {
 	si.Verbose = verbose
 }
+
+// String returns a description of the SocketInput.
+func (si *SocketInput) String() string {
+	return "socket " + si.InputSocket
+}
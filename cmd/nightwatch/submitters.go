@@ -0,0 +1,431 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DCSO/nightwatch/stix"
+	"github.com/DCSO/nightwatch/submitter"
+	"github.com/DCSO/nightwatch/util"
+
+	"github.com/NeowayLabs/wabbit"
+	"github.com/NeowayLabs/wabbit/amqp"
+	"github.com/NeowayLabs/wabbit/amqptest"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Submitters is the list of sinks verdicts are delivered to.
+	Submitters = flag.String("submitters", "amqp", "Comma separated list of sinks to submit verdicts to (amqp, kafka, file, webhook, syslog, misp, dummy)")
+
+	dummy       = flag.Bool("dummy", false, "Log verdicts to file instead of submitting to AMQP (same as -submitters dummy)")
+	dummyFilter = flag.String("dummyfilter", "all", "Verdicts logged by dummy submitter (all, suspicious or clean)")
+
+	filePath     = flag.String("filepath", "/var/log/nightwatch/verdicts.jsonl", "File to write verdicts to, one per line")
+	fileMaxSize  = flag.Int64("filemaxsize", 100, "Size in MB after which the verdict file is rotated, 0 for no limit")
+	fileMaxAge   = flag.Duration("filemaxage", 0, "Age after which the verdict file is rotated, 0 for no limit")
+	fileKeep     = flag.Int("filekeep", 10, "Number of rotated verdict files to keep, 0 to keep all")
+	fileCompress = flag.Bool("filecompress", true, "Compress rotated verdict files with gzip")
+	fileFilter   = flag.String("filefilter", "all", "Verdicts written to file (all, suspicious or clean)")
+	fileFormat   = flag.String("fileformat", "json", "Format of verdicts written to file (json or stix)")
+
+	webhookSecretFile    = flag.String("webhooksecretfile", "", "File containing the secret to sign webhook requests with (HMAC-SHA256)")
+	webhookBatch         = flag.Int("webhookbatch", 1, "Max number of verdicts per webhook request, sent as JSON array if more than 1")
+	webhookAttempts      = flag.Int("webhookattempts", 5, "Max number of attempts to deliver verdicts to a webhook")
+	webhookTimeout       = flag.Duration("webhooktimeout", 10*time.Second, "Timeout for webhook requests")
+	webhookDeadLetterDir = flag.String("webhookdeadletterdir", "/var/lib/nightwatch/deadletter", "Directory for verdicts which could not be delivered to a webhook")
+	webhookFilter        = flag.String("webhookfilter", "all", "Verdicts posted to webhooks (all, suspicious or clean)")
+	webhookFormat        = flag.String("webhookformat", "json", "Format of verdicts posted to webhooks (json or stix)")
+
+	kafkaBrokers     = flag.String("kafkabrokers", "localhost:9092", "Comma separated list of Kafka bootstrap brokers")
+	kafkaTopic       = flag.String("kafkatopic", "nightwatch", "Kafka topic to produce verdicts to")
+	kafkaClientID    = flag.String("kafkaclientid", "nightwatch", "Client ID for the Kafka connection")
+	kafkaAcks        = flag.String("kafkaacks", "all", "Acknowledgements required for Kafka writes (none, one or all)")
+	kafkaCompression = flag.String("kafkacompression", "none", "Compression of Kafka batches (none, gzip, snappy, lz4 or zstd)")
+	kafkaBatch       = flag.Int("kafkabatch", 100, "Max number of verdicts per Kafka write")
+	kafkaTLS         = flag.Bool("kafkatls", false, "Use TLS for the Kafka connection")
+	kafkaCAFile      = flag.String("kafkacafile", "", "PEM file with CA certificates to verify the Kafka brokers with")
+	kafkaServerName  = flag.String("kafkaservername", "", "Expected name in the Kafka broker certificates, if it differs from the host")
+	kafkaCertFile    = flag.String("kafkacertfile", "", "PEM file with client certificate for the Kafka connection")
+	kafkaKeyFile     = flag.String("kafkakeyfile", "", "PEM file with client key for the Kafka connection")
+	kafkaSASL        = flag.String("kafkasasl", "", "SASL mechanism for the Kafka connection (plain, scram-sha-256 or scram-sha-512)")
+	kafkaUser        = flag.String("kafkauser", "", "User name for Kafka SASL authentication")
+	kafkaPass        = flag.String("kafkapass", "", "Password for Kafka SASL authentication")
+	kafkaUserFile    = flag.String("kafkauserfile", "", "File to read the Kafka user name from instead of -kafkauser")
+	kafkaPassFile    = flag.String("kafkapassfile", "", "File to read the Kafka password from instead of -kafkapass")
+	kafkaFilter      = flag.String("kafkafilter", "all", "Verdicts produced to Kafka (all, suspicious or clean)")
+	kafkaFormat      = flag.String("kafkaformat", "json", "Format of verdicts produced to Kafka (json or stix)")
+
+	mispURL          = flag.String("mispurl", "", "Base URL of the MISP instance to create events for suspicious samples in")
+	mispKeyFile      = flag.String("mispkeyfile", "", "File containing the MISP API key")
+	mispCAFile       = flag.String("mispcafile", "", "PEM file with CA certificates to verify the MISP server with")
+	mispDistribution = flag.Int("mispdistribution", 0, "Distribution of created MISP events (0: organisation only, 1: community, 2: connected communities, 3: all)")
+	mispThreatLevel  = flag.Int("mispthreatlevel", 2, "Threat level of created MISP events (1: high, 2: medium, 3: low, 4: undefined)")
+	mispAnalysis     = flag.Int("mispanalysis", 0, "Analysis state of created MISP events (0: initial, 1: ongoing, 2: completed)")
+	mispAttach       = flag.Bool("mispattach", false, "Attach samples to MISP events once uploaded (requires sample upload)")
+
+	syslogNetwork  = flag.String("syslognetwork", "udp", "Network to send syslog messages over (udp, tcp or unix)")
+	syslogAddr     = flag.String("syslogaddr", "localhost:514", "Address of the syslog server, or path of the socket with unix network")
+	syslogFacility = flag.Int("syslogfacility", 16, "Syslog facility of verdict messages (0-23, 16 is local0)")
+	syslogFilter   = flag.String("syslogfilter", "all", "Verdicts sent to syslog (all, suspicious or clean)")
+
+	amqpURI          = flag.String("amqpuri", "localhost:5672", "Endpoint and port for the AMQP connection")
+	amqpExchange     = flag.String("amqpexch", "nightwatch", "Exchange to post messages to")
+	amqpExchangeType = flag.String("amqpexchtype", "fanout", "Type of the exchange to post messages to (fanout, direct, topic or headers)")
+	amqpRoutingKey   = flag.String("amqproutingkey", submitter.DefaultRoutingKey, "Routing key for verdicts, as template executed on the verdict")
+	amqpPersistent   = flag.Bool("amqppersistent", false, "Publish verdicts as persistent messages")
+	amqpTTL          = flag.Duration("amqpttl", 0, "Time after which undelivered verdicts expire, 0 for none")
+	amqpPriority     = flag.Uint("amqppriority", 0, "Message priority for suspicious verdicts (0-255)")
+	amqpUser         = flag.String("amqpuser", "sensor", "User name for the AMQP connection")
+	amqpPass         = flag.String("amqppass", "sensor", "Password for the AMQP connection")
+	amqpUserFile     = flag.String("amqpuserfile", "", "File to read the AMQP user name from instead of -amqpuser")
+	amqpPassFile     = flag.String("amqppassfile", "", "File to read the AMQP password from instead of -amqppass")
+	amqpVHost        = flag.String("amqpvhost", "", "Virtual host for the AMQP connection, overriding the path of -amqpuri")
+	amqpTLS          = flag.Bool("amqptls", false, "Use TLS (amqps) for the AMQP connection")
+	amqpCAFile       = flag.String("amqpcafile", "", "PEM file with CA certificates to verify the AMQP server with")
+	amqpServerName   = flag.String("amqpservername", "", "Expected name in the AMQP server certificate, if it differs from the host")
+	amqpCertFile     = flag.String("amqpcertfile", "", "PEM file with client certificate for the AMQP connection")
+	amqpKeyFile      = flag.String("amqpkeyfile", "", "PEM file with client key for the AMQP connection")
+	amqpExternal     = flag.Bool("amqpexternal", false, "Authenticate to AMQP server with the client certificate (SASL EXTERNAL)")
+	amqpBuffer       = flag.Int("amqpbuffer", 1000, "Max number of verdicts buffered during AMQP outages with buffer policy")
+	amqpFilter       = flag.String("amqpfilter", "all", "Verdicts submitted to AMQP (all, suspicious or clean)")
+	amqpSchema       = flag.String("amqpschema", "1", "Comma separated message schema versions to publish each verdict in (1 or 2)")
+	amqpOmitMetadata = flag.Bool("amqpomitmetadata", false, "Leave out meta file and fileinfo event in schema version 2")
+	amqpOmitStrings  = flag.Bool("amqpomitstrings", false, "Leave out strings matched by YARA rules in schema version 2")
+
+	amqpPolicy     = submitter.PolicyBlock
+	amqpHeaders    submitter.AMQPHeaders
+	amqpEncoding   = submitter.EncodingJSON
+	fileSync       = submitter.SyncInterval
+	webhookURLs    stringList
+	webhookHeaders submitter.HTTPHeaders
+	mispTags       stringList
+	syslogFormat   = submitter.FormatCEF
+)
+
+func init() {
+	flag.Var(&amqpPolicy, "amqppolicy", "Submission policy during AMQP outages (block or buffer)")
+	flag.Var(&amqpHeaders, "amqpheader", "Additional message header as key=value, may be repeated")
+	flag.Var(&amqpEncoding, "amqpencoding", "Encoding of AMQP messages (json, cbor or msgpack)")
+	flag.Var(&fileSync, "filesync", "When to sync the verdict file to disk (always, interval or never)")
+	flag.Var(&webhookURLs, "webhookurl", "URL to post verdicts to, may be repeated")
+	flag.Var(&webhookHeaders, "webhookheader", "Additional webhook request header as 'Name: value', may be repeated")
+	flag.Var(&mispTags, "misptag", "Additional tag for created MISP events, e.g. tlp:amber, may be repeated")
+	flag.Var(&syslogFormat, "syslogformat", "Payload format of syslog messages (cef or leef)")
+}
+
+// formats are the formats verdicts can be converted to for sinks supporting
+// them, with nil for the original JSON.
+var formats = map[string]submitter.Format{
+	"json": nil,
+	"stix": stix.Convert,
+}
+
+// stringList is a list of strings, usable as a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func makeAMQPSubmitter(verbose bool) (submitter.Submitter, error) {
+	switch *amqpExchangeType {
+	case "fanout", "direct", "topic", "headers":
+	default:
+		return nil, fmt.Errorf("invalid exchange type: %s", *amqpExchangeType)
+	}
+	routingKey, err := submitter.ParseRoutingKey(*amqpRoutingKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing key: %s", err)
+	}
+	schemas, err := submitter.ParseSchemaVersions(*amqpSchema)
+	if err != nil {
+		return nil, err
+	}
+	if *amqpPriority > 255 {
+		return nil, fmt.Errorf("invalid message priority: %d", *amqpPriority)
+	}
+	amqpConfig := submitter.AMQPConfig{
+		URI:        *amqpURI,
+		VHost:      *amqpVHost,
+		User:       *amqpUser,
+		Pass:       *amqpPass,
+		TLS:        *amqpTLS,
+		CAFile:     *amqpCAFile,
+		ServerName: *amqpServerName,
+		CertFile:   *amqpCertFile,
+		KeyFile:    *amqpKeyFile,
+		External:   *amqpExternal,
+	}
+	if len(*amqpUserFile) > 0 {
+		amqpConfig.User, err = util.ReadCredentialFile(*amqpUserFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(*amqpPassFile) > 0 {
+		amqpConfig.Pass, err = util.ReadCredentialFile(*amqpPassFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dialConfig, err := amqpConfig.DialConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	as, err := submitter.MakeAMQPSubmitterWithConfig(amqpConfig, *amqpExchange, verbose,
+		func(url string) (wabbit.Conn, string, error) {
+			log.Info(submitter.RedactURL(url))
+			if testMode {
+				c, e := amqptest.Dial(url)
+				return c, "direct", e
+			}
+			c, e := amqp.DialConfig(url, dialConfig)
+			return c, *amqpExchangeType, e
+		})
+	if err != nil {
+		return nil, err
+	}
+	as.Policy = amqpPolicy
+	as.BufferSize = *amqpBuffer
+	as.Message = submitter.AMQPMessageOptions{
+		RoutingKey:         routingKey,
+		Persistent:         *amqpPersistent,
+		TTL:                *amqpTTL,
+		SuspiciousPriority: uint8(*amqpPriority),
+		Headers:            amqpHeaders,
+		Schemas:            schemas,
+		Encoding:           amqpEncoding,
+		OmitMetadata:       *amqpOmitMetadata,
+		OmitStrings:        *amqpOmitStrings,
+	}
+	return as, nil
+}
+
+func makeKafkaSubmitter() (submitter.Submitter, error) {
+	kafkaConfig := submitter.KafkaConfig{
+		Brokers:     strings.Split(*kafkaBrokers, ","),
+		Topic:       *kafkaTopic,
+		ClientID:    *kafkaClientID,
+		Acks:        *kafkaAcks,
+		Compression: *kafkaCompression,
+		BatchSize:   *kafkaBatch,
+		TLS:         *kafkaTLS,
+		CAFile:      *kafkaCAFile,
+		ServerName:  *kafkaServerName,
+		CertFile:    *kafkaCertFile,
+		KeyFile:     *kafkaKeyFile,
+		SASL:        *kafkaSASL,
+		User:        *kafkaUser,
+		Pass:        *kafkaPass,
+	}
+	var err error
+	if len(*kafkaUserFile) > 0 {
+		kafkaConfig.User, err = util.ReadCredentialFile(*kafkaUserFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(*kafkaPassFile) > 0 {
+		kafkaConfig.Pass, err = util.ReadCredentialFile(*kafkaPassFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ks, err := submitter.MakeKafkaSubmitterWithConfig(kafkaConfig)
+	if err != nil {
+		return nil, err
+	}
+	ks.Run()
+	return ks, nil
+}
+
+func makeFileSubmitter() (submitter.Submitter, error) {
+	err := os.MkdirAll(filepath.Dir(*filePath), 0750)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := submitter.MakeFileSubmitter(*filePath)
+	if err != nil {
+		return nil, err
+	}
+	fs.MaxSize = *fileMaxSize * 1024 * 1024
+	fs.MaxAge = *fileMaxAge
+	fs.Keep = *fileKeep
+	fs.Compress = *fileCompress
+	fs.Sync = fileSync
+	fs.Run()
+	return fs, nil
+}
+
+func makeWebhookSubmitter() (submitter.Submitter, error) {
+	ws, err := submitter.MakeWebhookSubmitter(webhookURLs)
+	if err != nil {
+		return nil, err
+	}
+	if len(*webhookSecretFile) > 0 {
+		var secret string
+		secret, err = util.ReadCredentialFile(*webhookSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		ws.Secret = []byte(secret)
+	}
+	if len(*webhookDeadLetterDir) > 0 {
+		err = os.MkdirAll(*webhookDeadLetterDir, 0750)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ws.Headers = webhookHeaders
+	ws.BatchSize = *webhookBatch
+	ws.MaxAttempts = *webhookAttempts
+	ws.Client.Timeout = *webhookTimeout
+	ws.DeadLetterDir = *webhookDeadLetterDir
+	ws.Run()
+	return ws, nil
+}
+
+func makeMISPSubmitter() (submitter.Submitter, error) {
+	if len(*mispKeyFile) == 0 {
+		return nil, fmt.Errorf("no MISP API key file given")
+	}
+	key, err := util.ReadCredentialFile(*mispKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := submitter.MakeMISPSubmitter(*mispURL, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(*mispCAFile) > 0 {
+		tc, err := util.LoadTLSConfig(true, *mispCAFile, "", "", "")
+		if err != nil {
+			return nil, err
+		}
+		ms.Client.Transport = &http.Transport{TLSClientConfig: tc}
+	}
+	ms.Distribution = *mispDistribution
+	ms.ThreatLevel = *mispThreatLevel
+	ms.Analysis = *mispAnalysis
+	ms.Tags = mispTags
+	ms.AttachSamples = *mispAttach
+	return ms, nil
+}
+
+func makeSyslogSubmitter() (submitter.Submitter, error) {
+	if *syslogFacility < 0 || *syslogFacility > 23 {
+		return nil, fmt.Errorf("invalid syslog facility: %d", *syslogFacility)
+	}
+	ss, err := submitter.MakeSyslogSubmitter(*syslogNetwork, *syslogAddr, syslogFormat)
+	if err != nil {
+		return nil, err
+	}
+	ss.Facility = *syslogFacility
+	return ss, nil
+}
+
+// makeSubmitter creates the submitter delivering verdicts to all configured
+// sinks. With a single sink receiving all verdicts, that sink's submitter is
+// used directly. Otherwise, each sink gets its own outbox if durable is set,
+// giving up on verdicts after maxAttempts.
+func makeSubmitter(verbose bool, durable bool, maxAttempts int) (submitter.Submitter, error) {
+	names := strings.Split(*Submitters, ",")
+	if *dummy {
+		names = []string{"dummy"}
+	}
+	m := submitter.MakeMultiSubmitter(durable)
+	m.MaxAttempts = maxAttempts
+	filtered := false
+	// clean up sinks created so far if a later one fails
+	finishSinks := func() {
+		for _, sink := range m.Sinks {
+			sink.Submitter.Finish()
+		}
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			finishSinks()
+			return nil, fmt.Errorf("duplicate submitter: %s", name)
+		}
+		seen[name] = true
+		var filterName string
+		formatName := "json"
+		var makeSink func() (submitter.Submitter, error)
+		switch name {
+		case "amqp":
+			filterName = *amqpFilter
+			makeSink = func() (submitter.Submitter, error) {
+				return makeAMQPSubmitter(verbose)
+			}
+		case "kafka":
+			filterName = *kafkaFilter
+			formatName = *kafkaFormat
+			makeSink = makeKafkaSubmitter
+		case "file":
+			filterName = *fileFilter
+			formatName = *fileFormat
+			makeSink = makeFileSubmitter
+		case "webhook":
+			filterName = *webhookFilter
+			formatName = *webhookFormat
+			makeSink = makeWebhookSubmitter
+		case "syslog":
+			filterName = *syslogFilter
+			makeSink = makeSyslogSubmitter
+		case "misp":
+			// only suspicious verdicts make events, and queueing them in
+			// their own sink decouples the other sinks from MISP requests
+			filterName = "suspicious"
+			makeSink = makeMISPSubmitter
+		case "dummy":
+			filterName = *dummyFilter
+			makeSink = func() (submitter.Submitter, error) {
+				log.Info("disabling verdict submission")
+				return submitter.MakeDummySubmitter(), nil
+			}
+		default:
+			finishSinks()
+			return nil, fmt.Errorf("unknown submitter: %s", name)
+		}
+		filter, err := submitter.ParseFilter(filterName)
+		format, ok := formats[formatName]
+		if err == nil && !ok {
+			err = fmt.Errorf("invalid format: %s", formatName)
+		}
+		var s submitter.Submitter
+		if err == nil {
+			s, err = makeSink()
+		}
+		if err != nil {
+			finishSinks()
+			return nil, fmt.Errorf("%s submitter: %s", name, err)
+		}
+		if format != nil {
+			s = submitter.MakeFormatSubmitter(s, format)
+		}
+		m.AddSink(name, s, filter)
+		filtered = filtered || filterName != "all"
+	}
+	if len(m.Sinks) == 1 && !filtered {
+		return m.Sinks[0].Submitter, nil
+	}
+	m.Run()
+	return m, nil
+}
@@ -0,0 +1,85 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/DCSO/nightwatch/submitter"
+)
+
+func TestSubmittersFlag(t *testing.T) {
+	defer func(submitters, filter, path, format string) {
+		*Submitters = submitters
+		*dummyFilter = filter
+		*filePath = path
+		*fileFormat = format
+	}(*Submitters, *dummyFilter, *filePath, *fileFormat)
+
+	*Submitters = "dummy"
+	s, err := makeSubmitter(false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*submitter.DummySubmitter); !ok {
+		t.Fatalf("unexpected submitter %T", s)
+	}
+	s.Finish()
+
+	*Submitters = "file"
+	*filePath = filepath.Join(t.TempDir(), "log", "verdicts.jsonl")
+	s, err = makeSubmitter(false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs, ok := s.(*submitter.FileSubmitter); !ok || fs.MaxSize != 100*1024*1024 {
+		t.Fatalf("unexpected submitter %T", s)
+	}
+	s.Finish()
+
+	*fileFormat = "stix"
+	s, err = makeSubmitter(false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs, ok := s.(*submitter.FormatSubmitter); !ok {
+		t.Fatalf("unexpected submitter %T", s)
+	} else if _, ok := fs.Submitter.(*submitter.FileSubmitter); !ok {
+		t.Fatalf("unexpected wrapped submitter %T", fs.Submitter)
+	}
+	s.Finish()
+	*fileFormat = "xml"
+	if _, err = makeSubmitter(false, false, 0); err == nil {
+		t.Fatal("invalid format accepted")
+	}
+	*fileFormat = "json"
+
+	*Submitters = "dummy, file"
+	*dummyFilter = "suspicious"
+	s, err = makeSubmitter(false, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := s.(*submitter.MultiSubmitter); !ok || len(m.Sinks) != 2 {
+		t.Fatalf("unexpected submitter %T", s)
+	}
+	s.Finish()
+
+	for _, tc := range []struct {
+		submitters string
+		filter     string
+	}{
+		{"dummy,foo", "all"},
+		{"dummy,dummy", "all"},
+		{"dummy", "foo"},
+	} {
+		*Submitters = tc.submitters
+		*dummyFilter = tc.filter
+		_, err = makeSubmitter(false, false, 0)
+		if err == nil {
+			t.Errorf("invalid configuration %v accepted", tc)
+		}
+	}
+}
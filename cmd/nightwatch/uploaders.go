@@ -0,0 +1,279 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/DCSO/nightwatch/submitter"
+	"github.com/DCSO/nightwatch/uploader"
+	"github.com/DCSO/nightwatch/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of upload backends.
+const (
+	UploadBackendS3     = "s3"
+	UploadBackendLocal  = "local"
+	UploadBackendSFTP   = "sftp"
+	UploadBackendWebDAV = "webdav"
+)
+
+var (
+	uploadBackend = flag.String("uploadbackend", UploadBackendS3, "Storage for uploaded samples (s3, local, sftp or webdav); s3 is only used with -uploadendpoint")
+
+	uploadScratchDir      = flag.String("uploadscratchdir", "/tmp/nightwatch_scratch", "Temp directory for sample upload")
+	uploadLink            = flag.Bool("uploadlink", true, "Hard link or reflink samples into the scratch directory instead of copying them, where possible")
+	uploadKey             = flag.String("uploadkey", uploader.DefaultKey, "Object key for uploaded samples, as template executed on the verdict")
+	uploadSkipExisting    = flag.Bool("uploadskipexisting", true, "Do not upload samples already present in the bucket")
+	uploadAttempts        = flag.Int("uploadattempts", 20, "Max number of attempts to upload a sample before giving up on it, 0 for no limit")
+	uploadWrap            = flag.String("uploadwrap", "none", "Protection of uploaded samples (none, zip or age)")
+	uploadZIPPassword     = flag.String("uploadzippassword", "infected", "Password of ZIP archives with -uploadwrap zip")
+	uploadSamplePercent   = flag.Float64("uploadsamplepercent", 0, "Percentage of clean samples to upload as well, picked at random")
+	uploadSampleFirstSeen = flag.Bool("uploadsamplefirstseen", false, "Only upload clean samples not seen before")
+	uploadSampleMinSize   = flag.Int64("uploadsampleminsize", 0, "Min size in bytes of clean samples to upload")
+	uploadSampleMaxSize   = flag.Int64("uploadsamplemaxsize", 0, "Max size in bytes of clean samples to upload, 0 for no limit")
+	uploadBudget          = flag.Int64("uploadbudget", 0, "Max MB of clean samples to upload per hour, 0 for no limit (suspicious samples count towards it but are always uploaded)")
+
+	uploadEndpoint            = flag.String("uploadendpoint", "", "Endpoint for suspicious file S3 upload")
+	uploadAccessKey           = flag.String("uploadaccesskey", "", "Access key for S3 upload")
+	uploadSecretAccessKey     = flag.String("uploadsecretaccesskey", "", "Secret access key for S3 upload")
+	uploadAccessKeyFile       = flag.String("uploadaccesskeyfile", "", "File containing the access key for S3 upload")
+	uploadSecretAccessKeyFile = flag.String("uploadsecretaccesskeyfile", "", "File containing the secret access key for S3 upload")
+	uploadCredentialsFile     = flag.String("uploadcredentialsfile", "", "AWS shared credentials file to use if no S3 upload keys are given (default ~/.aws/credentials)")
+	uploadProfile             = flag.String("uploadprofile", "", "Profile in the AWS shared credentials file (default \"default\")")
+	uploadBucketName          = flag.String("uploadbucket", "", "Bucket name for S3 upload")
+	uploadRegion              = flag.String("uploadregion", "", "Region for S3 upload")
+	uploadSSL                 = flag.Bool("uploadssl", false, "Use SSL for S3 upload")
+	uploadPartSize            = flag.Uint64("uploadpartsize", 64, "Size in MB above which samples are uploaded in parts of this size (at least 5)")
+	uploadSSE                 = flag.String("uploadsse", "none", "Server-side encryption of uploaded objects (none, s3, kms or c)")
+	uploadKMSKey              = flag.String("uploadkmskey", "", "KMS key ID with -uploadsse kms (default key of the storage if empty)")
+	uploadSSEKeyFile          = flag.String("uploadssekeyfile", "", "File containing the 32 byte key, raw or base64 encoded, with -uploadsse c")
+	uploadStorageClass        = flag.String("uploadstorageclass", "", "Storage class of uploaded objects (default of the bucket if empty)")
+
+	uploadDir = flag.String("uploaddir", "", "Directory to store samples in with -uploadbackend local, e.g. on an NFS share")
+
+	uploadSFTPAddr         = flag.String("uploadsftpaddr", "", "Address (host:port) of the SFTP server with -uploadbackend sftp")
+	uploadSFTPUser         = flag.String("uploadsftpuser", "nightwatch", "User for the SFTP server")
+	uploadSFTPPassFile     = flag.String("uploadsftppassfile", "", "File containing the password for the SFTP server")
+	uploadSFTPKeyFile      = flag.String("uploadsftpkeyfile", "", "File containing an unencrypted SSH private key for the SFTP server")
+	uploadSFTPKnownHosts   = flag.String("uploadsftpknownhosts", "", "known_hosts file with the SFTP server's host key (default ~/.ssh/known_hosts)")
+	uploadSFTPInsecureHost = flag.Bool("uploadsftpinsecurehostkey", false, "Do not check the SFTP server's host key")
+	uploadSFTPDir          = flag.String("uploadsftpdir", "", "Directory on the SFTP server to store samples in, relative to the login directory unless absolute")
+
+	uploadWebDAVURL      = flag.String("uploadwebdavurl", "", "URL of the WebDAV collection to store samples in with -uploadbackend webdav")
+	uploadWebDAVUser     = flag.String("uploadwebdavuser", "", "User for basic authentication with the WebDAV server")
+	uploadWebDAVPassFile = flag.String("uploadwebdavpassfile", "", "File containing the password for the WebDAV server")
+	uploadWebDAVCAFile   = flag.String("uploadwebdavcafile", "", "CA certificate file to verify the WebDAV server with")
+
+	uploadTags        uploader.Tags
+	uploadRecipients  stringList
+	uploadSampleMagic stringList
+)
+
+func init() {
+	flag.Var(&uploadTags, "uploadtag", "Tag for uploaded objects as key=value, may be repeated")
+	flag.Var(&uploadRecipients, "uploadrecipient", "age public key to encrypt samples to with -uploadwrap age, may be repeated")
+	flag.Var(&uploadSampleMagic, "uploadsamplemagic", "Only upload clean samples whose file type contains this, may be repeated")
+}
+
+// s3Flags are the upload options only supported by the S3 backend.
+var s3Flags = []string{
+	"uploadendpoint",
+	"uploadaccesskey",
+	"uploadsecretaccesskey",
+	"uploadaccesskeyfile",
+	"uploadsecretaccesskeyfile",
+	"uploadcredentialsfile",
+	"uploadprofile",
+	"uploadbucket",
+	"uploadregion",
+	"uploadssl",
+	"uploadpartsize",
+	"uploadtag",
+	"uploadsse",
+	"uploadkmskey",
+	"uploadssekeyfile",
+	"uploadstorageclass",
+}
+
+// uploadEnabled returns whether samples are to be uploaded.
+func uploadEnabled() bool {
+	return *uploadBackend != UploadBackendS3 || len(*uploadEndpoint) > 0
+}
+
+// checkUploadFlags returns an error if an option only supported by S3 is set
+// with another backend, where it would be ignored otherwise.
+func checkUploadFlags() error {
+	if *uploadBackend == UploadBackendS3 {
+		return nil
+	}
+	for _, name := range s3Flags {
+		f := flag.Lookup(name)
+		if f.Value.String() != f.DefValue {
+			return fmt.Errorf("-%s is only supported with -uploadbackend %s", name, UploadBackendS3)
+		}
+	}
+	return nil
+}
+
+// makeUploader creates the uploader storing samples from filesDir with the
+// backend selected with -uploadbackend, submitting their verdicts to s.
+func makeUploader(s submitter.Submitter, filesDir string) (*uploader.Uploader, error) {
+	err := checkUploadFlags()
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(*uploadScratchDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	key, err := uploader.ParseKey(*uploadKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload key: %s", err)
+	}
+	config := uploader.UploadConfig{
+		Link:         *uploadLink,
+		PartSize:     *uploadPartSize * 1024 * 1024,
+		Key:          key,
+		Tags:         uploadTags,
+		SkipExisting: *uploadSkipExisting,
+		MaxAttempts:  *uploadAttempts,
+		Policy: &uploader.Policy{
+			Percent:   *uploadSamplePercent,
+			FirstSeen: *uploadSampleFirstSeen,
+			Magic:     uploadSampleMagic,
+			MinSize:   *uploadSampleMinSize,
+			MaxSize:   *uploadSampleMaxSize,
+			Budget:    *uploadBudget * 1024 * 1024,
+		},
+	}
+	switch *uploadWrap {
+	case "none":
+	case uploader.WrapZIP:
+		config.Wrapper = &uploader.ZIPWrapper{Password: *uploadZIPPassword}
+	case uploader.WrapAge:
+		config.Wrapper, err = uploader.MakeAgeWrapper(uploadRecipients)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid upload wrapping: %s", *uploadWrap)
+	}
+	var backend uploader.Backend
+	if *uploadBackend == UploadBackendS3 {
+		backend, err = makeS3Backend(&config)
+	} else {
+		backend, err = makeUploadBackend()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return uploader.MakeUploader(backend, filesDir, *uploadScratchDir, s, config)
+}
+
+// makeS3Backend returns the S3 backend, adding the S3 encryption and storage
+// class options to config.
+func makeS3Backend(config *uploader.UploadConfig) (uploader.Backend, error) {
+	var err error
+	config.SSE, err = uploader.MakeSSE(*uploadSSE, *uploadKMSKey, *uploadSSEKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if *uploadSSE == uploader.SSEC && !*uploadSSL {
+		log.Warn("S3 endpoints usually require SSL for SSE-C (-uploadssl)")
+	}
+	config.StorageClass = *uploadStorageClass
+	creds := uploader.S3Credentials{
+		Endpoint:              *uploadEndpoint,
+		AccessKey:             *uploadAccessKey,
+		SecretAccessKey:       *uploadSecretAccessKey,
+		BucketName:            *uploadBucketName,
+		Region:                *uploadRegion,
+		SharedCredentialsFile: *uploadCredentialsFile,
+		Profile:               *uploadProfile,
+	}
+	if len(*uploadAccessKeyFile) > 0 {
+		creds.AccessKey, err = util.ReadCredentialFile(*uploadAccessKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(*uploadSecretAccessKeyFile) > 0 {
+		creds.SecretAccessKey, err = util.ReadCredentialFile(*uploadSecretAccessKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return uploader.MakeS3Backend(creds, *uploadSSL, *config)
+}
+
+// makeUploadBackend returns the backend selected with -uploadbackend, other
+// than S3.
+func makeUploadBackend() (uploader.Backend, error) {
+	switch *uploadBackend {
+	case UploadBackendLocal:
+		if len(*uploadDir) == 0 {
+			return nil, fmt.Errorf("no upload directory given")
+		}
+		return uploader.MakeLocalBackend(*uploadDir)
+	case UploadBackendSFTP:
+		return makeSFTPBackend()
+	case UploadBackendWebDAV:
+		return makeWebDAVBackend()
+	}
+	return nil, fmt.Errorf("invalid upload backend: %s", *uploadBackend)
+}
+
+func makeSFTPBackend() (uploader.Backend, error) {
+	if len(*uploadSFTPAddr) == 0 {
+		return nil, fmt.Errorf("no SFTP server given")
+	}
+	config := uploader.SFTPConfig{
+		Address:               *uploadSFTPAddr,
+		User:                  *uploadSFTPUser,
+		KeyFile:               *uploadSFTPKeyFile,
+		KnownHostsFile:        *uploadSFTPKnownHosts,
+		InsecureIgnoreHostKey: *uploadSFTPInsecureHost,
+		Dir:                   *uploadSFTPDir,
+	}
+	if len(*uploadSFTPPassFile) > 0 {
+		var err error
+		config.Password, err = util.ReadCredentialFile(*uploadSFTPPassFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return uploader.MakeSFTPBackend(config)
+}
+
+func makeWebDAVBackend() (uploader.Backend, error) {
+	if len(*uploadWebDAVURL) == 0 {
+		return nil, fmt.Errorf("no WebDAV URL given")
+	}
+	var pass string
+	if len(*uploadWebDAVPassFile) > 0 {
+		var err error
+		pass, err = util.ReadCredentialFile(*uploadWebDAVPassFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b, err := uploader.MakeWebDAVBackend(*uploadWebDAVURL, *uploadWebDAVUser, pass)
+	if err != nil {
+		return nil, err
+	}
+	if len(*uploadWebDAVCAFile) > 0 {
+		tc, err := util.LoadTLSConfig(true, *uploadWebDAVCAFile, "", "", "")
+		if err != nil {
+			return nil, err
+		}
+		b.Client.Transport = &http.Transport{TLSClientConfig: tc}
+	}
+	return b, nil
+}
@@ -0,0 +1,119 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DCSO/nightwatch/uploader"
+)
+
+func TestUploadBackendFlag(t *testing.T) {
+	defer func(backend, endpoint, dir, sftpAddr, sftpPassFile, webdavURL string, insecure bool) {
+		*uploadBackend = backend
+		*uploadEndpoint = endpoint
+		*uploadDir = dir
+		*uploadSFTPAddr = sftpAddr
+		*uploadSFTPPassFile = sftpPassFile
+		*uploadSFTPInsecureHost = insecure
+		*uploadWebDAVURL = webdavURL
+	}(*uploadBackend, *uploadEndpoint, *uploadDir, *uploadSFTPAddr, *uploadSFTPPassFile, *uploadWebDAVURL, *uploadSFTPInsecureHost)
+
+	*uploadBackend = UploadBackendS3
+	*uploadEndpoint = ""
+	if uploadEnabled() {
+		t.Fatal("S3 upload enabled without endpoint")
+	}
+	*uploadEndpoint = "localhost:9000"
+	if !uploadEnabled() || checkUploadFlags() != nil {
+		t.Fatal("S3 upload not enabled by endpoint")
+	}
+
+	*uploadBackend = UploadBackendLocal
+	if checkUploadFlags() == nil {
+		t.Fatal("S3 endpoint accepted with local backend")
+	}
+	*uploadEndpoint = ""
+	if !uploadEnabled() || checkUploadFlags() != nil {
+		t.Fatal("local upload not enabled")
+	}
+	if _, err := makeUploadBackend(); err == nil {
+		t.Fatal("missing directory accepted")
+	}
+	*uploadDir = t.TempDir()
+	b, err := makeUploadBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(*uploader.LocalBackend); !ok {
+		t.Fatalf("unexpected backend %T", b)
+	}
+
+	*uploadBackend = UploadBackendSFTP
+	*uploadSFTPAddr = "localhost"
+	passFile := filepath.Join(t.TempDir(), "pass")
+	err = os.WriteFile(passFile, []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*uploadSFTPPassFile = passFile
+	*uploadSFTPInsecureHost = true
+	b, err = makeUploadBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb, ok := b.(*uploader.SFTPBackend); !ok || sb.Config.Password != "secret" ||
+		sb.Config.Address != "localhost:22" {
+		t.Fatalf("unexpected backend %+v", b)
+	}
+
+	*uploadBackend = UploadBackendWebDAV
+	if _, err := makeUploadBackend(); err == nil {
+		t.Fatal("missing URL accepted")
+	}
+	*uploadWebDAVURL = "https://dav.example.com/samples"
+	b, err = makeUploadBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wb, ok := b.(*uploader.WebDAVBackend); !ok || wb.Location("a") != "https://dav.example.com/samples/a" {
+		t.Fatalf("unexpected backend %+v", b)
+	}
+
+	*uploadBackend = "ftp"
+	if _, err := makeUploadBackend(); err == nil {
+		t.Fatal("invalid backend accepted")
+	}
+}
+
+func TestUploadS3Flags(t *testing.T) {
+	defer func(backend, sse, storageClass string) {
+		*uploadBackend = backend
+		*uploadSSE = sse
+		*uploadStorageClass = storageClass
+		uploadTags = nil
+	}(*uploadBackend, *uploadSSE, *uploadStorageClass)
+
+	*uploadBackend = UploadBackendSFTP
+	for _, set := range []func(){
+		func() { *uploadSSE = uploader.SSEKMS },
+		func() { *uploadStorageClass = "GLACIER" },
+		func() { uploadTags.Set("env=test") },
+	} {
+		*uploadSSE = "none"
+		*uploadStorageClass = ""
+		uploadTags = nil
+		set()
+		if err := checkUploadFlags(); err == nil {
+			t.Errorf("S3-only option accepted with SFTP backend")
+		}
+	}
+
+	*uploadBackend = UploadBackendS3
+	if err := checkUploadFlags(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,12 +4,12 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sync"
+	"time"
 
 	"github.com/DCSO/nightwatch/registry"
 	"github.com/DCSO/nightwatch/sampledb"
@@ -27,10 +27,6 @@ var (
 	droppedFileV2Reg = regexp.MustCompile(`[0-9a-fA-F]{2}.[0-9a-fA-F]{64}$`)
 )
 
-const (
-	numWorkers = 5
-)
-
 func intToStoreVersion(v int) (util.FilestoreVersion, error) {
 	if v < 1 || v > 2 {
 		return 0, fmt.Errorf("invalid filestore version: %d", v)
@@ -51,16 +47,21 @@ type Watcher struct {
 	StopperChan       chan bool
 	FinishNotifyChan  chan bool
 	ScanCandidateChan chan sampledb.FileInfoEvent
+	HeavyScanChan     chan *registry.Scan
+	WorkerGroup       sync.WaitGroup
 	IsRunning         bool
 	FileDir           string
 	FilestoreVersion  util.FilestoreVersion
 	WaitGroup         sync.WaitGroup
-	SocketInput       *SocketInput
+	Input             Input
 	Uploader          *uploader.Uploader
+	RetryQueue        *RetryQueue
+	InputQueue        *InputQueue
 }
 
 // backlogBuilder is called on program start to make a quick check of the files
-// directory to make sure we don't miss a file.
+// directory to make sure we don't miss a file. Files found are queued like
+// events from the input.
 func (w *Watcher) backlogBuilder(path string, submitter submitter.Submitter, storeVersion int) {
 	files := make([]string, 0)
 	log.Infof("building backlog")
@@ -109,18 +110,25 @@ func (w *Watcher) backlogBuilder(path string, submitter submitter.Submitter, sto
 				log.Error(err)
 				continue
 			}
-			var jm interface{}
-			err = json.Unmarshal(data, &jm)
+			jm, m, err := parseEVE(data)
 			if err != nil {
 				log.Error(err)
 				continue
 			}
+			if rule, drop := dropRules.Match(&m); drop {
+				log.Infof("skipping %s matching filter rule '%s'", jf, rule.Text)
+				continue
+			}
 			log.Debugf("found %s, submitting...", jf)
-			w.WaitGroup.Add(1)
-			w.ScanCandidateChan <- sampledb.FileInfoEvent{
+			fiev := sampledb.FileInfoEvent{
 				JSONMessage: jm,
 				FilePath:    f,
 			}
+			if m.EventType == "fileinfo" {
+				fiev.Event = m.EventInfo()
+			}
+			w.WaitGroup.Add(1)
+			w.InputQueue.InChan <- fiev
 		}
 		metaFiles, err := filepath.Glob(fmt.Sprintf("%s.meta", f))
 		if err != nil {
@@ -135,7 +143,7 @@ func (w *Watcher) backlogBuilder(path string, submitter submitter.Submitter, sto
 			}
 			log.Debugf("found %s, submitting...", mf)
 			w.WaitGroup.Add(1)
-			w.ScanCandidateChan <- sampledb.FileInfoEvent{
+			w.InputQueue.InChan <- sampledb.FileInfoEvent{
 				MetafileText: string(data),
 				FilePath:     f,
 			}
@@ -145,39 +153,157 @@ func (w *Watcher) backlogBuilder(path string, submitter submitter.Submitter, sto
 	log.Infof("finished building backlog")
 }
 
+// replayQueue is called on program start to queue all events left in the
+// persistent scan queue by a previous run, applying the queue policy like to
+// events from the input.
+func (w *Watcher) replayQueue() {
+	events, err := sampledb.QueuedEvents()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+	log.Infof("replaying %d queued events", len(events))
+	for _, fiev := range events {
+		w.WaitGroup.Add(1)
+		w.InputQueue.InChan <- fiev
+	}
+}
+
 // fileWorker takes a file path and calls the PluginIterator to let the plugins
-// do their analysis jobs.
+// do their analysis jobs. If there are separate workers for expensive
+// plugins, only the light plugins are run here and the scan is passed on.
 func (w *Watcher) fileWorker(submitter submitter.Submitter) {
+	defer w.WorkerGroup.Done()
 	for fiev := range w.ScanCandidateChan {
 		log.Debugf("worker grabbed file %s for processing", fiev.FilePath)
-		err := registry.PluginIterator(fiev, submitter, w.Uploader)
+		if !w.RetryQueue.Ready(fiev) {
+			// the retry queue takes care of the event until the file is
+			// complete
+			continue
+		}
+		if w.HeavyScanChan == nil {
+			err := registry.PluginIterator(fiev, submitter, w.Uploader)
+			if err != nil {
+				log.Error("PluginIterator: ", err)
+			}
+			dequeueEvent(fiev)
+			w.WaitGroup.Done()
+			continue
+		}
+		scan, err := registry.PrepareScan(fiev)
+		if err != nil || scan == nil {
+			if err != nil {
+				log.Error("PrepareScan: ", err)
+			}
+			dequeueEvent(fiev)
+			w.WaitGroup.Done()
+			continue
+		}
+		scan.RunPlugins(registry.CostLight)
+		w.HeavyScanChan <- scan
+	}
+	log.Info("worker terminated")
+}
+
+// heavyWorker runs the expensive plugins on scans prepared by the
+// fileWorkers and finishes them.
+func (w *Watcher) heavyWorker(submitter submitter.Submitter) {
+	for scan := range w.HeavyScanChan {
+		log.Debugf("heavy worker grabbed file %s for processing", scan.Event.FilePath)
+		scan.RunPlugins(registry.CostHeavy)
+		err := scan.Finish(submitter, w.Uploader)
 		if err != nil {
-			log.Error("PluginIterator: ", err)
+			log.Error("Finish: ", err)
 		}
+		dequeueEvent(scan.Event)
 		w.WaitGroup.Done()
 	}
-	log.Info("worker terminated")
+	log.Info("heavy worker terminated")
+}
+
+// WatcherConfig holds the settings of the workers and queues of a Watcher.
+type WatcherConfig struct {
+	// Workers is the number of workers processing files.
+	Workers int
+	// HeavyWorkers is the number of workers running expensive plugins. If
+	// zero, all plugins are run by the regular workers.
+	HeavyWorkers int
+	// QueueSize is the number of events that can be queued for the workers.
+	QueueSize int
+	// QueuePolicy determines what happens to incoming events when the queue
+	// is full.
+	QueuePolicy QueuePolicy
+	// SpillDir is the directory events are written to with QueueSpill.
+	SpillDir string
+	// PersistQueue makes incoming events persist in the database until they
+	// have been processed, to be replayed after a restart.
+	PersistQueue bool
+	// Events for files which are not yet complete are rechecked up to
+	// RetryMax times, starting after RetryDelay, and also until their meta
+	// file has appeared with RetryWaitMeta.
+	RetryMax      int
+	RetryDelay    time.Duration
+	RetryWaitMeta bool
+}
+
+// DefaultWatcherConfig returns the default watcher settings.
+func DefaultWatcherConfig() WatcherConfig {
+	return WatcherConfig{
+		Workers:     5,
+		QueueSize:   10000,
+		QueuePolicy: QueueBlock,
+		SpillDir:    "/var/lib/nightwatch/spill",
+		RetryMax:    8,
+		RetryDelay:  1 * time.Second,
+	}
 }
 
-// MakeWatcher returns a new, stopped Watcher. Will emit a value on finishNotify
-// channel when finished.
+// MakeWatcher returns a new, stopped Watcher with the given settings. Will
+// emit a value on finishNotify channel when finished.
 func MakeWatcher(finishNotify chan bool, submitter submitter.Submitter,
-	uploader *uploader.Uploader) *Watcher {
+	uploader *uploader.Uploader, config WatcherConfig) *Watcher {
 	w := &Watcher{
 		IsRunning:         false,
 		FinishNotifyChan:  finishNotify,
-		ScanCandidateChan: make(chan sampledb.FileInfoEvent, 10000),
+		ScanCandidateChan: make(chan sampledb.FileInfoEvent, config.QueueSize),
 		Uploader:          uploader,
 	}
-	for i := 0; i < numWorkers; i++ {
+	w.RetryQueue = MakeRetryQueue(w.ScanCandidateChan, &w.WaitGroup, config.RetryMax,
+		config.RetryDelay, config.RetryWaitMeta)
+	w.RetryQueue.Run()
+	w.InputQueue = MakeInputQueue(w.ScanCandidateChan, &w.WaitGroup, config.QueuePolicy,
+		config.SpillDir, config.PersistQueue)
+	w.InputQueue.Run()
+	if config.HeavyWorkers > 0 {
+		w.HeavyScanChan = make(chan *registry.Scan, config.HeavyWorkers)
+		for i := 0; i < config.HeavyWorkers; i++ {
+			go w.heavyWorker(submitter)
+		}
+	}
+	for i := 0; i < config.Workers; i++ {
+		w.WorkerGroup.Add(1)
 		go w.fileWorker(submitter)
 	}
+	log.Infof("started %d workers, %d heavy workers, queue size %d, queue policy %s",
+		config.Workers, config.HeavyWorkers, config.QueueSize, config.QueuePolicy)
 	return w
 }
 
 // Run starts the watcher on the given socketPath, with files being located in the
 // given directory.
 func (w *Watcher) Run(directory string, storeVersion int, socketPath string) error {
+	return w.RunInput(directory, storeVersion, func(outChan chan sampledb.FileInfoEvent,
+		fileDir string, wg *sync.WaitGroup, version util.FilestoreVersion) (Input, error) {
+		return MakeSocketInput(socketPath, outChan, fileDir, wg, version)
+	})
+}
+
+// RunInput starts the watcher on an Input created by the given maker, with
+// files being located in the given directory.
+func (w *Watcher) RunInput(directory string, storeVersion int, makeInput InputMaker) error {
 	var err error
 
 	if w.IsRunning {
@@ -191,19 +317,20 @@ func (w *Watcher) Run(directory string, storeVersion int, socketPath string) err
 	w.FilestoreVersion, err = intToStoreVersion(storeVersion)
 	if err != nil {
 		log.Info(err)
+		w.StartStopLock.Unlock()
 		return err
 	}
 
-	w.SocketInput, err = MakeSocketInput(socketPath, w.ScanCandidateChan,
-		w.FileDir, &w.WaitGroup, w.FilestoreVersion)
+	w.Input, err = makeInput(w.InputQueue.InChan, w.FileDir, &w.WaitGroup,
+		w.FilestoreVersion)
 	if err != nil {
 		w.StartStopLock.Unlock()
 		return err
 	}
 
-	log.Infof("Watcher running on socket %s, filestore %s, filestore version %d", socketPath, directory, storeVersion)
+	log.Infof("Watcher running on %s, filestore %s, filestore version %d", w.Input, directory, storeVersion)
 
-	w.SocketInput.Run()
+	w.Input.Run()
 
 	w.StartStopLock.Unlock()
 
@@ -213,7 +340,11 @@ func (w *Watcher) Run(directory string, storeVersion int, socketPath string) err
 // Stop causes the watcher to cease reacting to events on the target directory.
 func (w *Watcher) Stop() {
 	w.StartStopLock.Lock()
-	w.SocketInput.Stop(w.FinishNotifyChan)
+	if w.Input != nil {
+		w.Input.Stop(w.FinishNotifyChan)
+	} else {
+		close(w.FinishNotifyChan)
+	}
 	w.IsRunning = false
 	w.FileDir = "<none>"
 	w.StartStopLock.Unlock()
@@ -221,5 +352,18 @@ func (w *Watcher) Stop() {
 
 // Finish cleans up side effects of a Watcher instance.
 func (w *Watcher) Finish() {
+	w.RetryQueue.Stop()
+	// the input may still be sending events until it has been stopped
+	var inputStopped chan bool
+	if w.Input != nil {
+		inputStopped = w.FinishNotifyChan
+	}
+	w.InputQueue.Stop(inputStopped)
 	close(w.ScanCandidateChan)
+	if w.HeavyScanChan != nil {
+		go func() {
+			w.WorkerGroup.Wait()
+			close(w.HeavyScanChan)
+		}()
+	}
 }
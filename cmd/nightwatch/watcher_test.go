@@ -136,7 +136,7 @@ func _TestBacklog(t *testing.T, version int) {
 		util.CreateFilePairV2(4, tinybytes, 100, dir)
 	}
 
-	w := MakeWatcher(nil, s, nil)
+	w := MakeWatcher(nil, s, nil, DefaultWatcherConfig())
 	defer w.Finish()
 	w.backlogBuilder(dir, s, version)
 
@@ -284,7 +284,7 @@ func TestSubmitter(t *testing.T) {
 
 	// Watch directory
 	finishNotify := make(chan bool)
-	w := MakeWatcher(finishNotify, s, nil)
+	w := MakeWatcher(finishNotify, s, nil, DefaultWatcherConfig())
 	defer w.Finish()
 	w.Run(dir, 1, tmpfn)
 
@@ -410,7 +410,7 @@ func _TestBacklogDelete(t *testing.T, version int) {
 
 	s := submitter.MakeDummySubmitter()
 
-	w := MakeWatcher(nil, s, nil)
+	w := MakeWatcher(nil, s, nil, DefaultWatcherConfig())
 	w.FilestoreVersion, _ = intToStoreVersion(version)
 	defer w.Finish()
 	w.backlogBuilder(dir, s, version)
@@ -32,6 +32,9 @@ type Scanner struct{}
 // Name returns the plugin name
 func (y *Scanner) Name() string { return "YARA" }
 
+// CostClass returns the plugin's cost class, as it scans the complete file
+func (y *Scanner) CostClass() registry.CostClass { return registry.CostHeavy }
+
 // ReInitialize loads the yara rules either from file or url
 func (y *Scanner) ReInitialize() error {
 	return loadRules(*ruleFile, *ruleXZ)
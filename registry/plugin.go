@@ -20,6 +20,41 @@ func RegisterAnalysisPlugin(p AnalysisPlugin) {
 	AnalysisPlugins = append(AnalysisPlugins, p)
 }
 
+// CostClass describes how expensive a plugin's analysis is, allowing plugins
+// of different classes to be run in separate worker pools.
+type CostClass int
+
+const (
+	// CostLight is the class of plugins doing quick checks.
+	CostLight CostClass = iota
+	// CostHeavy is the class of plugins doing expensive analysis, e.g.
+	// scanning the whole file.
+	CostHeavy
+)
+
+// CostClassifier can be implemented by plugins to declare their cost class.
+// Plugins not implementing it are considered light.
+type CostClassifier interface {
+	CostClass() CostClass
+}
+
+// PluginCostClass returns the cost class of the given plugin.
+func PluginCostClass(p AnalysisPlugin) CostClass {
+	if c, ok := p.(CostClassifier); ok {
+		return c.CostClass()
+	}
+	return CostLight
+}
+
+func hasCostClass(classes []CostClass, c CostClass) bool {
+	for _, cc := range classes {
+		if cc == c {
+			return true
+		}
+	}
+	return false
+}
+
 // FileSample is the struct passed to every plugin to handle the sample
 type FileSample struct {
 	FD       uintptr
@@ -19,49 +19,115 @@ import (
 
 var rescanTimeframe = flag.Duration("rescantime", time.Hour*72, "rescan files older than time period")
 
+// Scan holds the state of a sample while it is being processed by the
+// plugins. Scans are created by PrepareScan, run through RunPlugins once per
+// cost class and completed by Finish, possibly in different goroutines.
+// FirstSeen is set if the hashes of the sample were not in the database yet.
+type Scan struct {
+	Event           sampledb.FileInfoEvent
+	Verdict         sampledb.FileVerdict
+	Truncated       bool
+	TruncatedReason string
+	FirstSeen       bool
+	sample          *os.File
+	sampleStat      os.FileInfo
+}
+
 // PluginIterator opens a given sample file and processes it with all registered
 // plugins.
 func PluginIterator(fiev sampledb.FileInfoEvent, s submitter.Submitter, uploader *uploader.Uploader) error {
-	var verdict sampledb.FileVerdict
-	verdict.Reasons = make(map[string]interface{})
-	verdict.SuspiciousVia = make([]string, 0)
+	scan, err := PrepareScan(fiev)
+	if err != nil || scan == nil {
+		return err
+	}
+	scan.RunPlugins(CostLight, CostHeavy)
+	return scan.Finish(s, uploader)
+}
+
+// PrepareScan opens a given sample file and calculates its hashes. It returns
+// a nil Scan without error if the sample does not need to be processed, e.g.
+// because it was already processed recently.
+func PrepareScan(fiev sampledb.FileInfoEvent) (*Scan, error) {
+	scan := &Scan{
+		Event: fiev,
+	}
+	scan.Verdict.Reasons = make(map[string]interface{})
+	scan.Verdict.SuspiciousVia = make([]string, 0)
 
 	sample, err := os.Open(fiev.FilePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer sample.Close()
 
 	sampleStat, err := sample.Stat()
 	if err != nil {
-		return err
+		sample.Close()
+		return nil, err
+	}
+
+	truncated, truncatedReason := CheckTruncated(fiev.Event, sampleStat.Size())
+	if truncated {
+		metricTruncated.Add(1)
+		switch truncatedConfig.Policy {
+		case TruncatedSkip:
+			log.Infof("skipping truncated file %s (%s)", fiev.FilePath, truncatedReason)
+			sample.Close()
+			return nil, nil
+		case TruncatedQuarantine:
+			log.Infof("quarantining truncated file %s (%s)", fiev.FilePath, truncatedReason)
+			sample.Close()
+			return nil, quarantineFile(fiev.FilePath)
+		default:
+			log.Infof("scanning truncated file %s (%s)", fiev.FilePath, truncatedReason)
+		}
 	}
 
 	hashes, err := CalculateBasicHashes(sample)
 	if err != nil {
-		return err
+		sample.Close()
+		return nil, err
 	}
 
-	se, err := sampledb.GetSampleEntry(hashes.Sha512)
-	if err != nil && err.Error() != "missing bucket" {
-		return err
-	}
+	// Truncated files are kept out of the database: their hashes only cover
+	// partial content, and a later complete copy needs to be scanned.
+	if !truncated {
+		se, err := sampledb.GetSampleEntry(hashes.Sha512)
+		if err != nil && err.Error() != "missing bucket" {
+			sample.Close()
+			return nil, err
+		}
 
-	// If the result set is empty this is a new sample and we process it if it has
-	// not been scanned in rescanTimeframe otherwise return.
-	if se.Hashes.Sha512 != "" && time.Now().UTC().Sub(se.Time) < *rescanTimeframe {
-		log.Debug("sample already processed: ", fiev.FilePath)
-		return err
+		// If the result set is empty this is a new sample and we process it if it has
+		// not been scanned in rescanTimeframe otherwise return.
+		if se.Hashes.Sha512 != "" && time.Now().UTC().Sub(se.Time) < *rescanTimeframe {
+			log.Debug("sample already processed: ", fiev.FilePath)
+			sample.Close()
+			return nil, nil
+		}
+		scan.FirstSeen = se.Hashes.Sha512 == ""
 	}
 
+	scan.Verdict.Hashes = hashes
+	scan.Truncated = truncated
+	scan.TruncatedReason = truncatedReason
+	scan.sample = sample
+	scan.sampleStat = sampleStat
+	return scan, nil
+}
+
+// RunPlugins lets the registered plugins of the given cost classes do their
+// analysis on the sample.
+func (scan *Scan) RunPlugins(classes ...CostClass) {
 	// Iterate over the available plugins and let them do their analysis. If they
 	// find something suspicious they should return a non empty Reason struct.
-	var suspicious = false
 	for _, plug := range AnalysisPlugins {
+		if !hasCostClass(classes, PluginCostClass(plug)) {
+			continue
+		}
 		output, pluginSuspicious, anaErr := plug.ProcessFile(FileSample{
-			FD:       sample.Fd(),
-			Info:     sampleStat,
-			OrigPath: fiev.FilePath,
+			FD:       scan.sample.Fd(),
+			Info:     scan.sampleStat,
+			OrigPath: scan.Event.FilePath,
 		})
 		if anaErr != nil {
 			log.Errorf("plugin (%s) error processing file: %s", plug.Name(), anaErr)
@@ -72,35 +138,52 @@ func PluginIterator(fiev sampledb.FileInfoEvent, s submitter.Submitter, uploader
 			var result interface{}
 			anaErr = json.Unmarshal([]byte(output), &result)
 			if anaErr != nil {
-				log.Errorf("error in plugin return data %v %v", plug.Name(), err)
+				log.Errorf("error in plugin return data %v %v", plug.Name(), anaErr)
 				continue
 			}
-			verdict.Reasons[plug.Name()] = result
-		}
-		if !suspicious {
-			suspicious = pluginSuspicious
+			scan.Verdict.Reasons[plug.Name()] = result
 		}
 		if pluginSuspicious {
-			verdict.SuspiciousVia = append(verdict.SuspiciousVia, plug.Name())
+			scan.Verdict.Suspicious = true
+			scan.Verdict.SuspiciousVia = append(scan.Verdict.SuspiciousVia, plug.Name())
 		}
 	}
-	verdict.Suspicious = suspicious
+}
+
+// Close releases the sample file of a Scan that is not going to be finished.
+func (scan *Scan) Close() error {
+	return scan.sample.Close()
+}
+
+// Finish completes the verdict for the scanned sample, records it in the
+// database and sends it on using the given submitter or uploader. The sample
+// file is closed afterwards.
+func (scan *Scan) Finish(s submitter.Submitter, uploader *uploader.Uploader) error {
+	defer scan.Close()
+
+	fiev := scan.Event
+	verdict := scan.Verdict
+	truncated := scan.Truncated
 	verdict.Filename = fiev.FilePath
 	verdict.Time = time.Now().UTC()
-	verdict.CollectionTime = sampleStat.ModTime().UTC()
+	verdict.CollectionTime = scan.sampleStat.ModTime().UTC()
 	verdict.SensorID = submitter.SensorID
-	verdict.Size = sampleStat.Size()
-	verdict.Hashes = hashes
+	verdict.Size = scan.sampleStat.Size()
 	verdict.Magic = MagicFromFile(fiev.FilePath)
 	verdict.Metadata = fiev.JSONMessage
+	verdict.Event = fiev.Event
+	verdict.Truncated = truncated
+	verdict.TruncatedReason = scan.TruncatedReason
 
-	err = sampledb.CreateSampleEntry(verdict)
-	if err != nil {
-		return err
+	if !truncated {
+		err := sampledb.CreateSampleEntry(verdict)
+		if err != nil {
+			return err
+		}
 	}
 
 	metaFile := fiev.FilePath + ".meta"
-	if _, err = os.Stat(metaFile); err == nil {
+	if _, err := os.Stat(metaFile); err == nil {
 		content, fileErr := os.ReadFile(metaFile)
 		if fileErr != nil {
 			return fileErr
@@ -118,7 +201,7 @@ func PluginIterator(fiev sampledb.FileInfoEvent, s submitter.Submitter, uploader
 
 	/// and send it on (and the file possibly as well)
 	if uploader != nil {
-		if verdict.Suspicious {
+		if uploader.ShouldUpload(&verdict, scan.FirstSeen) {
 			// in this case the uploader will handle submitting the verdict
 			// after adding the uploaded file location
 			err = uploader.Enqueue(verdict, fiev.FilePath)
@@ -139,6 +222,10 @@ func PluginIterator(fiev sampledb.FileInfoEvent, s submitter.Submitter, uploader
 	}
 	verdict.Reported = true
 
+	if truncated {
+		return nil
+	}
+
 	// Update the sample entry in the DB with our new information
 	err = sampledb.CreateSampleEntry(verdict)
 	return err
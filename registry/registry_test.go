@@ -4,13 +4,16 @@
 package registry
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/DCSO/nightwatch/sampledb"
 	"github.com/DCSO/nightwatch/submitter"
+	"github.com/DCSO/nightwatch/uploader"
 	"github.com/DCSO/nightwatch/util"
 
 	log "github.com/sirupsen/logrus"
@@ -114,3 +117,261 @@ func TestRescanTimeframe(t *testing.T) {
 
 	s.Finish()
 }
+
+type captureSubmitter struct {
+	msgs [][]byte
+}
+
+func (s *captureSubmitter) Submit(jsonData []byte) error {
+	s.msgs = append(s.msgs, jsonData)
+	return nil
+}
+
+func (s *captureSubmitter) Finish() {}
+
+func TestTruncated(t *testing.T) {
+	s := &captureSubmitter{}
+
+	dbdir, err := os.MkdirTemp("", "dbdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sampledb.InitDB(dbdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+	defer os.RemoveAll(dbdir)
+
+	dir, err := os.MkdirTemp("", "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer SetTruncatedConfig(truncatedConfig)
+	SetTruncatedConfig(DefaultTruncatedConfig())
+
+	util.CreateFilePair(2, []byte("foo bar baz"), 10, dir)
+	path := filepath.Join(dir, "file.2")
+	fiev := sampledb.FileInfoEvent{
+		FilePath: path,
+		Event: &sampledb.EventInfo{
+			File: sampledb.FileEventInfo{
+				State: "CLOSED",
+				Size:  4096,
+			},
+		},
+	}
+
+	// scan and flag, twice as truncated files are not recorded
+	for i := 1; i <= 2; i++ {
+		err = PluginIterator(fiev, s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.count[path] != int32(i) {
+			t.Fatalf("truncated file scanned %d times, expected %d", p.count[path], i)
+		}
+	}
+	if len(s.msgs) != 2 {
+		t.Fatalf("expected 2 verdicts, got %d", len(s.msgs))
+	}
+	var verdict sampledb.FileVerdict
+	err = json.Unmarshal(s.msgs[0], &verdict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verdict.Truncated || !strings.HasSuffix(verdict.TruncatedReason, "of 4096 bytes") {
+		t.Fatalf("verdict not flagged as truncated: %v %s", verdict.Truncated,
+			verdict.TruncatedReason)
+	}
+	se, err := sampledb.GetSampleEntry(verdict.Hashes.Sha512)
+	if err != nil && err.Error() != "missing bucket" {
+		t.Fatal(err)
+	}
+	if se.Hashes.Sha512 != "" {
+		t.Fatal("truncated file recorded in database")
+	}
+
+	// skip
+	SetTruncatedConfig(TruncatedConfig{Policy: TruncatedSkip})
+	err = PluginIterator(fiev, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.count[path] != 2 || len(s.msgs) != 2 {
+		t.Fatal("truncated file not skipped")
+	}
+
+	// quarantine
+	qdir := filepath.Join(dir, "quarantine")
+	SetTruncatedConfig(TruncatedConfig{Policy: TruncatedQuarantine, QuarantineDir: qdir})
+	err = PluginIterator(fiev, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.count[path] != 2 || len(s.msgs) != 2 {
+		t.Fatal("quarantined file scanned")
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("quarantined file still present")
+	}
+	if _, err = os.Stat(filepath.Join(qdir, "file.2")); err != nil {
+		t.Fatal("quarantined file missing in quarantine directory")
+	}
+	if _, err = os.Stat(filepath.Join(qdir, "file.2.meta")); err != nil {
+		t.Fatal("metafile not moved to quarantine directory")
+	}
+
+	// Suricata reuses the name for another truncated file
+	util.CreateFilePair(2, []byte("qux quux"), 10, dir)
+	err = PluginIterator(fiev, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(qdir, "file.2"))
+	if err != nil || !strings.HasPrefix(string(data), "foo bar baz") {
+		t.Fatal("quarantined file overwritten")
+	}
+	data, err = os.ReadFile(filepath.Join(qdir, "file.2-1"))
+	if err != nil || !strings.HasPrefix(string(data), "qux quux") {
+		t.Fatal("second quarantined file missing in quarantine directory")
+	}
+	if _, err = os.Stat(filepath.Join(qdir, "file.2-1.meta")); err != nil {
+		t.Fatal("second metafile not moved to quarantine directory")
+	}
+}
+
+func TestTruncatedPolicyFlag(t *testing.T) {
+	var tp TruncatedPolicy
+	if tp.Set("quarantine") != nil || tp != TruncatedQuarantine {
+		t.Fatal("valid policy rejected")
+	}
+	if tp.Set("ignore") == nil {
+		t.Fatal("invalid policy accepted")
+	}
+}
+
+func TestScanCostClasses(t *testing.T) {
+	s := &captureSubmitter{}
+
+	dbdir, err := os.MkdirTemp("", "dbdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sampledb.InitDB(dbdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+	defer os.RemoveAll(dbdir)
+
+	dir, err := os.MkdirTemp("", "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if PluginCostClass(p) != CostLight {
+		t.Fatal("plugin without cost class not considered light")
+	}
+
+	util.CreateFilePair(3, []byte("foo bar baz quux"), 10, dir)
+	path := filepath.Join(dir, "file.3")
+	scan, err := PrepareScan(sampledb.FileInfoEvent{
+		FilePath: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scan == nil {
+		t.Fatal("new sample not prepared for scanning")
+	}
+	scan.RunPlugins(CostHeavy)
+	if p.count[path] != 0 {
+		t.Fatal("light plugin run with heavy plugins")
+	}
+	scan.RunPlugins(CostLight)
+	if p.count[path] != 1 {
+		t.Fatal("light plugin not run")
+	}
+	err = scan.Finish(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.msgs) != 1 {
+		t.Fatalf("expected 1 verdict, got %d", len(s.msgs))
+	}
+
+	// already processed sample is not prepared again
+	scan, err = PrepareScan(sampledb.FileInfoEvent{
+		FilePath: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scan != nil {
+		t.Fatal("processed sample prepared again")
+	}
+}
+
+func TestUploadPolicy(t *testing.T) {
+	s := &captureSubmitter{}
+
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	oldRescanTimeframe := *rescanTimeframe
+	*rescanTimeframe = 0
+	defer func() {
+		*rescanTimeframe = oldRescanTimeframe
+	}()
+
+	backend, err := uploader.MakeLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := uploader.DefaultUploadConfig()
+	config.Policy = &uploader.Policy{Percent: 100, FirstSeen: true}
+	dir := t.TempDir()
+	u, err := uploader.MakeUploader(backend, dir, t.TempDir(), submitter.MakeDummySubmitter(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	util.CreateFilePair(3, []byte("clean sample"), 10, dir)
+	fiev := sampledb.FileInfoEvent{
+		FilePath: filepath.Join(dir, "file.3"),
+	}
+
+	// clean samples seen for the first time are uploaded, which submits
+	// their verdict afterwards
+	err = PluginIterator(fiev, s, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.msgs) != 0 {
+		t.Fatal("verdict of uploaded sample submitted directly")
+	}
+	jobs, err := sampledb.UploadJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Verdict.Suspicious {
+		t.Fatalf("unexpected upload jobs %+v", jobs)
+	}
+
+	// rescans are not
+	err = PluginIterator(fiev, s, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.msgs) != 1 {
+		t.Fatal("verdict of rescanned sample not submitted")
+	}
+}
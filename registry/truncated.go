@@ -0,0 +1,173 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package registry
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+// TruncatedPolicy determines how files are handled that Suricata could not
+// extract completely.
+type TruncatedPolicy string
+
+const (
+	// TruncatedScan scans truncated files and flags them in the verdict.
+	TruncatedScan TruncatedPolicy = "scan"
+	// TruncatedSkip ignores truncated files.
+	TruncatedSkip TruncatedPolicy = "skip"
+	// TruncatedQuarantine moves truncated files into the quarantine directory
+	// without scanning them.
+	TruncatedQuarantine TruncatedPolicy = "quarantine"
+)
+
+// String returns the policy name.
+func (p *TruncatedPolicy) String() string {
+	return string(*p)
+}
+
+// Set sets the policy from its name.
+func (p *TruncatedPolicy) Set(s string) error {
+	switch TruncatedPolicy(s) {
+	case TruncatedScan, TruncatedSkip, TruncatedQuarantine:
+		*p = TruncatedPolicy(s)
+		return nil
+	}
+	return fmt.Errorf("invalid policy for truncated files: %s", s)
+}
+
+// TruncatedConfig describes how files are handled that Suricata could not
+// extract completely.
+type TruncatedConfig struct {
+	Policy TruncatedPolicy
+	// QuarantineDir is the directory files are moved to with
+	// TruncatedQuarantine.
+	QuarantineDir string
+}
+
+// DefaultTruncatedConfig returns the default handling of truncated files,
+// scanning them.
+func DefaultTruncatedConfig() TruncatedConfig {
+	return TruncatedConfig{
+		Policy:        TruncatedScan,
+		QuarantineDir: "/var/lib/nightwatch/quarantine",
+	}
+}
+
+var (
+	truncatedConfig = DefaultTruncatedConfig()
+
+	metricTruncated = expvar.NewInt("truncated_files")
+)
+
+// SetTruncatedConfig sets how truncated files are handled. It needs to be
+// called before files are scanned.
+func SetTruncatedConfig(config TruncatedConfig) {
+	truncatedConfig = config
+}
+
+// CheckTruncated uses the fileinfo event to determine whether a file with the
+// given size on disk is incomplete. If so, it also returns a description of
+// the reasons.
+func CheckTruncated(ei *sampledb.EventInfo, size int64) (bool, string) {
+	if ei == nil {
+		return false, ""
+	}
+	reasons := make([]string, 0)
+	if ei.File.Gaps {
+		reasons = append(reasons, "gaps")
+	}
+	if ei.File.State != "" && ei.File.State != "CLOSED" {
+		reasons = append(reasons, fmt.Sprintf("state %s", ei.File.State))
+	}
+	if ei.File.Size > size {
+		reasons = append(reasons, fmt.Sprintf("size %d of %d bytes", size, ei.File.Size))
+	}
+	return len(reasons) > 0, strings.Join(reasons, ", ")
+}
+
+// quarantineDest reserves a name in the quarantine directory for the file at
+// the given path. Suricata reuses file names, so a numeric suffix is added to
+// keep files quarantined earlier.
+func quarantineDest(path string) (string, error) {
+	base := filepath.Base(path)
+	for i := 0; ; i++ {
+		dest := filepath.Join(truncatedConfig.QuarantineDir, base)
+		if i > 0 {
+			dest = filepath.Join(truncatedConfig.QuarantineDir, fmt.Sprintf("%s-%d", base, i))
+		}
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			return dest, f.Close()
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+}
+
+// moveFile moves a file, copying it if it is located on a different file
+// system.
+func moveFile(path, dest string) error {
+	err := os.Rename(path, dest)
+	if err == nil {
+		return nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, src)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// quarantineFile moves the file at the given path to the quarantine
+// directory, along with its metafiles.
+func quarantineFile(path string) error {
+	err := os.MkdirAll(truncatedConfig.QuarantineDir, 0700)
+	if err != nil {
+		return err
+	}
+	dest, err := quarantineDest(path)
+	if err != nil {
+		return err
+	}
+	err = moveFile(path, dest)
+	if err != nil {
+		return err
+	}
+	metaFiles, err := filepath.Glob(path + ".*.json")
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(path + ".meta"); err == nil {
+		metaFiles = append(metaFiles, path+".meta")
+	}
+	for _, mf := range metaFiles {
+		err = moveFile(mf, dest+strings.TrimPrefix(mf, path))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
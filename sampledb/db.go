@@ -38,6 +38,19 @@ func CloseDB() error {
 	return filesDB.Close()
 }
 
+// ResetSamples removes all FileVerdict reports from the database, leaving
+// other data such as the outbox, the scan queue and upload jobs intact.
+func ResetSamples() error {
+	return filesDB.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(bucketName))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte(bucketName))
+		return err
+	})
+}
+
 // CreateSampleEntry creates a database entry for a newly observed file.
 func CreateSampleEntry(fv FileVerdict) error {
 	encoded, err := json.Marshal(fv)
@@ -81,3 +94,26 @@ func GetSampleEntry(hash string) (FileVerdict, error) {
 	err = json.Unmarshal(data, &fv)
 	return fv, err
 }
+
+// SampleEntries returns all FileVerdict reports in the database, ordered by
+// the sha512 hash of the sample.
+func SampleEntries() ([]FileVerdict, error) {
+	verdicts := make([]FileVerdict, 0)
+	err := filesDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var fv FileVerdict
+			err := json.Unmarshal(v, &fv)
+			if err != nil {
+				log.Errorf("invalid sample entry %s: %s", k, err)
+				return nil
+			}
+			verdicts = append(verdicts, fv)
+			return nil
+		})
+	})
+	return verdicts, err
+}
@@ -0,0 +1,242 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package sampledb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultOutbox is the outbox verdicts are kept in until they are submitted.
+// Other outboxes can be used by giving them different names.
+const DefaultOutbox = "OUTBOX"
+
+// deadLetters returns the name of the bucket holding the messages given up on
+// from the given outbox.
+func deadLetters(outbox string) string {
+	return outbox + "_DEAD"
+}
+
+func addOutboxEntry(tx *bolt.Tx, outbox string, data []byte) (uint64, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(outbox))
+	if err != nil {
+		return 0, err
+	}
+	id, err := bucket.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	return id, bucket.Put(queueKey(id), data)
+}
+
+// AddOutboxEntry stores a message to be submitted in the given outbox,
+// returning its ID.
+func AddOutboxEntry(outbox string, data []byte) (uint64, error) {
+	var id uint64
+	err := filesDB.Update(func(tx *bolt.Tx) error {
+		var err error
+		id, err = addOutboxEntry(tx, outbox, data)
+		return err
+	})
+	return id, err
+}
+
+// AddOutboxEntries stores a message in all given outboxes at once, so that it
+// is either added to all of them or to none.
+func AddOutboxEntries(outboxes []string, data []byte) error {
+	return filesDB.Update(func(tx *bolt.Tx) error {
+		for _, outbox := range outboxes {
+			if _, err := addOutboxEntry(tx, outbox, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FirstOutboxEntries returns up to n of the oldest messages in the given
+// outbox along with their IDs, in order. The returned slices are empty if the
+// outbox is empty.
+func FirstOutboxEntries(outbox string, n int) ([]uint64, [][]byte, error) {
+	var ids []uint64
+	var data [][]byte
+	err := filesDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(outbox))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil && len(ids) < n; k, v = c.Next() {
+			ids = append(ids, binary.BigEndian.Uint64(k))
+			data = append(data, append([]byte(nil), v...))
+		}
+		return nil
+	})
+	return ids, data, err
+}
+
+// DeleteOutboxEntries removes the messages with the given IDs from the given
+// outbox once they have been submitted.
+func DeleteOutboxEntries(outbox string, ids []uint64) error {
+	return filesDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(outbox))
+		if bucket == nil {
+			return nil
+		}
+		for _, id := range ids {
+			if err := bucket.Delete(queueKey(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeadLetterOutboxEntries moves the messages with the given IDs from the
+// given outbox to its dead letters, where they are kept until they are
+// requeued.
+func DeadLetterOutboxEntries(outbox string, ids []uint64) error {
+	return filesDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(outbox))
+		if bucket == nil {
+			return nil
+		}
+		deadBucket, err := tx.CreateBucketIfNotExists([]byte(deadLetters(outbox)))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			data := bucket.Get(queueKey(id))
+			if data == nil {
+				continue
+			}
+			err = deadBucket.Put(queueKey(id), data)
+			if err != nil {
+				return err
+			}
+			err = bucket.Delete(queueKey(id))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RequeueDeadLetters moves all dead letters of the given outbox back to its
+// end. It returns the number of messages moved.
+func RequeueDeadLetters(outbox string) (int, error) {
+	var n int
+	err := filesDB.Update(func(tx *bolt.Tx) error {
+		deadBucket := tx.Bucket([]byte(deadLetters(outbox)))
+		if deadBucket == nil {
+			return nil
+		}
+		err := deadBucket.ForEach(func(k, v []byte) error {
+			_, err := addOutboxEntry(tx, outbox, v)
+			n++
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(deadLetters(outbox)))
+	})
+	return n, err
+}
+
+// MoveOutboxEntries moves all messages in the outbox from to the end of the
+// outboxes returned by route for each of them, dropping those for which it
+// returns none. It returns the number of messages moved.
+func MoveOutboxEntries(from string, route func(data []byte) []string) (int, error) {
+	var n int
+	err := filesDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(from))
+		if bucket == nil {
+			return nil
+		}
+		var keys [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			for _, outbox := range route(v) {
+				if _, err := addOutboxEntry(tx, outbox, v); err != nil {
+					return err
+				}
+			}
+			keys = append(keys, k)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// OutboxLen returns the number of messages in the given outbox.
+func OutboxLen(outbox string) (int, error) {
+	var n int
+	err := filesDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(outbox))
+		if bucket != nil {
+			n = bucket.Stats().KeyN
+		}
+		return nil
+	})
+	return n, err
+}
+
+// MoveUnreportedToOutbox adds all stored verdicts which have not been
+// reported yet to the default outbox and marks them as reported. It returns the
+// number of verdicts moved.
+func MoveUnreportedToOutbox() (int, error) {
+	var n int
+	err := filesDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			return nil
+		}
+		updates := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			var fv FileVerdict
+			if err := json.Unmarshal(v, &fv); err != nil {
+				log.Errorf("invalid sample entry %s: %s", k, err)
+				return nil
+			}
+			if fv.Reported {
+				return nil
+			}
+			if _, err := addOutboxEntry(tx, DefaultOutbox, v); err != nil {
+				return err
+			}
+			fv.Reported = true
+			encoded, err := json.Marshal(fv)
+			if err != nil {
+				return err
+			}
+			updates[string(k)] = encoded
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, v := range updates {
+			if err = bucket.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		n = len(updates)
+		return nil
+	})
+	return n, err
+}
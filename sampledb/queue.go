@@ -0,0 +1,80 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package sampledb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+const queueBucketName = "QUEUE"
+
+func queueKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// EnqueueEvent stores a FileInfoEvent in the persistent scan queue, setting
+// its QueueID.
+func EnqueueEvent(fiev *FileInfoEvent) error {
+	return filesDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(queueBucketName))
+		if err != nil {
+			return err
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		fiev.QueueID = id
+		encoded, err := json.Marshal(fiev)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(queueKey(id), encoded)
+	})
+}
+
+// DequeueEvent removes the event with the given QueueID from the persistent
+// scan queue once it has been processed.
+func DequeueEvent(id uint64) error {
+	err := filesDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(queueBucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(queueKey(id))
+	})
+	if err == nil {
+		log.Debug("Removed event from queue:", id)
+	}
+	return err
+}
+
+// QueuedEvents returns all events in the persistent scan queue in the order
+// they were added.
+func QueuedEvents() ([]FileInfoEvent, error) {
+	events := make([]FileInfoEvent, 0)
+	err := filesDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(queueBucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var fiev FileInfoEvent
+			err := json.Unmarshal(v, &fiev)
+			if err != nil {
+				log.Errorf("invalid queued event %x: %s", k, err)
+				return nil
+			}
+			events = append(events, fiev)
+			return nil
+		})
+	})
+	return events, err
+}
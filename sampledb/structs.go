@@ -4,6 +4,8 @@
 package sampledb
 
 import (
+	"encoding/json"
+	"sort"
 	"time"
 
 	"github.com/DCSO/nightwatch/util"
@@ -26,6 +28,35 @@ type FileVerdict struct {
 	Magic          string
 	Uploaded       bool
 	UploadLocation string `json:"UploadLocation,omitempty"`
+	// UploadWrapping is the protection of the uploaded sample, such as zip
+	// or age, if any.
+	UploadWrapping string     `json:"UploadWrapping,omitempty"`
+	Event          *EventInfo `json:"Event,omitempty"`
+	// Truncated is set if Suricata could not extract the file completely,
+	// in which case TruncatedReason describes why.
+	Truncated       bool   `json:"Truncated,omitempty"`
+	TruncatedReason string `json:"TruncatedReason,omitempty"`
+}
+
+// MatchedRules returns the names of the YARA rules matched according to the
+// reasons of the verdict, in sorted order.
+func (fv *FileVerdict) MatchedRules() []string {
+	var rules []string
+	for _, reason := range fv.Reasons {
+		var result struct {
+			MatchedRules []string
+		}
+		switch r := reason.(type) {
+		case string:
+			json.Unmarshal([]byte(r), &result)
+		case map[string]interface{}:
+			b, _ := json.Marshal(r)
+			json.Unmarshal(b, &result)
+		}
+		rules = append(rules, result.MatchedRules...)
+	}
+	sort.Strings(rules)
+	return rules
 }
 
 // HashInfo contains file hash information for the verdict struct
@@ -37,6 +68,64 @@ type HashInfo struct {
 	Sha3_512 string
 }
 
+// EventInfo contains the fields of the Suricata fileinfo event and its flow
+// context describing how a sample was observed.
+type EventInfo struct {
+	Timestamp string `json:"Timestamp,omitempty"`
+	FlowID    uint64 `json:"FlowID,omitempty"`
+	SrcIP     string `json:"SrcIP,omitempty"`
+	SrcPort   int    `json:"SrcPort,omitempty"`
+	DestIP    string `json:"DestIP,omitempty"`
+	DestPort  int    `json:"DestPort,omitempty"`
+	Proto     string `json:"Proto,omitempty"`
+	AppProto  string `json:"AppProto,omitempty"`
+	TxID      int
+	HTTP      *HTTPInfo  `json:"HTTP,omitempty"`
+	SMTP      *SMTPInfo  `json:"SMTP,omitempty"`
+	Email     *EmailInfo `json:"Email,omitempty"`
+	File      FileEventInfo
+}
+
+// HTTPInfo contains the HTTP transaction a sample was transferred in.
+type HTTPInfo struct {
+	Hostname    string `json:"Hostname,omitempty"`
+	URL         string `json:"URL,omitempty"`
+	Method      string `json:"Method,omitempty"`
+	UserAgent   string `json:"UserAgent,omitempty"`
+	ContentType string `json:"ContentType,omitempty"`
+	Status      int    `json:"Status,omitempty"`
+}
+
+// SMTPInfo contains the SMTP transaction a sample was transferred in.
+type SMTPInfo struct {
+	Helo     string   `json:"Helo,omitempty"`
+	MailFrom string   `json:"MailFrom,omitempty"`
+	RcptTo   []string `json:"RcptTo,omitempty"`
+}
+
+// EmailInfo contains the email a sample was attached to.
+type EmailInfo struct {
+	From    string   `json:"From,omitempty"`
+	To      []string `json:"To,omitempty"`
+	Cc      []string `json:"Cc,omitempty"`
+	Subject string   `json:"Subject,omitempty"`
+}
+
+// FileEventInfo contains the file-specific part of a fileinfo event as
+// reported by Suricata.
+type FileEventInfo struct {
+	Filename string `json:"Filename,omitempty"`
+	FileID   uint64 `json:"FileID,omitempty"`
+	Stored   bool
+	Magic    string `json:"Magic,omitempty"`
+	State    string `json:"State,omitempty"`
+	Gaps     bool
+	Size     int64
+	Md5      string `json:"Md5,omitempty"`
+	Sha1     string `json:"Sha1,omitempty"`
+	Sha256   string `json:"Sha256,omitempty"`
+}
+
 // FileInfoEvent is a struct containing both the file path as well
 // as the original
 type FileInfoEvent struct {
@@ -44,4 +133,12 @@ type FileInfoEvent struct {
 	JSONMessage  interface{}
 	MetafileText string
 	FilePath     string
+	// Event contains the parsed fileinfo event, if available.
+	Event *EventInfo `json:"Event,omitempty"`
+	// Retries is the number of times processing of the event was deferred
+	// because its file was not yet complete.
+	Retries int `json:"Retries,omitempty"`
+	// QueueID identifies the event in the persistent scan queue. It is zero
+	// for events not stored there.
+	QueueID uint64 `json:"QueueID,omitempty"`
 }
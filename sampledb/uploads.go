@@ -0,0 +1,269 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package sampledb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	uploadsBucketName = "UPLOADS"
+	// uploadsDueBucketName indexes upload jobs by the time they are due,
+	// so that only those need to be read.
+	uploadsDueBucketName = "UPLOADS_DUE"
+)
+
+// UploadState is the state of an upload job.
+type UploadState string
+
+// States of upload jobs. New jobs are pending; jobs which failed are retried
+// once their NextAttempt has passed, unless they were given up on, in which
+// case NextAttempt is not set. Jobs which are done or were given up on are
+// removed once they expire.
+const (
+	UploadPending   UploadState = "pending"
+	UploadUploading UploadState = "uploading"
+	UploadDone      UploadState = "done"
+	UploadFailed    UploadState = "failed"
+)
+
+// UploadJob describes the upload of a sample and its verdict, keyed by the
+// sha512 hash of the sample.
+type UploadJob struct {
+	Verdict FileVerdict
+	// LocalPath is the copy of the sample to upload.
+	LocalPath string
+	// Key is the object key of the sample in the bucket.
+	Key         string `json:"Key,omitempty"`
+	State       UploadState
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `json:"LastError,omitempty"`
+	// Expires is the time a job which is done or was given up on is
+	// removed.
+	Expires time.Time
+}
+
+// Finished returns whether the job is done or was given up on.
+func (j *UploadJob) Finished() bool {
+	return j.State == UploadDone || (j.State == UploadFailed && j.NextAttempt.IsZero())
+}
+
+// dueKey returns the key of the job in the index of due jobs: the time the
+// job is due, followed by its hash. Pending jobs are due immediately,
+// finished jobs once they expire. Jobs being uploaded are not indexed.
+func (j *UploadJob) dueKey() []byte {
+	var due time.Time
+	switch {
+	case j.State == UploadUploading:
+		return nil
+	case j.Finished():
+		due = j.Expires
+	case j.State == UploadFailed:
+		due = j.NextAttempt
+	}
+	key := make([]byte, 8, 8+len(j.Verdict.Hashes.Sha512))
+	if !due.IsZero() {
+		binary.BigEndian.PutUint64(key, uint64(due.UnixNano()))
+	}
+	return append(key, j.Verdict.Hashes.Sha512...)
+}
+
+// putUploadJob stores the job and updates its entry in the index of due
+// jobs.
+func putUploadJob(tx *bolt.Tx, job UploadJob) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	bucket, err := tx.CreateBucketIfNotExists([]byte(uploadsBucketName))
+	if err != nil {
+		return err
+	}
+	dueBucket, err := tx.CreateBucketIfNotExists([]byte(uploadsDueBucketName))
+	if err != nil {
+		return err
+	}
+	hash := []byte(job.Verdict.Hashes.Sha512)
+	err = deleteDueKey(bucket, dueBucket, hash)
+	if err != nil {
+		return err
+	}
+	err = bucket.Put(hash, encoded)
+	if err != nil {
+		return err
+	}
+	if key := job.dueKey(); key != nil {
+		return dueBucket.Put(key, []byte{})
+	}
+	return nil
+}
+
+// deleteDueKey removes the entry of the stored job with the given hash from
+// the index of due jobs.
+func deleteDueKey(bucket, dueBucket *bolt.Bucket, hash []byte) error {
+	data := bucket.Get(hash)
+	if data == nil {
+		return nil
+	}
+	var old UploadJob
+	if json.Unmarshal(data, &old) != nil {
+		return nil
+	}
+	if key := old.dueKey(); key != nil {
+		return dueBucket.Delete(key)
+	}
+	return nil
+}
+
+// PutUploadJob creates or updates an upload job.
+func PutUploadJob(job UploadJob) error {
+	return filesDB.Update(func(tx *bolt.Tx) error {
+		return putUploadJob(tx, job)
+	})
+}
+
+// DeleteUploadJob removes the upload job for the sample with the given
+// sha512 hash, if there is one.
+func DeleteUploadJob(hash string) error {
+	return filesDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(uploadsBucketName))
+		dueBucket := tx.Bucket([]byte(uploadsDueBucketName))
+		if bucket == nil || dueBucket == nil {
+			return nil
+		}
+		err := deleteDueKey(bucket, dueBucket, []byte(hash))
+		if err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(hash))
+	})
+}
+
+// DueUploadJobs returns the upload jobs which are due at the given time,
+// pending ones first, and the time the next job is due, which is zero if
+// there is none. Only these jobs are read from the database.
+func DueUploadJobs(now time.Time) ([]UploadJob, time.Time, error) {
+	jobs := make([]UploadJob, 0)
+	var next time.Time
+	err := filesDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(uploadsBucketName))
+		dueBucket := tx.Bucket([]byte(uploadsDueBucketName))
+		if bucket == nil || dueBucket == nil {
+			return nil
+		}
+		c := dueBucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if len(k) < 8 {
+				continue
+			}
+			if due := int64(binary.BigEndian.Uint64(k)); due > now.UnixNano() {
+				next = time.Unix(0, due)
+				return nil
+			}
+			var job UploadJob
+			err := json.Unmarshal(bucket.Get(k[8:]), &job)
+			if err != nil {
+				log.Errorf("invalid upload job %s: %s", k[8:], err)
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	return jobs, next, err
+}
+
+// GetUploadJob returns the upload job for the sample with the given sha512
+// hash. The returned job has an empty state if there is none.
+func GetUploadJob(hash string) (UploadJob, error) {
+	var job UploadJob
+	err := filesDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(uploadsBucketName))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(hash))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &job)
+	})
+	return job, err
+}
+
+// UploadJobs returns all upload jobs, ordered by the sha512 hash of the
+// sample.
+func UploadJobs() ([]UploadJob, error) {
+	jobs := make([]UploadJob, 0)
+	err := filesDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(uploadsBucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var job UploadJob
+			err := json.Unmarshal(v, &job)
+			if err != nil {
+				log.Errorf("invalid upload job %s: %s", k, err)
+				return nil
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// ResetUploadJobs marks all jobs which were being uploaded as pending again,
+// as after a restart, and rebuilds the index of due jobs, which jobs stored
+// by previous versions are missing from. It returns the number of jobs
+// reset.
+func ResetUploadJobs() (int, error) {
+	var n int
+	err := filesDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(uploadsBucketName))
+		if bucket == nil {
+			return nil
+		}
+		err := tx.DeleteBucket([]byte(uploadsDueBucketName))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		dueBucket, err := tx.CreateBucket([]byte(uploadsDueBucketName))
+		if err != nil {
+			return err
+		}
+		updates := make([]UploadJob, 0)
+		err = bucket.ForEach(func(k, v []byte) error {
+			var job UploadJob
+			if err := json.Unmarshal(v, &job); err != nil {
+				log.Errorf("invalid upload job %s: %s", k, err)
+				return nil
+			}
+			if job.State == UploadUploading {
+				job.State = UploadPending
+				updates = append(updates, job)
+				return nil
+			}
+			return dueBucket.Put(job.dueKey(), []byte{})
+		})
+		if err != nil {
+			return err
+		}
+		for _, job := range updates {
+			if err = putUploadJob(tx, job); err != nil {
+				return err
+			}
+		}
+		n = len(updates)
+		return nil
+	})
+	return n, err
+}
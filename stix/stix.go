@@ -0,0 +1,314 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+// Package stix converts verdicts into STIX 2.1 objects for sharing them with
+// partners. Identifiers and timestamps are derived from the verdicts only, so
+// converting the same verdicts always yields the same output.
+package stix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+
+	"github.com/google/uuid"
+)
+
+// SpecVersion is the STIX version of the created objects.
+const SpecVersion = "2.1"
+
+const (
+	// Product is the name of the analysis product in malware-analysis
+	// objects.
+	Product = "nightwatch"
+	// timeFormat is the STIX timestamp format with millisecond precision.
+	timeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+var (
+	// scoNamespace is the namespace for identifiers of STIX Cyber-observable
+	// Objects defined by the STIX specification.
+	scoNamespace = uuid.Must(uuid.Parse("00abedb4-aa42-466c-9c01-fed23315a9b7"))
+	// namespace is the namespace for identifiers of the other objects.
+	namespace = uuid.NewSHA1(uuid.NameSpaceDNS, []byte("nightwatch.dcso.de"))
+)
+
+// File is a file STIX Cyber-observable Object describing a sample.
+type File struct {
+	Type        string            `json:"type"`
+	SpecVersion string            `json:"spec_version"`
+	ID          string            `json:"id"`
+	Hashes      map[string]string `json:"hashes,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Magic       string            `json:"x_nightwatch_magic,omitempty"`
+}
+
+// MalwareAnalysis is a malware-analysis STIX Domain Object describing the
+// result of a plugin for a sample.
+type MalwareAnalysis struct {
+	Type          string `json:"type"`
+	SpecVersion   string `json:"spec_version"`
+	ID            string `json:"id"`
+	Created       string `json:"created"`
+	Modified      string `json:"modified"`
+	Product       string `json:"product"`
+	Module        string `json:"module"`
+	AnalysisEnded string `json:"analysis_ended,omitempty"`
+	Result        string `json:"result"`
+	ResultName    string `json:"result_name,omitempty"`
+	SampleRef     string `json:"sample_ref"`
+	SensorID      string `json:"x_nightwatch_sensor_id,omitempty"`
+}
+
+// Indicator is an indicator STIX Domain Object matching the hash of a
+// suspicious sample.
+type Indicator struct {
+	Type           string   `json:"type"`
+	SpecVersion    string   `json:"spec_version"`
+	ID             string   `json:"id"`
+	Created        string   `json:"created"`
+	Modified       string   `json:"modified"`
+	Name           string   `json:"name"`
+	IndicatorTypes []string `json:"indicator_types"`
+	Pattern        string   `json:"pattern"`
+	PatternType    string   `json:"pattern_type"`
+	ValidFrom      string   `json:"valid_from"`
+	Labels         []string `json:"labels,omitempty"`
+}
+
+// Relationship is a STIX Relationship Object linking two objects.
+type Relationship struct {
+	Type             string `json:"type"`
+	SpecVersion      string `json:"spec_version"`
+	ID               string `json:"id"`
+	Created          string `json:"created"`
+	Modified         string `json:"modified"`
+	RelationshipType string `json:"relationship_type"`
+	SourceRef        string `json:"source_ref"`
+	TargetRef        string `json:"target_ref"`
+}
+
+// Bundle is a STIX bundle of objects.
+type Bundle struct {
+	Type    string        `json:"type"`
+	ID      string        `json:"id"`
+	Objects []interface{} `json:"objects"`
+}
+
+// canonicalJSON returns the JSON encoding of v with sorted keys and without
+// HTML escaping, as needed for deterministic identifiers.
+func canonicalJSON(v interface{}) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
+
+// id returns the identifier of an object of the given type, derived from
+// the given parts.
+func id(objectType string, parts ...string) string {
+	return objectType + "--" + uuid.NewSHA1(namespace,
+		[]byte(objectType+"|"+strings.Join(parts, "|"))).String()
+}
+
+// timestamp returns t as STIX timestamp.
+func timestamp(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
+
+// filename returns the name of the sample as transferred, if known.
+func filename(v *sampledb.FileVerdict) string {
+	if v.Event != nil {
+		return v.Event.File.Filename
+	}
+	return ""
+}
+
+// MakeFile returns the file object for the sample of a verdict. Its
+// identifier is derived from the SHA-256 hash and the name as described in
+// the STIX specification, so it matches that of other producers.
+func MakeFile(v *sampledb.FileVerdict) *File {
+	f := &File{
+		Type:        "file",
+		SpecVersion: SpecVersion,
+		Hashes:      make(map[string]string),
+		Size:        v.Size,
+		Name:        filename(v),
+		Magic:       v.Magic,
+	}
+	for name, value := range map[string]string{
+		"MD5":      v.Hashes.Md5,
+		"SHA-1":    v.Hashes.Sha1,
+		"SHA-256":  v.Hashes.Sha256,
+		"SHA-512":  v.Hashes.Sha512,
+		"SHA3-512": v.Hashes.Sha3_512,
+	} {
+		if len(value) > 0 {
+			f.Hashes[name] = value
+		}
+	}
+	contributing := make(map[string]interface{})
+	if len(v.Hashes.Sha256) > 0 {
+		contributing["hashes"] = map[string]string{"SHA-256": v.Hashes.Sha256}
+	}
+	if len(f.Name) > 0 {
+		contributing["name"] = f.Name
+	}
+	f.ID = "file--" + uuid.NewSHA1(scoNamespace, canonicalJSON(contributing)).String()
+	return f
+}
+
+// plugins returns the sorted names of the plugins with results in a verdict.
+func plugins(v *sampledb.FileVerdict) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for name := range v.Reasons {
+		seen[name] = true
+		names = append(names, name)
+	}
+	for _, name := range v.SuspiciousVia {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Objects returns the STIX objects for a verdict: the file, a
+// malware-analysis for each plugin result and, if the sample is suspicious,
+// an indicator for its hash together with relationships from the indicator
+// to the file and the analyses it is based on.
+func Objects(v *sampledb.FileVerdict) []interface{} {
+	ts := timestamp(v.Time)
+	file := MakeFile(v)
+	objects := []interface{}{file}
+
+	suspiciousVia := make(map[string]bool)
+	for _, name := range v.SuspiciousVia {
+		suspiciousVia[name] = true
+	}
+	var suspiciousAnalyses []string
+	for _, name := range plugins(v) {
+		a := &MalwareAnalysis{
+			Type:          "malware-analysis",
+			SpecVersion:   SpecVersion,
+			ID:            id("malware-analysis", v.Hashes.Sha256, v.SensorID, ts, name),
+			Created:       ts,
+			Modified:      ts,
+			Product:       Product,
+			Module:        name,
+			AnalysisEnded: ts,
+			Result:        "benign",
+			SampleRef:     file.ID,
+			SensorID:      v.SensorID,
+		}
+		if suspiciousVia[name] {
+			a.Result = "suspicious"
+			suspiciousAnalyses = append(suspiciousAnalyses, a.ID)
+		}
+		if name == "YARA" {
+			a.ResultName = strings.Join(v.MatchedRules(), ",")
+		}
+		objects = append(objects, a)
+	}
+
+	if !v.Suspicious || len(v.Hashes.Sha256) == 0 {
+		return objects
+	}
+	name := "Suspicious file"
+	if len(file.Name) > 0 {
+		name += " " + file.Name
+	}
+	indicator := &Indicator{
+		Type:           "indicator",
+		SpecVersion:    SpecVersion,
+		ID:             id("indicator", v.Hashes.Sha256, v.SensorID, ts),
+		Created:        ts,
+		Modified:       ts,
+		Name:           name,
+		IndicatorTypes: []string{"malicious-activity"},
+		Pattern:        fmt.Sprintf("[file:hashes.'SHA-256' = '%s']", v.Hashes.Sha256),
+		PatternType:    "stix",
+		ValidFrom:      ts,
+		Labels:         v.MatchedRules(),
+	}
+	objects = append(objects, indicator)
+	relate := func(relationshipType, target string) {
+		objects = append(objects, &Relationship{
+			Type:             "relationship",
+			SpecVersion:      SpecVersion,
+			ID:               id("relationship", indicator.ID, relationshipType, target),
+			Created:          ts,
+			Modified:         ts,
+			RelationshipType: relationshipType,
+			SourceRef:        indicator.ID,
+			TargetRef:        target,
+		})
+	}
+	relate("indicates", file.ID)
+	for _, analysis := range suspiciousAnalyses {
+		relate("based-on", analysis)
+	}
+	return objects
+}
+
+// objectID returns the identifier of one of the objects returned by Objects.
+func objectID(o interface{}) string {
+	switch o := o.(type) {
+	case *File:
+		return o.ID
+	case *MalwareAnalysis:
+		return o.ID
+	case *Indicator:
+		return o.ID
+	case *Relationship:
+		return o.ID
+	}
+	return ""
+}
+
+// MakeBundle returns a bundle with the objects for the given verdicts, in
+// order. Objects shared by several verdicts, such as the file of a sample
+// seen repeatedly, are included once. The identifier of the bundle is
+// derived from those of its objects.
+func MakeBundle(verdicts ...*sampledb.FileVerdict) *Bundle {
+	b := &Bundle{
+		Type:    "bundle",
+		Objects: make([]interface{}, 0),
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	for _, v := range verdicts {
+		for _, o := range Objects(v) {
+			oid := objectID(o)
+			if seen[oid] {
+				continue
+			}
+			seen[oid] = true
+			ids = append(ids, oid)
+			b.Objects = append(b.Objects, o)
+		}
+	}
+	b.ID = id("bundle", ids...)
+	return b
+}
+
+// Convert converts a verdict encoded as JSON into a STIX bundle encoded as
+// JSON. It can be used as format for submitters.
+func Convert(jsonData []byte) ([]byte, error) {
+	var v sampledb.FileVerdict
+	err := json.Unmarshal(jsonData, &v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(MakeBundle(&v))
+}
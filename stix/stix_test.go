@@ -0,0 +1,126 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package stix
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+func testVerdict() *sampledb.FileVerdict {
+	return &sampledb.FileVerdict{
+		Suspicious:    true,
+		SuspiciousVia: []string{"YARA"},
+		Reasons: map[string]interface{}{
+			"YARA":    `{"MatchedRules":["Rule2","Rule1"]}`,
+			"Entropy": map[string]interface{}{"Entropy": 7.2},
+		},
+		SensorID: "sensor1",
+		Time:     time.Date(2025, 1, 2, 3, 4, 5, 6000000, time.UTC),
+		Size:     42,
+		Magic:    "PE32 executable",
+		Hashes:   sampledb.HashInfo{Md5: "m", Sha256: "0f3b2c"},
+		Event: &sampledb.EventInfo{
+			File: sampledb.FileEventInfo{Filename: "evil.exe"},
+		},
+	}
+}
+
+func TestObjects(t *testing.T) {
+	objects := Objects(testVerdict())
+	if len(objects) != 6 {
+		t.Fatalf("unexpected objects %v", objects)
+	}
+
+	file := objects[0].(*File)
+	// identifier computed independently according to the specification
+	if file.ID != "file--2fa77cd2-2052-5c26-9439-a5e13af31ffd" {
+		t.Fatalf("unexpected file ID %s", file.ID)
+	}
+	if file.Hashes["MD5"] != "m" || file.Hashes["SHA-256"] != "0f3b2c" || len(file.Hashes) != 2 ||
+		file.Name != "evil.exe" || file.Size != 42 {
+		t.Fatalf("unexpected file %+v", file)
+	}
+
+	entropy := objects[1].(*MalwareAnalysis)
+	yara := objects[2].(*MalwareAnalysis)
+	if entropy.Module != "Entropy" || entropy.Result != "benign" || entropy.SampleRef != file.ID {
+		t.Fatalf("unexpected analysis %+v", entropy)
+	}
+	if yara.Module != "YARA" || yara.Result != "suspicious" || yara.ResultName != "Rule1,Rule2" ||
+		yara.Created != "2025-01-02T03:04:05.006Z" || yara.SensorID != "sensor1" {
+		t.Fatalf("unexpected analysis %+v", yara)
+	}
+
+	indicator := objects[3].(*Indicator)
+	if indicator.Pattern != "[file:hashes.'SHA-256' = '0f3b2c']" || indicator.Name != "Suspicious file evil.exe" ||
+		indicator.ValidFrom != yara.Created {
+		t.Fatalf("unexpected indicator %+v", indicator)
+	}
+	indicates := objects[4].(*Relationship)
+	basedOn := objects[5].(*Relationship)
+	if indicates.RelationshipType != "indicates" || indicates.SourceRef != indicator.ID ||
+		indicates.TargetRef != file.ID {
+		t.Fatalf("unexpected relationship %+v", indicates)
+	}
+	if basedOn.RelationshipType != "based-on" || basedOn.SourceRef != indicator.ID ||
+		basedOn.TargetRef != yara.ID {
+		t.Fatalf("unexpected relationship %+v", basedOn)
+	}
+
+	// clean verdicts have no indicator
+	v := testVerdict()
+	v.Suspicious = false
+	v.SuspiciousVia = nil
+	if objects := Objects(v); len(objects) != 3 {
+		t.Fatalf("unexpected objects %v", objects)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	v1 := testVerdict()
+	v2 := testVerdict()
+	v2.SensorID = "sensor2"
+	b := MakeBundle(v1, v2)
+	// the file is shared
+	if len(b.Objects) != 11 {
+		t.Fatalf("unexpected objects %v", b.Objects)
+	}
+
+	in, err := json.Marshal(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out1, err := Convert(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out2, err := Convert(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out1) != string(out2) {
+		t.Fatalf("conversion not deterministic:\n%s\n%s", out1, out2)
+	}
+	var bundle struct {
+		Type    string
+		ID      string
+		Objects []map[string]interface{}
+	}
+	err = json.Unmarshal(out1, &bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Type != "bundle" || bundle.ID == b.ID || len(bundle.Objects) != 6 ||
+		bundle.Objects[0]["spec_version"] != "2.1" {
+		t.Fatalf("unexpected bundle %s", out1)
+	}
+
+	if _, err := Convert([]byte("no json")); err == nil {
+		t.Fatal("invalid verdict accepted")
+	}
+}
@@ -0,0 +1,503 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/NeowayLabs/wabbit"
+	wabbitamqp "github.com/NeowayLabs/wabbit/amqp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	amqpReconnMinDelay   = 1 * time.Second
+	amqpReconnMaxDelay   = 30 * time.Second
+	amqpConfirmTimeout   = 10 * time.Second
+	amqpConfirmQueueSize = 16
+	amqpBufferSize       = 1000
+	amqpPartialSize      = 1000
+)
+
+// errAMQPClosed is returned when using a submitter which has been finished.
+var errAMQPClosed = errors.New("RabbitMQ submitter closed")
+
+// ConnState is the state of the connection of an AMQPSubmitter.
+type ConnState int
+
+const (
+	// StateConnected means that messages can be published.
+	StateConnected ConnState = iota
+	// StateReconnecting means that the connection was lost and is being
+	// reestablished.
+	StateReconnecting
+	// StateClosed means that the submitter has been finished.
+	StateClosed
+)
+
+func (cs ConnState) String() string {
+	switch cs {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// SubmitPolicy determines how an AMQPSubmitter handles submissions while its
+// connection is being reestablished.
+type SubmitPolicy string
+
+const (
+	// PolicyBlock makes Submit wait until the connection is back.
+	PolicyBlock SubmitPolicy = "block"
+	// PolicyBuffer keeps up to BufferSize messages in memory, to be
+	// published once the connection is back. Submit returns immediately, so
+	// buffered messages are lost if the process terminates.
+	PolicyBuffer SubmitPolicy = "buffer"
+)
+
+// String returns the policy name.
+func (p *SubmitPolicy) String() string {
+	return string(*p)
+}
+
+// Set sets the policy from its name.
+func (p *SubmitPolicy) Set(s string) error {
+	switch SubmitPolicy(s) {
+	case PolicyBlock, PolicyBuffer:
+		*p = SubmitPolicy(s)
+		return nil
+	}
+	return fmt.Errorf("invalid submit policy: %s", s)
+}
+
+// AMQPSubmitter sends verdicts to a RabbitMQ exchange. If a verdict is sent in
+// several schema versions and only some of them are confirmed, the confirmed
+// versions are remembered in Partial, keyed by the SHA256 hash of the
+// verdict, so that they are not sent again when the verdict is submitted
+// again. Partial holds at most amqpPartialSize verdicts, the oldest are
+// forgotten first.
+type AMQPSubmitter struct {
+	URL              string
+	User             string
+	Pass             string
+	Exchange         string
+	Message          AMQPMessageOptions
+	Verbose          bool
+	Conn             wabbit.Conn
+	Channel          wabbit.Channel
+	ErrorChan        chan wabbit.Error
+	Confirms         chan wabbit.Confirmation
+	PublishTag       uint64
+	Partial          map[[sha256.Size]byte]map[int32]bool
+	PartialOrder     [][sha256.Size]byte
+	ChanMutex        sync.Mutex
+	State            ConnState
+	StateMutex       sync.Mutex
+	StateCond        *sync.Cond
+	Policy           SubmitPolicy
+	BufferSize       int
+	Buffer           [][]byte
+	MinDelay         time.Duration
+	MaxDelay         time.Duration
+	StopReconnection chan bool
+	StoppedChan      chan bool
+	Reconnector      func(string) (wabbit.Conn, string, error)
+}
+
+// connect establishes a new connection and channel, replacing the current
+// ones.
+func (s *AMQPSubmitter) connect() error {
+	conn, exchangeType, err := s.Reconnector(s.URL)
+	if err != nil {
+		return err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	// We do not want to declare an exchange on non-default connection methods,
+	// as they may not support all exchange types. For instance amqptest does
+	// not support 'fanout'.
+	err = channel.ExchangeDeclare(
+		s.Exchange,   // name
+		exchangeType, // type
+		wabbit.Option{
+			"durable":    true,
+			"autoDelete": false,
+			"internal":   false,
+			"noWait":     false,
+		},
+	)
+	if err == nil {
+		// Have the server confirm each message, so we know whether we need
+		// to send it again.
+		err = channel.Confirm(false)
+	}
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return err
+	}
+	errorChan := make(chan wabbit.Error, 1)
+	conn.NotifyClose(errorChan)
+	confirms := channel.NotifyPublish(make(chan wabbit.Confirmation, amqpConfirmQueueSize))
+
+	s.ChanMutex.Lock()
+	oldConn, oldChannel := s.Conn, s.Channel
+	s.Conn = conn
+	s.Channel = channel
+	s.ErrorChan = errorChan
+	s.Confirms = confirms
+	s.PublishTag = 0
+	s.ChanMutex.Unlock()
+
+	// release what is left of a previous connection
+	if oldChannel != nil {
+		oldChannel.Close()
+	}
+	if oldConn != nil {
+		oldConn.Close()
+	}
+	log.Debugf("Submitter established connection to %s", RedactURL(s.URL))
+
+	return nil
+}
+
+// setState switches to the given state, unless the submitter has been
+// finished already.
+func (s *AMQPSubmitter) setState(state ConnState) {
+	s.StateMutex.Lock()
+	if s.State == StateClosed {
+		s.StateMutex.Unlock()
+		return
+	}
+	s.State = state
+	s.StateCond.Broadcast()
+	s.StateMutex.Unlock()
+	log.Debugf("Submitter connection state: %s", state)
+}
+
+// backoff returns the randomized delay before the given reconnection
+// attempt, growing exponentially up to MaxDelay.
+func (s *AMQPSubmitter) backoff(attempt int) time.Duration {
+	d := s.MinDelay
+	for i := 0; i < attempt && d < s.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > s.MaxDelay {
+		d = s.MaxDelay
+	}
+	// wait between half and the full delay, so that many sensors do not
+	// reconnect at the same time
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// flush publishes all buffered messages, and marks the submitter as connected
+// once the buffer is empty. It returns errAMQPClosed if the submitter was
+// finished in the meantime.
+func (s *AMQPSubmitter) flush() error {
+	for {
+		s.StateMutex.Lock()
+		if s.State == StateClosed {
+			s.StateMutex.Unlock()
+			return errAMQPClosed
+		}
+		if len(s.Buffer) == 0 {
+			s.State = StateConnected
+			s.StateCond.Broadcast()
+			s.StateMutex.Unlock()
+			return nil
+		}
+		msg := s.Buffer[0]
+		s.StateMutex.Unlock()
+
+		err := s.publish(msg)
+		if err != nil {
+			return err
+		}
+
+		s.StateMutex.Lock()
+		// the buffer is discarded if finished while publishing
+		if len(s.Buffer) > 0 {
+			s.Buffer = s.Buffer[1:]
+		}
+		s.StateMutex.Unlock()
+	}
+}
+
+// reconnect tries to reestablish the connection until it succeeds or the
+// submitter is finished, in which case it returns false.
+func (s *AMQPSubmitter) reconnect() bool {
+	for attempt := 0; ; attempt++ {
+		delay := s.backoff(attempt)
+		select {
+		case <-time.After(delay):
+		case <-s.StopReconnection:
+			return false
+		}
+		err := s.connect()
+		if err == nil {
+			err = s.flush()
+		}
+		if err == errAMQPClosed {
+			return false
+		}
+		if err == nil {
+			log.Infof("Reestablished connection to %s", RedactURL(s.URL))
+			return true
+		}
+		log.Warnf("RabbitMQ reconnection attempt %d failed: %s", attempt+1, err)
+	}
+}
+
+// manage watches the connection and reconnects when it fails.
+func (s *AMQPSubmitter) manage() {
+	defer close(s.StoppedChan)
+	for {
+		s.ChanMutex.Lock()
+		errorChan := s.ErrorChan
+		s.ChanMutex.Unlock()
+		select {
+		case <-s.StopReconnection:
+			return
+		case rabbitErr := <-errorChan:
+			if rabbitErr != nil {
+				log.Warnf("RabbitMQ connection failed: %s", rabbitErr.Reason())
+			} else {
+				log.Warnf("RabbitMQ connection closed")
+			}
+			s.setState(StateReconnecting)
+			if !s.reconnect() {
+				return
+			}
+		}
+	}
+}
+
+// MakeAMQPSubmitterWithReconnector creates a new submitter connected to a
+// RabbitMQ server at the given URL, using the reconnector function as a means
+// to Dial() in order to obtain a Connection object.
+func MakeAMQPSubmitterWithReconnector(amqpURI string, amqpUser string,
+	amqpPass string, amqpExch string, verbose bool,
+	reconnector func(string) (wabbit.Conn, string, error)) (*AMQPSubmitter, error) {
+	return MakeAMQPSubmitterWithConfig(AMQPConfig{
+		URI:  amqpURI,
+		User: amqpUser,
+		Pass: amqpPass,
+	}, amqpExch, verbose, reconnector)
+}
+
+// MakeAMQPSubmitterWithConfig creates a new submitter connected to the
+// RabbitMQ server described by config, using the reconnector function to
+// Dial() the URL of the server. The reconnector is responsible for applying
+// the TLS and authentication settings, see AMQPConfig.DialConfig.
+func MakeAMQPSubmitterWithConfig(config AMQPConfig, amqpExch string, verbose bool,
+	reconnector func(string) (wabbit.Conn, string, error)) (*AMQPSubmitter, error) {
+
+	mySubmitter := &AMQPSubmitter{
+		URL:              config.URL(),
+		Verbose:          verbose,
+		Reconnector:      reconnector,
+		User:             config.User,
+		Pass:             config.Pass,
+		Exchange:         amqpExch,
+		Message:          DefaultAMQPMessageOptions(),
+		State:            StateConnected,
+		Policy:           PolicyBlock,
+		BufferSize:       amqpBufferSize,
+		Partial:          make(map[[sha256.Size]byte]map[int32]bool),
+		MinDelay:         amqpReconnMinDelay,
+		MaxDelay:         amqpReconnMaxDelay,
+		StopReconnection: make(chan bool),
+		StoppedChan:      make(chan bool),
+	}
+	mySubmitter.StateCond = sync.NewCond(&mySubmitter.StateMutex)
+	if verbose {
+		log.Debugf("Initial connection to %s...", RedactURL(mySubmitter.URL))
+	}
+
+	err := mySubmitter.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	go mySubmitter.manage()
+
+	return mySubmitter, nil
+}
+
+// waitConfirm waits for the server to confirm the message with the given
+// delivery tag.
+func (s *AMQPSubmitter) waitConfirm(tag uint64) error {
+	timeout := time.After(amqpConfirmTimeout)
+	for {
+		select {
+		case c, ok := <-s.Confirms:
+			if !ok {
+				return fmt.Errorf("channel closed before confirmation")
+			}
+			if c.DeliveryTag() < tag {
+				// late confirmation for a message we already gave up on
+				continue
+			}
+			if !c.Ack() {
+				return fmt.Errorf("message rejected by server")
+			}
+			return nil
+		case <-timeout:
+			return fmt.Errorf("timeout waiting for confirmation")
+		}
+	}
+}
+
+// publish sends the messages for a verdict on the current channel and waits
+// for the server to confirm each of them. Versions confirmed in an earlier
+// attempt are skipped. Verdicts which cannot be encoded are dropped, as
+// retrying would not help.
+func (s *AMQPSubmitter) publish(jsonData []byte) error {
+	key, msgs, err := s.messages(jsonData)
+	if err != nil {
+		metricFormatFailed.Add(1)
+		log.Errorf("dropping verdict: %s", err)
+		return nil
+	}
+	s.ChanMutex.Lock()
+	defer s.ChanMutex.Unlock()
+	digest := sha256.Sum256(jsonData)
+	confirmed := s.Partial[digest]
+	for _, msg := range msgs {
+		version, _ := msg.Headers["schema_version"].(int32)
+		if confirmed[version] {
+			continue
+		}
+		if ch, ok := s.Channel.(*wabbitamqp.Channel); ok {
+			// wabbit options do not cover all message properties, such as the
+			// expiration, so use the underlying channel directly
+			err = ch.Channel.Publish(s.Exchange, key, false, false, msg)
+		} else {
+			err = s.Channel.Publish(s.Exchange, key, msg.Body, wabbit.Option{
+				"contentType":  msg.ContentType,
+				"deliveryMode": msg.DeliveryMode,
+				"priority":     msg.Priority,
+				"headers":      msg.Headers,
+			})
+		}
+		if err == nil {
+			s.PublishTag++
+			err = s.waitConfirm(s.PublishTag)
+		}
+		if err != nil {
+			if len(confirmed) > 0 {
+				s.rememberPartial(digest, confirmed)
+			}
+			return err
+		}
+		if len(msgs) > 1 {
+			if confirmed == nil {
+				confirmed = make(map[int32]bool)
+			}
+			confirmed[version] = true
+		}
+	}
+	delete(s.Partial, digest)
+	return nil
+}
+
+// rememberPartial records the confirmed versions of a verdict, forgetting
+// the oldest verdicts if there are too many.
+func (s *AMQPSubmitter) rememberPartial(digest [sha256.Size]byte, confirmed map[int32]bool) {
+	if s.Partial == nil {
+		s.Partial = make(map[[sha256.Size]byte]map[int32]bool)
+	}
+	if _, ok := s.Partial[digest]; !ok {
+		s.PartialOrder = append(s.PartialOrder, digest)
+	}
+	s.Partial[digest] = confirmed
+	for len(s.PartialOrder) > amqpPartialSize {
+		delete(s.Partial, s.PartialOrder[0])
+		s.PartialOrder = s.PartialOrder[1:]
+	}
+}
+
+// Submit sends the jsonData payload via the registered RabbitMQ connection
+// and waits for the server to confirm it. While the connection is being
+// reestablished, the message is handled according to the submit policy.
+func (s *AMQPSubmitter) Submit(jsonData []byte) error {
+	s.StateMutex.Lock()
+	for s.State == StateReconnecting {
+		if s.Policy == PolicyBuffer {
+			defer s.StateMutex.Unlock()
+			if len(s.Buffer) >= s.BufferSize {
+				return fmt.Errorf("RabbitMQ submission buffer full (%d messages)", len(s.Buffer))
+			}
+			msg := make([]byte, len(jsonData))
+			copy(msg, jsonData)
+			s.Buffer = append(s.Buffer, msg)
+			if s.Verbose {
+				log.Debugf("RabbitMQ submission buffered (%d messages)", len(s.Buffer))
+			}
+			return nil
+		}
+		s.StateCond.Wait()
+	}
+	state := s.State
+	s.StateMutex.Unlock()
+	if state == StateClosed {
+		return errAMQPClosed
+	}
+
+	err := s.publish(jsonData)
+	if err == nil {
+		if s.Verbose {
+			log.Debugf("RabbitMQ submission (%s) successful", RedactURL(s.URL))
+		}
+	} else {
+		log.Warnf("RabbitMQ submission not successful: %s", err.Error())
+	}
+	return err
+}
+
+// ConnectionState returns the current state of the connection.
+func (s *AMQPSubmitter) ConnectionState() ConnState {
+	s.StateMutex.Lock()
+	defer s.StateMutex.Unlock()
+	return s.State
+}
+
+// Finish cleans up the RMQ connection.
+func (s *AMQPSubmitter) Finish() {
+	s.StateMutex.Lock()
+	if s.State == StateClosed {
+		s.StateMutex.Unlock()
+		return
+	}
+	if len(s.Buffer) > 0 {
+		log.Warnf("Submitter discarding %d buffered messages", len(s.Buffer))
+		s.Buffer = nil
+	}
+	s.State = StateClosed
+	s.StateCond.Broadcast()
+	s.StateMutex.Unlock()
+
+	close(s.StopReconnection)
+	<-s.StoppedChan
+	if s.Verbose {
+		log.Debugf("Submitter closing connection...")
+	}
+	s.ChanMutex.Lock()
+	s.Channel.Close()
+	s.Conn.Close()
+	s.ChanMutex.Unlock()
+}
@@ -0,0 +1,94 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DCSO/nightwatch/util"
+
+	origamqp "github.com/rabbitmq/amqp091-go"
+)
+
+// AMQPConfig describes the RabbitMQ endpoint and how to authenticate to it.
+type AMQPConfig struct {
+	// URI is the host and port of the server, optionally followed by the
+	// virtual host as path.
+	URI string
+	// VHost is the virtual host to use, overriding the one given in URI.
+	VHost string
+	User  string
+	Pass  string
+	// TLS enables amqps. CAFile is a PEM bundle of the certificates used to
+	// verify the server instead of the system ones, and ServerName the name
+	// expected in the server certificate if it differs from the host.
+	TLS        bool
+	CAFile     string
+	ServerName string
+	// CertFile and KeyFile contain the PEM encoded client certificate and
+	// key presented to the server.
+	CertFile string
+	KeyFile  string
+	// External selects SASL EXTERNAL, authenticating with the client
+	// certificate instead of user and password.
+	External bool
+}
+
+// URL returns the AMQP URL for the configured endpoint.
+func (c *AMQPConfig) URL() string {
+	scheme := "amqp"
+	if c.TLS {
+		scheme = "amqps"
+	}
+	userInfo := ""
+	if !c.External {
+		userInfo = url.UserPassword(c.User, c.Pass).String() + "@"
+	}
+	u := scheme + "://" + userInfo + c.URI + "/"
+	if len(c.VHost) > 0 {
+		u = scheme + "://" + userInfo + strings.SplitN(c.URI, "/", 2)[0] + "/" +
+			url.PathEscape(c.VHost)
+	}
+	return u
+}
+
+// TLSConfig returns the TLS client configuration, or nil if TLS is not
+// enabled.
+func (c *AMQPConfig) TLSConfig() (*tls.Config, error) {
+	return util.LoadTLSConfig(c.TLS, c.CAFile, c.ServerName, c.CertFile, c.KeyFile)
+}
+
+// DialConfig returns the connection configuration to be passed to
+// amqp.DialConfig together with the URL.
+func (c *AMQPConfig) DialConfig() (origamqp.Config, error) {
+	cfg := origamqp.Config{
+		Heartbeat: 10 * time.Second,
+		Locale:    "en_US",
+	}
+	var err error
+	cfg.TLSClientConfig, err = c.TLSConfig()
+	if err != nil {
+		return cfg, err
+	}
+	if c.External {
+		if cfg.TLSClientConfig == nil || len(cfg.TLSClientConfig.Certificates) == 0 {
+			return cfg, fmt.Errorf("SASL EXTERNAL needs TLS with a client certificate")
+		}
+		cfg.SASL = []origamqp.Authentication{&origamqp.ExternalAuth{}}
+	}
+	return cfg, nil
+}
+
+// RedactURL returns the URL with the password replaced, for logging.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,201 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	origamqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRoutingKey is the routing key used if no other one is configured.
+const DefaultRoutingKey = "nightwatch"
+
+var routingKeyFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	// first returns the first element of a list, or an empty string
+	"first": func(v interface{}) string {
+		if l, ok := v.([]interface{}); ok && len(l) > 0 {
+			return fmt.Sprint(l[0])
+		}
+		return ""
+	},
+	"join": joinList,
+}
+
+// joinList concatenates the elements of a list using the given separator.
+func joinList(v interface{}, sep string) string {
+	l, _ := v.([]interface{})
+	s := make([]string, len(l))
+	for i, e := range l {
+		s[i] = fmt.Sprint(e)
+	}
+	return strings.Join(s, sep)
+}
+
+// ParseRoutingKey parses a routing key template. The template is executed on
+// the submitted verdict, so for instance
+//
+//	nightwatch.{{if .Suspicious}}suspicious.{{first .SuspiciousVia | lower}}{{else}}clean{{end}}
+//
+// routes verdicts by the plugin which found the file suspicious. The
+// functions lower, upper, first and join are available.
+func ParseRoutingKey(text string) (*template.Template, error) {
+	return template.New("routingkey").Funcs(routingKeyFuncs).Parse(text)
+}
+
+// AMQPMessageOptions determines the routing key, headers and properties of
+// the messages published by an AMQPSubmitter.
+type AMQPMessageOptions struct {
+	// RoutingKey is executed on each verdict to obtain its routing key.
+	RoutingKey *template.Template
+	// Persistent makes the broker write messages to disk.
+	Persistent bool
+	// TTL is the time after which undelivered messages are discarded by the
+	// broker, if non-zero.
+	TTL time.Duration
+	// SuspiciousPriority is the priority of suspicious verdicts. Other
+	// messages have priority 0.
+	SuspiciousPriority uint8
+	// Headers are added to each message, besides the sensor ID.
+	Headers map[string]string
+	// Schemas are the schema versions each verdict is published in, as one
+	// message per version. If empty, only SchemaLegacy is published.
+	Schemas []int
+	// Encoding is the serialization of the messages, JSON if empty.
+	Encoding Encoding
+	// OmitMetadata leaves out the meta file and fileinfo event, and
+	// OmitStrings the strings matched by YARA rules, in schema version 2.
+	OmitMetadata bool
+	OmitStrings  bool
+}
+
+// DefaultAMQPMessageOptions returns the message options used if no other ones
+// are configured, publishing transient messages with routing key
+// DefaultRoutingKey.
+func DefaultAMQPMessageOptions() AMQPMessageOptions {
+	return AMQPMessageOptions{
+		RoutingKey: template.Must(ParseRoutingKey(DefaultRoutingKey)),
+	}
+}
+
+// AMQPHeaders is a set of static message headers which can be given on the
+// command line, repeating the flag for each key=value pair.
+type AMQPHeaders map[string]string
+
+// String returns the headers as a comma separated list of key=value pairs.
+func (h *AMQPHeaders) String() string {
+	if h == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*h))
+	for k, v := range *h {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set adds a header given as key=value.
+func (h *AMQPHeaders) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || len(k) == 0 {
+		return fmt.Errorf("invalid header, need key=value: %s", s)
+	}
+	if k == "sensor_id" || k == "schema_version" {
+		return fmt.Errorf("header %s is reserved", k)
+	}
+	if *h == nil {
+		*h = make(AMQPHeaders)
+	}
+	(*h)[k] = v
+	return nil
+}
+
+// message builds the routing key and message to publish for the given
+// payload.
+func (s *AMQPSubmitter) message(jsonData []byte) (string, origamqp.Publishing) {
+	msg := origamqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: origamqp.Transient,
+		Headers:      origamqp.Table{},
+		Body:         jsonData,
+	}
+	for k, v := range s.Message.Headers {
+		msg.Headers[k] = v
+	}
+	msg.Headers["sensor_id"] = SensorID
+	if s.Message.Persistent {
+		msg.DeliveryMode = origamqp.Persistent
+	}
+	if s.Message.TTL > 0 {
+		msg.Expiration = strconv.FormatInt(s.Message.TTL.Milliseconds(), 10)
+	}
+
+	// payloads which are not JSON objects, such as those of tests, are
+	// handled like empty verdicts
+	verdict := make(map[string]interface{})
+	json.Unmarshal(jsonData, &verdict)
+	// expose the verdict in the headers as well, for headers exchanges
+	if suspicious, ok := verdict["Suspicious"].(bool); ok {
+		msg.Headers["suspicious"] = suspicious
+		if suspicious {
+			msg.Priority = s.Message.SuspiciousPriority
+			msg.Headers["suspicious_via"] = joinList(verdict["SuspiciousVia"], ",")
+		}
+	}
+
+	key := DefaultRoutingKey
+	if s.Message.RoutingKey != nil {
+		var buf bytes.Buffer
+		err := s.Message.RoutingKey.Execute(&buf, verdict)
+		if err == nil {
+			key = buf.String()
+		} else {
+			log.Warnf("could not build routing key, using %s: %s", key, err)
+		}
+	}
+	return key, msg
+}
+
+// messages builds the routing key and the messages to publish for the given
+// payload, one for each configured schema version. Each message has the
+// schema_version header and the content type of its encoding.
+func (s *AMQPSubmitter) messages(jsonData []byte) (string, []origamqp.Publishing, error) {
+	key, msg := s.message(jsonData)
+	schemas := s.Message.Schemas
+	if len(schemas) == 0 {
+		schemas = []int{SchemaLegacy}
+	}
+	enc := s.Message.Encoding
+	if enc == "" {
+		enc = EncodingJSON
+	}
+	msgs := make([]origamqp.Publishing, 0, len(schemas))
+	for _, version := range schemas {
+		body, err := EncodeVerdict(jsonData, version, enc, s.Message.OmitMetadata, s.Message.OmitStrings)
+		if err != nil {
+			return key, nil, fmt.Errorf("could not encode verdict in schema version %d: %w", version, err)
+		}
+		m := msg
+		m.Headers = make(origamqp.Table, len(msg.Headers)+1)
+		for k, v := range msg.Headers {
+			m.Headers[k] = v
+		}
+		m.Headers["schema_version"] = int32(version)
+		m.ContentType = enc.ContentType()
+		m.Body = body
+		msgs = append(msgs, m)
+	}
+	return key, msgs, nil
+}
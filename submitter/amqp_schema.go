@@ -0,0 +1,322 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Message schema versions. Each message carries its version in the
+// schema_version header, so consumers can bind to the version they
+// understand, e.g. with a headers exchange.
+const (
+	// SchemaLegacy is the verdict as marshalled by Nightwatch itself, with
+	// Go field names.
+	SchemaLegacy = 1
+	// SchemaV2 is the documented VerdictV2 structure with snake_case
+	// field names.
+	SchemaV2 = 2
+)
+
+// Encoding is the serialization of published messages.
+type Encoding string
+
+// Supported message encodings.
+const (
+	EncodingJSON    Encoding = "json"
+	EncodingCBOR    Encoding = "cbor"
+	EncodingMsgPack Encoding = "msgpack"
+)
+
+// String returns the name of the encoding.
+func (e *Encoding) String() string {
+	if e == nil || *e == "" {
+		return string(EncodingJSON)
+	}
+	return string(*e)
+}
+
+// Set parses the name of an encoding.
+func (e *Encoding) Set(s string) error {
+	switch Encoding(s) {
+	case EncodingJSON, EncodingCBOR, EncodingMsgPack:
+		*e = Encoding(s)
+		return nil
+	}
+	return fmt.Errorf("invalid encoding: %s", s)
+}
+
+// ContentType returns the MIME type of messages with this encoding.
+func (e Encoding) ContentType() string {
+	switch e {
+	case EncodingCBOR:
+		return "application/cbor"
+	case EncodingMsgPack:
+		return "application/msgpack"
+	}
+	return "application/json"
+}
+
+// ParseSchemaVersions parses a comma separated list of schema versions.
+func ParseSchemaVersions(s string) ([]int, error) {
+	var versions []int
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || v < SchemaLegacy || v > SchemaV2 {
+			return nil, fmt.Errorf("invalid schema version: %s", f)
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// VerdictV2 is the verdict in message schema version 2.
+type VerdictV2 struct {
+	// SchemaVersion is always 2.
+	SchemaVersion int      `json:"schema_version"`
+	Suspicious    bool     `json:"suspicious"`
+	SuspiciousVia []string `json:"suspicious_via,omitempty"`
+	// Reasons contains the output of each plugin, keyed by plugin name, as
+	// object. The fields of these objects are defined by the plugins; the
+	// YARA plugin reports MatchedRules and, unless left out, RuleDetails
+	// with the matched strings per rule.
+	Reasons        map[string]interface{} `json:"reasons,omitempty"`
+	SensorID       string                 `json:"sensor_id"`
+	Time           time.Time              `json:"time"`
+	CollectionTime time.Time              `json:"collection_time"`
+	Filename       string                 `json:"filename"`
+	Size           int64                  `json:"size"`
+	Magic          string                 `json:"magic,omitempty"`
+	Hashes         HashesV2               `json:"hashes"`
+	// MetaFile is the raw Suricata meta file, and Metadata the fileinfo
+	// event as logged by Suricata, unless left out.
+	MetaFile        []byte      `json:"meta_file,omitempty"`
+	Metadata        interface{} `json:"metadata,omitempty"`
+	Uploaded        bool        `json:"uploaded"`
+	UploadLocation  string      `json:"upload_location,omitempty"`
+	UploadWrapping  string      `json:"upload_wrapping,omitempty"`
+	Event           *EventV2    `json:"event,omitempty"`
+	Truncated       bool        `json:"truncated"`
+	TruncatedReason string      `json:"truncated_reason,omitempty"`
+}
+
+// HashesV2 contains the hashes of the file in schema version 2.
+type HashesV2 struct {
+	MD5     string `json:"md5"`
+	SHA1    string `json:"sha1"`
+	SHA256  string `json:"sha256"`
+	SHA512  string `json:"sha512"`
+	SHA3512 string `json:"sha3_512"`
+}
+
+// EventV2 describes how the file was observed in schema version 2.
+type EventV2 struct {
+	Timestamp string      `json:"timestamp,omitempty"`
+	FlowID    uint64      `json:"flow_id,omitempty"`
+	SrcIP     string      `json:"src_ip,omitempty"`
+	SrcPort   int         `json:"src_port,omitempty"`
+	DestIP    string      `json:"dest_ip,omitempty"`
+	DestPort  int         `json:"dest_port,omitempty"`
+	Proto     string      `json:"proto,omitempty"`
+	AppProto  string      `json:"app_proto,omitempty"`
+	TxID      int         `json:"tx_id"`
+	HTTP      *HTTPV2     `json:"http,omitempty"`
+	SMTP      *SMTPV2     `json:"smtp,omitempty"`
+	Email     *EmailV2    `json:"email,omitempty"`
+	File      FileEventV2 `json:"file"`
+}
+
+// HTTPV2 is the HTTP transaction a file was transferred in.
+type HTTPV2 struct {
+	Hostname    string `json:"hostname,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Method      string `json:"method,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Status      int    `json:"status,omitempty"`
+}
+
+// SMTPV2 is the SMTP transaction a file was transferred in.
+type SMTPV2 struct {
+	Helo     string   `json:"helo,omitempty"`
+	MailFrom string   `json:"mail_from,omitempty"`
+	RcptTo   []string `json:"rcpt_to,omitempty"`
+}
+
+// EmailV2 is the email a file was attached to.
+type EmailV2 struct {
+	From    string   `json:"from,omitempty"`
+	To      []string `json:"to,omitempty"`
+	Cc      []string `json:"cc,omitempty"`
+	Subject string   `json:"subject,omitempty"`
+}
+
+// FileEventV2 is the file-specific part of the fileinfo event.
+type FileEventV2 struct {
+	Filename string `json:"filename,omitempty"`
+	FileID   uint64 `json:"file_id,omitempty"`
+	Stored   bool   `json:"stored"`
+	Magic    string `json:"magic,omitempty"`
+	State    string `json:"state,omitempty"`
+	Gaps     bool   `json:"gaps"`
+	Size     int64  `json:"size"`
+	Md5      string `json:"md5,omitempty"`
+	Sha1     string `json:"sha1,omitempty"`
+	Sha256   string `json:"sha256,omitempty"`
+}
+
+// MakeVerdictV2 converts a verdict to schema version 2. With omitMetadata,
+// the raw meta file and fileinfo event are left out, and with
+// omitStrings the strings matched by YARA rules.
+func MakeVerdictV2(v *sampledb.FileVerdict, omitMetadata, omitStrings bool) *VerdictV2 {
+	out := &VerdictV2{
+		SchemaVersion:  SchemaV2,
+		Suspicious:     v.Suspicious,
+		SuspiciousVia:  v.SuspiciousVia,
+		SensorID:       v.SensorID,
+		Time:           v.Time,
+		CollectionTime: v.CollectionTime,
+		Filename:       v.Filename,
+		Size:           v.Size,
+		Magic:          v.Magic,
+		Hashes: HashesV2{
+			MD5:     v.Hashes.Md5,
+			SHA1:    v.Hashes.Sha1,
+			SHA256:  v.Hashes.Sha256,
+			SHA512:  v.Hashes.Sha512,
+			SHA3512: v.Hashes.Sha3_512,
+		},
+		Uploaded:        v.Uploaded,
+		UploadLocation:  v.UploadLocation,
+		UploadWrapping:  v.UploadWrapping,
+		Truncated:       v.Truncated,
+		TruncatedReason: v.TruncatedReason,
+	}
+	if !omitMetadata {
+		out.MetaFile = v.MetaFile
+		out.Metadata = v.Metadata
+	}
+	if len(v.Reasons) > 0 {
+		out.Reasons = make(map[string]interface{}, len(v.Reasons))
+		for plugin, reason := range v.Reasons {
+			out.Reasons[plugin] = reasonV2(reason, omitStrings)
+		}
+	}
+	if e := v.Event; e != nil {
+		// the event structures only differ in their field names
+		out.Event = &EventV2{
+			Timestamp: e.Timestamp,
+			FlowID:    e.FlowID,
+			SrcIP:     e.SrcIP,
+			SrcPort:   e.SrcPort,
+			DestIP:    e.DestIP,
+			DestPort:  e.DestPort,
+			Proto:     e.Proto,
+			AppProto:  e.AppProto,
+			TxID:      e.TxID,
+			File:      FileEventV2(e.File),
+		}
+		if e.HTTP != nil {
+			http := HTTPV2(*e.HTTP)
+			out.Event.HTTP = &http
+		}
+		if e.SMTP != nil {
+			smtp := SMTPV2(*e.SMTP)
+			out.Event.SMTP = &smtp
+		}
+		if e.Email != nil {
+			email := EmailV2(*e.Email)
+			out.Event.Email = &email
+		}
+	}
+	return out
+}
+
+// reasonV2 returns the output of a plugin as object, decoding outputs given
+// as JSON string. With omitStrings, the RuleDetails of YARA results are
+// removed.
+func reasonV2(reason interface{}, omitStrings bool) interface{} {
+	var obj map[string]interface{}
+	switch r := reason.(type) {
+	case string:
+		if json.Unmarshal([]byte(r), &obj) != nil {
+			return r
+		}
+	case map[string]interface{}:
+		obj = r
+	default:
+		return reason
+	}
+	if omitStrings {
+		if _, ok := obj["RuleDetails"]; ok {
+			stripped := make(map[string]interface{}, len(obj))
+			for k, v := range obj {
+				if k != "RuleDetails" {
+					stripped[k] = v
+				}
+			}
+			obj = stripped
+		}
+	}
+	return obj
+}
+
+var cborEncoding, _ = cbor.EncOptions{
+	Time: cbor.TimeRFC3339Nano,
+	Sort: cbor.SortCanonical,
+}.EncMode()
+
+// encode serializes v with the given encoding. Struct fields are named
+// according to their JSON tags with all encodings.
+func encode(v interface{}, enc Encoding) ([]byte, error) {
+	switch enc {
+	case EncodingCBOR:
+		return cborEncoding.Marshal(v)
+	case EncodingMsgPack:
+		var buf bytes.Buffer
+		e := msgpack.NewEncoder(&buf)
+		e.SetCustomStructTag("json")
+		e.SetSortMapKeys(true)
+		if err := e.Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return json.Marshal(v)
+}
+
+// EncodeVerdict returns the verdict given as JSON in the given schema
+// version and encoding. Legacy JSON verdicts are returned unchanged, and the
+// omit options only apply to version 2.
+func EncodeVerdict(jsonData []byte, version int, enc Encoding, omitMetadata, omitStrings bool) ([]byte, error) {
+	switch version {
+	case SchemaLegacy:
+		if enc == EncodingJSON || enc == "" {
+			return jsonData, nil
+		}
+		var v interface{}
+		err := json.Unmarshal(jsonData, &v)
+		if err != nil {
+			return nil, err
+		}
+		return encode(v, enc)
+	case SchemaV2:
+		var v sampledb.FileVerdict
+		err := json.Unmarshal(jsonData, &v)
+		if err != nil {
+			return nil, err
+		}
+		return encode(MakeVerdictV2(&v, omitMetadata, omitStrings), enc)
+	}
+	return nil, fmt.Errorf("unknown schema version %d", version)
+}
@@ -0,0 +1,328 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const fileSyncInterval = 1 * time.Second
+
+// SyncPolicy determines when a FileSubmitter flushes written verdicts to disk.
+type SyncPolicy string
+
+const (
+	// SyncAlways syncs the file after each verdict.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval syncs the file every SyncInterval if verdicts were
+	// written.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves it to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+// String returns the policy name.
+func (p *SyncPolicy) String() string {
+	return string(*p)
+}
+
+// Set sets the policy from its name.
+func (p *SyncPolicy) Set(s string) error {
+	switch SyncPolicy(s) {
+	case SyncAlways, SyncInterval, SyncNever:
+		*p = SyncPolicy(s)
+		return nil
+	}
+	return fmt.Errorf("invalid sync policy: %s", s)
+}
+
+// FileSubmitter is a Submitter writing one verdict per line to a file. The
+// file is rotated once it exceeds MaxSize bytes or is older than MaxAge, if
+// these are set, by renaming it with the time of rotation appended. Rotated
+// files are compressed with gzip if Compress is set, and only the newest Keep
+// ones are kept unless Keep is zero.
+type FileSubmitter struct {
+	Path         string
+	MaxSize      int64
+	MaxAge       time.Duration
+	Keep         int
+	Compress     bool
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	File         *os.File
+	Size         int64
+	Opened       time.Time
+	LastRotation time.Time
+	Dirty        bool
+	Lock         sync.Mutex
+	RotateLock   sync.Mutex
+	Rotations    sync.WaitGroup
+	Running      bool
+	Finished     bool
+	StopChan     chan bool
+	StoppedChan  chan bool
+}
+
+// MakeFileSubmitter returns a new FileSubmitter appending to the file at the
+// given path.
+func MakeFileSubmitter(path string) (*FileSubmitter, error) {
+	s := &FileSubmitter{
+		Path:         path,
+		Sync:         SyncInterval,
+		SyncInterval: fileSyncInterval,
+		StopChan:     make(chan bool),
+		StoppedChan:  make(chan bool),
+	}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSubmitter) open() error {
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.File = f
+	s.Size = fi.Size()
+	s.Opened = time.Now()
+	return nil
+}
+
+// rotate renames the current file and opens a new one. The rotated file is
+// compressed and old files are removed in the background.
+func (s *FileSubmitter) rotate() error {
+	if s.Sync != SyncNever {
+		s.File.Sync()
+	}
+	err := s.File.Close()
+	s.File = nil
+	if err != nil {
+		return err
+	}
+	// rotated files must not overwrite each other
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if !now.After(s.LastRotation) {
+		now = s.LastRotation.Add(time.Microsecond)
+	}
+	s.LastRotation = now
+	rotated := s.Path + "." + now.Format("20060102T150405.000000")
+	err = os.Rename(s.Path, rotated)
+	if err != nil {
+		// keep writing to the current file rather than losing verdicts
+		if openErr := s.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	log.Infof("rotated verdict file to %s", rotated)
+	s.Dirty = false
+	s.Rotations.Add(1)
+	go func() {
+		defer s.Rotations.Done()
+		s.RotateLock.Lock()
+		defer s.RotateLock.Unlock()
+		if s.Compress {
+			if err := compressFile(rotated); err != nil {
+				log.Errorf("could not compress %s: %s", rotated, err)
+			}
+		}
+		s.prune()
+	}()
+	return s.open()
+}
+
+// compressFile replaces a file with a gzip compressed version.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// prune removes the oldest rotated files exceeding Keep.
+func (s *FileSubmitter) prune() {
+	if s.Keep <= 0 {
+		return
+	}
+	files, err := filepath.Glob(s.Path + ".*")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	rotated := files[:0]
+	for _, f := range files {
+		if filepath.Ext(f) != ".tmp" {
+			rotated = append(rotated, f)
+		}
+	}
+	// names end in the time of rotation, so they sort by age
+	sort.Strings(rotated)
+	for len(rotated) > s.Keep {
+		err = os.Remove(rotated[0])
+		if err != nil {
+			log.Errorf("could not remove rotated verdict file: %s", err)
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// reopen opens the file again if that failed after the last rotation.
+func (s *FileSubmitter) reopen() error {
+	if s.File != nil || s.Finished {
+		return nil
+	}
+	return s.open()
+}
+
+func (s *FileSubmitter) needsRotation(n int64) bool {
+	if s.Size == 0 {
+		return false
+	}
+	return (s.MaxSize > 0 && s.Size+n > s.MaxSize) ||
+		(s.MaxAge > 0 && time.Since(s.Opened) >= s.MaxAge)
+}
+
+// Run starts the background task syncing the file with the interval sync
+// policy and rotating it once it gets older than MaxAge.
+func (s *FileSubmitter) Run() {
+	s.Running = true
+	go func() {
+		defer close(s.StoppedChan)
+		ticker := time.NewTicker(s.SyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Lock.Lock()
+				if err := s.reopen(); err != nil {
+					log.Errorf("could not open verdict file: %s", err)
+				} else if s.File != nil {
+					if s.needsRotation(0) {
+						if err := s.rotate(); err != nil {
+							log.Errorf("could not rotate verdict file: %s", err)
+						}
+					} else if s.Dirty && s.Sync == SyncInterval {
+						if err := s.File.Sync(); err != nil {
+							log.Errorf("could not sync verdict file: %s", err)
+						}
+						s.Dirty = false
+					}
+				}
+				s.Lock.Unlock()
+			case <-s.StopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Submit appends the jsonData payload as a line to the file.
+func (s *FileSubmitter) Submit(jsonData []byte) error {
+	line := jsonData
+	if bytes.ContainsAny(jsonData, "\r\n") {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, jsonData); err != nil {
+			return err
+		}
+		line = buf.Bytes()
+	}
+	line = append(line[:len(line):len(line)], '\n')
+
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.Finished {
+		return fmt.Errorf("verdict file closed")
+	}
+	if err := s.reopen(); err != nil {
+		return err
+	}
+	if s.needsRotation(int64(len(line))) {
+		err := s.rotate()
+		if err != nil {
+			log.Errorf("could not rotate verdict file: %s", err)
+			if s.File == nil {
+				return err
+			}
+		}
+	}
+	n, err := s.File.Write(line)
+	s.Size += int64(n)
+	if err != nil {
+		return err
+	}
+	if s.Sync == SyncAlways {
+		return s.File.Sync()
+	}
+	s.Dirty = true
+	return nil
+}
+
+// Finish stops the background task, syncs and closes the file and waits for
+// the compression of rotated files.
+func (s *FileSubmitter) Finish() {
+	s.Lock.Lock()
+	if s.Finished {
+		s.Lock.Unlock()
+		return
+	}
+	s.Finished = true
+	close(s.StopChan)
+	if s.File != nil {
+		if s.Sync != SyncNever {
+			s.File.Sync()
+		}
+		s.File.Close()
+		s.File = nil
+	}
+	s.Lock.Unlock()
+
+	if s.Running {
+		<-s.StoppedChan
+	}
+	s.Rotations.Wait()
+}
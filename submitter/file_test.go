@@ -0,0 +1,166 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readLines returns the lines of a file, decompressing it if needed.
+func readLines(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestFileSubmitter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verdicts.jsonl")
+	s, err := MakeFileSubmitter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Sync = SyncAlways
+	for _, msg := range []string{`{"N":1}`, "{\n  \"N\": 2\n}", `{"N":3}`} {
+		err = s.Submit([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Finish()
+	if s.Submit([]byte(`{}`)) == nil {
+		t.Fatal("submission to finished submitter succeeded")
+	}
+
+	// verdicts are appended after a restart
+	s, err = MakeFileSubmitter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Submit([]byte(`{"N":4}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Finish()
+
+	lines := readLines(t, path)
+	if strings.Join(lines, ",") != `{"N":1},{"N":2},{"N":3},{"N":4}` {
+		t.Fatalf("unexpected lines %v", lines)
+	}
+}
+
+func TestFileSubmitterRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "verdicts.jsonl")
+	s, err := MakeFileSubmitter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two lines per file
+	s.MaxSize = 20
+	s.Keep = 2
+	s.Compress = true
+	for i := 0; i < 9; i++ {
+		err = s.Submit([]byte(fmt.Sprintf(`{"N":%d}`, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Finish()
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("unexpected rotated files %v", rotated)
+	}
+	var lines []string
+	for _, f := range append(rotated, path) {
+		if f != path && !strings.HasSuffix(f, ".gz") {
+			t.Fatalf("rotated file %s not compressed", f)
+		}
+		for _, line := range readLines(t, f) {
+			var v map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &v); err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, line)
+		}
+	}
+	// the oldest files were removed
+	if strings.Join(lines, ",") != `{"N":4},{"N":5},{"N":6},{"N":7},{"N":8}` {
+		t.Fatalf("unexpected lines %v", lines)
+	}
+}
+
+func TestFileSubmitterMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verdicts.jsonl")
+	s, err := MakeFileSubmitter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxAge = 50 * time.Millisecond
+	s.SyncInterval = 10 * time.Millisecond
+	s.Run()
+	defer s.Finish()
+	err = s.Submit([]byte(`{"N":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is rotated without further submissions
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rotated, err := filepath.Glob(path + ".*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rotated) == 1 {
+			if lines := readLines(t, rotated[0]); len(lines) != 1 || lines[0] != `{"N":1}` {
+				t.Fatalf("unexpected lines %v", lines)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for rotation")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var p SyncPolicy
+	if p.Set("sometimes") == nil {
+		t.Fatal("invalid sync policy accepted")
+	}
+	if p.Set("never") != nil || p != SyncNever {
+		t.Fatal("valid sync policy not accepted")
+	}
+}
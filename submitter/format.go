@@ -0,0 +1,74 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"expvar"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metricFormatFailed counts verdicts which could not be converted by a
+// FormatSubmitter.
+var metricFormatFailed = expvar.NewInt("format_failed")
+
+// Format converts a verdict encoded as JSON into another representation.
+type Format func(jsonData []byte) ([]byte, error)
+
+// FormatSubmitter is a Submitter converting verdicts with Format before
+// passing them on to another Submitter.
+type FormatSubmitter struct {
+	Submitter Submitter
+	Format    Format
+}
+
+// MakeFormatSubmitter returns a new FormatSubmitter passing verdicts
+// converted with f on to s.
+func MakeFormatSubmitter(s Submitter, f Format) *FormatSubmitter {
+	return &FormatSubmitter{
+		Submitter: s,
+		Format:    f,
+	}
+}
+
+// Submit converts the jsonData payload and submits the result. Verdicts
+// which cannot be converted are dropped, as retrying would not help.
+func (s *FormatSubmitter) Submit(jsonData []byte) error {
+	out, err := s.Format(jsonData)
+	if err != nil {
+		metricFormatFailed.Add(1)
+		log.Errorf("dropping verdict which could not be converted: %s", err)
+		return nil
+	}
+	return s.Submitter.Submit(out)
+}
+
+// SubmitBatch converts all messages of batch and submits the results at
+// once, dropping those which cannot be converted.
+func (s *FormatSubmitter) SubmitBatch(batch [][]byte) error {
+	out := make([][]byte, 0, len(batch))
+	for _, jsonData := range batch {
+		converted, err := s.Format(jsonData)
+		if err != nil {
+			metricFormatFailed.Add(1)
+			log.Errorf("dropping verdict which could not be converted: %s", err)
+			continue
+		}
+		out = append(out, converted)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return submitBatch(s.Submitter, out)
+}
+
+// MaxBatchSize returns the batch size of the wrapped Submitter.
+func (s *FormatSubmitter) MaxBatchSize() int {
+	return maxBatchSize(s.Submitter)
+}
+
+// Finish finishes the wrapped Submitter.
+func (s *FormatSubmitter) Finish() {
+	s.Submitter.Finish()
+}
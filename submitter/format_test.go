@@ -0,0 +1,38 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestFormatSubmitter(t *testing.T) {
+	fs := &flakySubmitter{Failures: 1}
+	s := MakeFormatSubmitter(fs, func(jsonData []byte) ([]byte, error) {
+		if !bytes.HasPrefix(jsonData, []byte("{")) {
+			return nil, fmt.Errorf("not an object")
+		}
+		return bytes.ToUpper(jsonData), nil
+	})
+
+	// failures of the wrapped submitter are passed on
+	if s.Submit([]byte(`{"a":1}`)) == nil {
+		t.Fatal("failed submission not reported")
+	}
+	err := s.Submit([]byte(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// verdicts which cannot be converted are dropped
+	err = s.Submit([]byte(`[]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Finish()
+	if len(fs.Received) != 1 || fs.Received[0] != `{"A":1}` || !fs.Finished {
+		t.Fatalf("unexpected submissions %v", fs.Received)
+	}
+}
@@ -0,0 +1,278 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DCSO/nightwatch/util"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	kafkaTimeout   = 10 * time.Second
+	kafkaBatchSize = 100
+)
+
+var (
+	// metricKafkaProduced counts verdicts written to Kafka.
+	metricKafkaProduced = expvar.NewInt("kafka_produced")
+	// metricKafkaFailed counts verdicts which could not be written to Kafka,
+	// to be submitted again later.
+	metricKafkaFailed = expvar.NewInt("kafka_failed")
+)
+
+// KafkaWriter writes messages to Kafka. It is implemented by *kafka.Writer
+// and can be replaced for testing.
+type KafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaConfig describes the Kafka cluster and topic verdicts are produced to.
+type KafkaConfig struct {
+	Brokers  []string
+	Topic    string
+	ClientID string
+	// Acks is the number of acknowledgements required for a write: none,
+	// one (the leader) or all (all in-sync replicas).
+	Acks string
+	// Compression is the codec batches are compressed with: none, gzip,
+	// snappy, lz4 or zstd.
+	Compression string
+	// BatchSize and BatchBytes limit the number of verdicts and bytes
+	// written in one request.
+	BatchSize  int
+	BatchBytes int64
+	// TLS enables TLS, with the CAFile, ServerName, CertFile and KeyFile
+	// options as described for AMQPConfig.
+	TLS        bool
+	CAFile     string
+	ServerName string
+	CertFile   string
+	KeyFile    string
+	// SASL is the authentication mechanism used with User and Pass: plain,
+	// scram-sha-256 or scram-sha-512, or empty for none.
+	SASL string
+	User string
+	Pass string
+}
+
+var kafkaAcks = map[string]kafka.RequiredAcks{
+	"none": kafka.RequireNone,
+	"one":  kafka.RequireOne,
+	"all":  kafka.RequireAll,
+}
+
+var kafkaCompression = map[string]kafka.Compression{
+	"none":   0,
+	"gzip":   kafka.Gzip,
+	"snappy": kafka.Snappy,
+	"lz4":    kafka.Lz4,
+	"zstd":   kafka.Zstd,
+}
+
+// Mechanism returns the SASL mechanism, or nil if none is configured.
+func (c *KafkaConfig) Mechanism() (sasl.Mechanism, error) {
+	switch c.SASL {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: c.User, Password: c.Pass}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, c.User, c.Pass)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, c.User, c.Pass)
+	}
+	return nil, fmt.Errorf("invalid SASL mechanism: %s", c.SASL)
+}
+
+// Writer returns a writer producing to the configured topic. Messages are
+// assigned to partitions by the murmur2 hash of their key, like the Java
+// client does.
+func (c *KafkaConfig) Writer() (*kafka.Writer, error) {
+	if len(c.Brokers) == 0 {
+		return nil, fmt.Errorf("no Kafka broker given")
+	}
+	if len(c.Topic) == 0 {
+		return nil, fmt.Errorf("no Kafka topic given")
+	}
+	acks, ok := kafkaAcks[c.Acks]
+	if !ok {
+		return nil, fmt.Errorf("invalid acks: %s", c.Acks)
+	}
+	compression, ok := kafkaCompression[c.Compression]
+	if !ok {
+		return nil, fmt.Errorf("invalid compression: %s", c.Compression)
+	}
+	tc, err := util.LoadTLSConfig(c.TLS, c.CAFile, c.ServerName, c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	mechanism, err := c.Mechanism()
+	if err != nil {
+		return nil, err
+	}
+	batchSize := c.BatchSize
+	if batchSize <= 0 {
+		batchSize = kafkaBatchSize
+	}
+	return &kafka.Writer{
+		Addr:         kafka.TCP(c.Brokers...),
+		Topic:        c.Topic,
+		Balancer:     &kafka.Murmur2Balancer{Consistent: true},
+		RequiredAcks: acks,
+		Compression:  compression,
+		BatchSize:    batchSize,
+		BatchBytes:   c.BatchBytes,
+		// batches are collected by the outbox already
+		BatchTimeout: time.Millisecond,
+		WriteTimeout: kafkaTimeout,
+		Transport: &kafka.Transport{
+			ClientID: c.ClientID,
+			TLS:      tc,
+			SASL:     mechanism,
+		},
+	}, nil
+}
+
+// KafkaSubmitter is a Submitter producing verdicts to a Kafka topic, keyed by
+// the SHA256 hash of the sample so that all verdicts for a sample end up in
+// the same partition. It is a BatchSubmitter, so the outbox hands over up to
+// BatchSize verdicts to be written at once. Submit and SubmitBatch only return
+// once the write has been acknowledged as required by the writer, and return
+// an error if it failed, leaving retries to the outbox.
+type KafkaSubmitter struct {
+	Writer    KafkaWriter
+	BatchSize int
+	Lock      sync.RWMutex
+	Running   bool
+	Finished  bool
+	Writes    sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// MakeKafkaSubmitter returns a new KafkaSubmitter writing with the given
+// writer.
+func MakeKafkaSubmitter(w KafkaWriter) *KafkaSubmitter {
+	s := &KafkaSubmitter{
+		Writer:    w,
+		BatchSize: kafkaBatchSize,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// MakeKafkaSubmitterWithConfig returns a new KafkaSubmitter producing to the
+// cluster and topic described by config.
+func MakeKafkaSubmitterWithConfig(config KafkaConfig) (*KafkaSubmitter, error) {
+	w, err := config.Writer()
+	if err != nil {
+		return nil, err
+	}
+	s := MakeKafkaSubmitter(w)
+	if config.BatchSize > 0 {
+		s.BatchSize = config.BatchSize
+	}
+	return s, nil
+}
+
+// message returns the Kafka message for the jsonData payload.
+func (s *KafkaSubmitter) message(jsonData []byte) kafka.Message {
+	var verdict struct {
+		Hashes struct {
+			Sha256 string
+		}
+	}
+	json.Unmarshal(jsonData, &verdict)
+	msg := kafka.Message{
+		Value: jsonData,
+		Headers: []kafka.Header{
+			{Key: "sensor_id", Value: []byte(SensorID)},
+			{Key: "suspicious", Value: []byte(strconv.FormatBool(isSuspicious(jsonData)))},
+		},
+	}
+	if len(verdict.Hashes.Sha256) > 0 {
+		msg.Key = []byte(verdict.Hashes.Sha256)
+	}
+	return msg
+}
+
+// Run makes the submitter accept verdicts.
+func (s *KafkaSubmitter) Run() {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.Running = true
+}
+
+// Submit writes the jsonData payload, waiting for the write to be
+// acknowledged. It returns an error if the write failed or was cancelled by
+// Finish.
+func (s *KafkaSubmitter) Submit(jsonData []byte) error {
+	return s.SubmitBatch([][]byte{jsonData})
+}
+
+// SubmitBatch writes all given payloads at once, like Submit.
+func (s *KafkaSubmitter) SubmitBatch(batch [][]byte) error {
+	s.Lock.RLock()
+	ok := s.Running && !s.Finished
+	if ok {
+		s.Writes.Add(1)
+	}
+	s.Lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("Kafka submitter not running")
+	}
+	defer s.Writes.Done()
+
+	msgs := make([]kafka.Message, len(batch))
+	for i, jsonData := range batch {
+		msgs[i] = s.message(jsonData)
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, kafkaTimeout)
+	defer cancel()
+	err := s.Writer.WriteMessages(ctx, msgs...)
+	if err != nil {
+		metricKafkaFailed.Add(int64(len(batch)))
+		return fmt.Errorf("writing to Kafka failed: %w", err)
+	}
+	metricKafkaProduced.Add(int64(len(batch)))
+	return nil
+}
+
+// MaxBatchSize returns BatchSize.
+func (s *KafkaSubmitter) MaxBatchSize() int {
+	return s.BatchSize
+}
+
+// Finish cancels writes in progress, waits for them to return and closes the
+// writer.
+func (s *KafkaSubmitter) Finish() {
+	s.Lock.Lock()
+	if s.Finished {
+		s.Lock.Unlock()
+		return
+	}
+	s.Finished = true
+	s.Lock.Unlock()
+
+	s.cancel()
+	s.Writes.Wait()
+	err := s.Writer.Close()
+	if err != nil {
+		log.Errorf("could not close Kafka writer: %s", err)
+	}
+}
@@ -0,0 +1,271 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafkaWriter records written messages, failing the given number of
+// writes first. With Block set, writes wait until they are cancelled.
+type fakeKafkaWriter struct {
+	Lock     sync.Mutex
+	Failures int
+	Block    bool
+	Batches  [][]kafka.Message
+	Closed   bool
+}
+
+func (w *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if w.Block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+	if w.Failures > 0 {
+		w.Failures--
+		return fmt.Errorf("broker not available")
+	}
+	w.Batches = append(w.Batches, msgs)
+	return nil
+}
+
+func (w *fakeKafkaWriter) Close() error {
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+	w.Closed = true
+	return nil
+}
+
+func (w *fakeKafkaWriter) waitMessages(t *testing.T, n int) []kafka.Message {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.Lock.Lock()
+		var msgs []kafka.Message
+		for _, b := range w.Batches {
+			msgs = append(msgs, b...)
+		}
+		w.Lock.Unlock()
+		if len(msgs) >= n {
+			return msgs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %d messages, got %d", n, len(msgs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKafkaSubmitter(t *testing.T) {
+	w := &fakeKafkaWriter{}
+	s := MakeKafkaSubmitter(w)
+	if s.Submit([]byte(`{}`)) == nil {
+		t.Fatal("submission before Run succeeded")
+	}
+	s.Run()
+
+	for _, msg := range []string{
+		`{"Suspicious":true,"Hashes":{"Sha256":"abc"}}`,
+		`{"Hashes":{"Sha256":"def"}}`,
+	} {
+		if err := s.Submit([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.SubmitBatch([][]byte{[]byte(`{"N":3}`), []byte(`{"N":4}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Finish()
+
+	if len(w.Batches) != 3 || len(w.Batches[2]) != 2 || !w.Closed {
+		t.Fatalf("unexpected batches %v", w.Batches)
+	}
+	suspicious := map[string]string{"abc": "true", "def": "false", "": "false"}
+	for _, m := range append(w.Batches[0], w.Batches[1]...) {
+		expected, ok := suspicious[string(m.Key)]
+		if !ok {
+			t.Errorf("unexpected key %q", m.Key)
+		}
+		delete(suspicious, string(m.Key))
+		headers := make(map[string]string)
+		for _, h := range m.Headers {
+			headers[h.Key] = string(h.Value)
+		}
+		if headers["sensor_id"] != SensorID || headers["suspicious"] != expected {
+			t.Errorf("unexpected headers %v", headers)
+		}
+	}
+	if s.Submit([]byte(`{}`)) == nil {
+		t.Fatal("submission to finished submitter succeeded")
+	}
+}
+
+func TestKafkaOutbox(t *testing.T) {
+	dbdir := t.TempDir()
+	err := sampledb.InitDB(dbdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	// verdicts piling up in the outbox are written in batches, also when
+	// passed through a sink converting them
+	w := &fakeKafkaWriter{}
+	s := MakeKafkaSubmitter(w)
+	s.BatchSize = 2
+	s.Run()
+	m := MakeMultiSubmitter(true)
+	m.AddSink("kafka", MakeFormatSubmitter(s, func(jsonData []byte) ([]byte, error) {
+		return jsonData, nil
+	}), func([]byte) bool { return true })
+	for i := 0; i < 5; i++ {
+		err = m.Submit([]byte(fmt.Sprintf(`{"N":%d}`, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Run()
+	msgs := w.waitMessages(t, 5)
+	m.Finish()
+
+	if len(w.Batches) != 3 || len(w.Batches[0]) != 2 || len(w.Batches[1]) != 2 {
+		t.Fatalf("unexpected batches %v", w.Batches)
+	}
+	for i, msg := range msgs {
+		if string(msg.Value) != fmt.Sprintf(`{"N":%d}`, i) {
+			t.Fatalf("wrong message or order: %s", msg.Value)
+		}
+	}
+}
+
+func TestKafkaFailure(t *testing.T) {
+	w := &fakeKafkaWriter{Failures: 1}
+	s := MakeKafkaSubmitter(w)
+	s.Run()
+
+	// failed writes are reported, to be retried by the outbox
+	if s.Submit([]byte(`{"N":1}`)) == nil {
+		t.Fatal("failed write reported as submitted")
+	}
+	err := s.Submit([]byte(`{"N":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Finish()
+	if len(w.Batches) != 1 {
+		t.Fatalf("unexpected batches %v", w.Batches)
+	}
+
+	// writes in progress are cancelled on shutdown
+	w = &fakeKafkaWriter{Block: true}
+	s = MakeKafkaSubmitter(w)
+	s.Run()
+	result := make(chan error)
+	go func() {
+		result <- s.Submit([]byte(`{"N":2}`))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	finished := make(chan bool)
+	go func() {
+		s.Finish()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout finishing submitter")
+	}
+	if <-result == nil || !w.Closed {
+		t.Fatal("cancelled write reported as submitted")
+	}
+}
+
+func TestKafkaConfig(t *testing.T) {
+	config := KafkaConfig{
+		Brokers:     []string{"localhost:9092"},
+		Topic:       "verdicts",
+		Acks:        "all",
+		Compression: "zstd",
+		SASL:        "scram-sha-512",
+		User:        "sensor",
+		Pass:        "secret",
+		TLS:         true,
+	}
+	w, err := config.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.RequiredAcks != kafka.RequireAll || w.Compression != kafka.Zstd ||
+		w.BatchSize != kafkaBatchSize {
+		t.Fatalf("unexpected writer %+v", w)
+	}
+	transport := w.Transport.(*kafka.Transport)
+	if transport.TLS == nil || transport.SASL.Name() != "SCRAM-SHA-512" {
+		t.Fatalf("unexpected transport %+v", transport)
+	}
+
+	for _, invalid := range []func(c *KafkaConfig){
+		func(c *KafkaConfig) { c.Brokers = nil },
+		func(c *KafkaConfig) { c.Topic = "" },
+		func(c *KafkaConfig) { c.Acks = "two" },
+		func(c *KafkaConfig) { c.Compression = "xz" },
+		func(c *KafkaConfig) { c.SASL = "gssapi" },
+		func(c *KafkaConfig) { c.TLS = false; c.CAFile = "ca.pem" },
+	} {
+		c := config
+		invalid(&c)
+		if _, err := c.Writer(); err == nil {
+			t.Errorf("invalid configuration %+v accepted", c)
+		}
+	}
+}
+
+// TestKafkaBroker produces to a real broker given as NIGHTWATCH_KAFKA_BROKER,
+// e.g. a local single-node one, with automatic topic creation enabled.
+func TestKafkaBroker(t *testing.T) {
+	broker := os.Getenv("NIGHTWATCH_KAFKA_BROKER")
+	if len(broker) == 0 {
+		t.Skip("NIGHTWATCH_KAFKA_BROKER not set")
+	}
+	topic := fmt.Sprintf("nightwatch-test-%d", time.Now().UnixNano())
+	s, err := MakeKafkaSubmitterWithConfig(KafkaConfig{
+		Brokers:     strings.Split(broker, ","),
+		Topic:       topic,
+		Acks:        "all",
+		Compression: "gzip",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Writer.(*kafka.Writer).AllowAutoTopicCreation = true
+	err = s.Writer.WriteMessages(context.Background(), s.message([]byte(`{"Hashes":{"Sha256":"abc"}}`)))
+	s.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{Brokers: strings.Split(broker, ","), Topic: topic})
+	defer r.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	m, err := r.ReadMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Key) != "abc" {
+		t.Fatalf("unexpected key %q", m.Key)
+	}
+}
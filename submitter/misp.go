@@ -0,0 +1,335 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mispTimeout       = 30 * time.Second
+	mispMaxSampleSize = 20 * 1024 * 1024
+	// mispFileTemplate is the UUID of the MISP file object template.
+	mispFileTemplate = "688c46fb-5edb-40a3-8273-1af7923e2215"
+)
+
+// mispTag is a tag of a MISP event.
+type mispTag struct {
+	Name string `json:"name"`
+}
+
+// mispAttribute is an attribute of a MISP object.
+type mispAttribute struct {
+	Type           string `json:"type"`
+	ObjectRelation string `json:"object_relation"`
+	Value          string `json:"value"`
+	ToIDS          bool   `json:"to_ids"`
+	Comment        string `json:"comment,omitempty"`
+	// Data is the base64 encoded content of a malware-sample, which MISP
+	// stores in a password protected zip file if Encrypt is set.
+	Data    string `json:"data,omitempty"`
+	Encrypt bool   `json:"encrypt,omitempty"`
+}
+
+// mispObject is a MISP object, such as a file.
+type mispObject struct {
+	Name         string          `json:"name"`
+	MetaCategory string          `json:"meta-category"`
+	TemplateUUID string          `json:"template_uuid"`
+	Attribute    []mispAttribute `json:"Attribute"`
+}
+
+// mispEvent is a MISP event as sent to and returned by the REST API. MISP
+// returns numbers as strings.
+type mispEvent struct {
+	ID            string       `json:"id,omitempty"`
+	UUID          string       `json:"uuid,omitempty"`
+	Info          string       `json:"info"`
+	Distribution  string       `json:"distribution,omitempty"`
+	ThreatLevelID string       `json:"threat_level_id,omitempty"`
+	Analysis      string       `json:"analysis,omitempty"`
+	Tag           []mispTag    `json:"Tag,omitempty"`
+	Object        []mispObject `json:"Object,omitempty"`
+}
+
+// MISPSubmitter is a Submitter creating a MISP event for each suspicious
+// sample through the MISP REST API. The event contains a file object with the
+// hashes, name, size and type of the sample and is tagged with the sensor, the
+// plugins which found the sample suspicious and the names of matched YARA
+// rules. If an event exists for the sample already, the tags are added to it
+// and a sighting for the sensor is recorded instead. Clean verdicts are
+// ignored.
+//
+// If AttachSamples is set, samples which have been uploaded by an Uploader
+// are attached as malware-sample, which MISP stores encrypted. The sample is
+// read from the Suricata filestore, as the uploader removes its staged copy
+// once uploaded. Samples larger than MaxSampleSize or which have been removed
+// from the filestore already are left out and the event is created without
+// them.
+type MISPSubmitter struct {
+	URL           string
+	Key           string
+	Client        *http.Client
+	Distribution  int
+	ThreatLevel   int
+	Analysis      int
+	Tags          []string
+	AttachSamples bool
+	MaxSampleSize int64
+}
+
+// MakeMISPSubmitter returns a new MISPSubmitter for the MISP instance at the
+// given URL, authenticating with the given API key. Events are only visible
+// to the own organisation, with medium threat level and initial analysis
+// state by default.
+func MakeMISPSubmitter(baseURL, key string) (*MISPSubmitter, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid MISP URL: %s", RedactURL(baseURL))
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("no MISP API key given")
+	}
+	return &MISPSubmitter{
+		URL:           strings.TrimRight(baseURL, "/"),
+		Key:           key,
+		Client:        &http.Client{Timeout: mispTimeout},
+		ThreatLevel:   2,
+		MaxSampleSize: mispMaxSampleSize,
+	}, nil
+}
+
+// request sends a request with a JSON body to the given API path and decodes
+// the JSON response into result, if not nil.
+func (s *MISPSubmitter) request(path string, body interface{}, result interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", s.Key)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("MISP request %s failed with status %s: %s", path, resp.Status,
+			bytes.TrimSpace(msg))
+	}
+	if result == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// eventInfo returns the info of the event for a sample, by which the event is
+// found again.
+func eventInfo(v *sampledb.FileVerdict) string {
+	return "Nightwatch: suspicious file " + v.Hashes.Sha256
+}
+
+// tags returns the tags for a verdict.
+func (s *MISPSubmitter) tags(v *sampledb.FileVerdict) []string {
+	tags := append([]string{}, s.Tags...)
+	tags = append(tags, fmt.Sprintf("nightwatch:sensor=%q", v.SensorID))
+	for _, plugin := range v.SuspiciousVia {
+		tags = append(tags, fmt.Sprintf("nightwatch:plugin=%q", plugin))
+	}
+	for _, rule := range v.MatchedRules() {
+		tags = append(tags, fmt.Sprintf("yara:rule=%q", rule))
+	}
+	return tags
+}
+
+// fileObject returns the MISP file object describing the sample.
+func (s *MISPSubmitter) fileObject(v *sampledb.FileVerdict) mispObject {
+	filename := filepath.Base(v.Filename)
+	if v.Event != nil && len(v.Event.File.Filename) > 0 {
+		filename = v.Event.File.Filename
+	}
+	o := mispObject{
+		Name:         "file",
+		MetaCategory: "file",
+		TemplateUUID: mispFileTemplate,
+	}
+	add := func(relation, value string, toIDS bool, comment string) {
+		if len(value) > 0 {
+			o.Attribute = append(o.Attribute, mispAttribute{
+				Type:           relation,
+				ObjectRelation: relation,
+				Value:          value,
+				ToIDS:          toIDS,
+				Comment:        comment,
+			})
+		}
+	}
+	add("md5", v.Hashes.Md5, true, "")
+	add("sha1", v.Hashes.Sha1, true, "")
+	add("sha256", v.Hashes.Sha256, true, "")
+	add("sha512", v.Hashes.Sha512, true, "")
+	add("filename", filename, false, "")
+	if v.Size > 0 {
+		add("size-in-bytes", strconv.FormatInt(v.Size, 10), false, "")
+	}
+	add("text", v.Magic, false, "file type determined by libmagic")
+
+	if s.AttachSamples && v.Uploaded {
+		data, err := s.readSample(v.Filename)
+		if os.IsNotExist(err) {
+			log.Infof("not attaching sample %s to MISP event: %s has been removed from the filestore already",
+				v.Hashes.Sha256, v.Filename)
+		} else if err != nil {
+			log.Warnf("not attaching sample %s to MISP event: %s", v.Hashes.Sha256, err)
+		} else {
+			o.Attribute = append(o.Attribute, mispAttribute{
+				Type:           "malware-sample",
+				ObjectRelation: "malware-sample",
+				Value:          filename,
+				Data:           base64.StdEncoding.EncodeToString(data),
+				Encrypt:        true,
+				Comment:        v.UploadLocation,
+			})
+		}
+	}
+	return o
+}
+
+func (s *MISPSubmitter) readSample(path string) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() > s.MaxSampleSize {
+		return nil, fmt.Errorf("sample exceeds %d bytes", s.MaxSampleSize)
+	}
+	return os.ReadFile(path)
+}
+
+// findEvent returns the event for the sample of the verdict, or nil if there
+// is none yet.
+func (s *MISPSubmitter) findEvent(v *sampledb.FileVerdict) (*mispEvent, error) {
+	var result struct {
+		Response []struct {
+			Event mispEvent
+		} `json:"response"`
+	}
+	err := s.request("/events/restSearch", map[string]interface{}{
+		"returnFormat": "json",
+		"eventinfo":    eventInfo(v),
+		"metadata":     true,
+		"limit":        1,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Response) == 0 {
+		return nil, nil
+	}
+	return &result.Response[0].Event, nil
+}
+
+// createEvent creates a new event for the sample of the verdict.
+func (s *MISPSubmitter) createEvent(v *sampledb.FileVerdict) error {
+	event := mispEvent{
+		Info:          eventInfo(v),
+		Distribution:  strconv.Itoa(s.Distribution),
+		ThreatLevelID: strconv.Itoa(s.ThreatLevel),
+		Analysis:      strconv.Itoa(s.Analysis),
+		Object:        []mispObject{s.fileObject(v)},
+	}
+	for _, tag := range s.tags(v) {
+		event.Tag = append(event.Tag, mispTag{Name: tag})
+	}
+	var result struct {
+		Event mispEvent
+	}
+	err := s.request("/events/add", map[string]interface{}{"Event": event}, &result)
+	if err != nil {
+		return err
+	}
+	log.Infof("created MISP event %s for %s", result.Event.ID, v.Hashes.Sha256)
+	return nil
+}
+
+// updateEvent adds the tags missing from an existing event and records a
+// sighting of the sample.
+func (s *MISPSubmitter) updateEvent(event *mispEvent, v *sampledb.FileVerdict) error {
+	existing := make(map[string]bool)
+	for _, tag := range event.Tag {
+		existing[tag.Name] = true
+	}
+	for _, tag := range s.tags(v) {
+		if existing[tag] {
+			continue
+		}
+		err := s.request("/tags/attachTagToObject", map[string]string{
+			"uuid": event.UUID,
+			"tag":  tag,
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.request("/sightings/add", map[string]interface{}{
+		"values": []string{v.Hashes.Sha256},
+		"source": "nightwatch " + v.SensorID,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	log.Infof("updated MISP event %s for %s", event.ID, v.Hashes.Sha256)
+	return nil
+}
+
+// Submit creates or updates the MISP event for the verdict given as jsonData
+// payload, if it is suspicious.
+func (s *MISPSubmitter) Submit(jsonData []byte) error {
+	var v sampledb.FileVerdict
+	err := json.Unmarshal(jsonData, &v)
+	if err != nil {
+		return err
+	}
+	if !v.Suspicious {
+		return nil
+	}
+	if len(v.Hashes.Sha256) == 0 {
+		return fmt.Errorf("verdict without SHA256 hash")
+	}
+	event, err := s.findEvent(&v)
+	if err != nil {
+		return err
+	}
+	if event == nil {
+		return s.createEvent(&v)
+	}
+	return s.updateEvent(event, &v)
+}
+
+// Finish does nothing, as requests are made synchronously.
+func (s *MISPSubmitter) Finish() {}
@@ -0,0 +1,236 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mispServer is a stand-in for the parts of the MISP REST API used by the
+// MISPSubmitter, keeping events in memory.
+type mispServer struct {
+	*httptest.Server
+	Lock      sync.Mutex
+	Events    []mispEvent
+	Sightings []string
+}
+
+func makeMISPServer(t *testing.T) *mispServer {
+	ms := &mispServer{}
+	mux := http.NewServeMux()
+	handle := func(path string, handler func(body map[string]interface{}) interface{}) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.Header.Get("Authorization") != "key" ||
+				r.Header.Get("Accept") != "application/json" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			var body map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			ms.Lock.Lock()
+			result := handler(body)
+			ms.Lock.Unlock()
+			json.NewEncoder(w).Encode(result)
+		})
+	}
+	handle("/events/restSearch", func(body map[string]interface{}) interface{} {
+		response := []map[string]interface{}{}
+		for _, e := range ms.Events {
+			if e.Info == body["eventinfo"] {
+				response = append(response, map[string]interface{}{"Event": e})
+			}
+		}
+		return map[string]interface{}{"response": response}
+	})
+	handle("/events/add", func(body map[string]interface{}) interface{} {
+		b, _ := json.Marshal(body["Event"])
+		var e mispEvent
+		json.Unmarshal(b, &e)
+		e.ID = fmt.Sprint(len(ms.Events) + 1)
+		e.UUID = "uuid-" + e.ID
+		ms.Events = append(ms.Events, e)
+		return map[string]interface{}{"Event": e}
+	})
+	handle("/tags/attachTagToObject", func(body map[string]interface{}) interface{} {
+		for i, e := range ms.Events {
+			if e.UUID == body["uuid"] {
+				ms.Events[i].Tag = append(e.Tag, mispTag{Name: body["tag"].(string)})
+			}
+		}
+		return map[string]interface{}{"saved": true}
+	})
+	handle("/sightings/add", func(body map[string]interface{}) interface{} {
+		ms.Sightings = append(ms.Sightings, fmt.Sprint(body["values"], " ", body["source"]))
+		return map[string]interface{}{"message": "1 sighting successfully added."}
+	})
+	ms.Server = httptest.NewServer(mux)
+	return ms
+}
+
+func mispVerdict(sensor string, rules ...string) []byte {
+	reason, _ := json.Marshal(map[string]interface{}{"MatchedRules": rules})
+	b, _ := json.Marshal(map[string]interface{}{
+		"Suspicious":    true,
+		"SuspiciousVia": []string{"YARA"},
+		"Reasons":       map[string]string{"YARA": string(reason)},
+		"SensorID":      sensor,
+		"Filename":      "/var/log/suricata/filestore/ab/abcd",
+		"Size":          5,
+		"Magic":         "ASCII text",
+		"Hashes":        map[string]string{"Md5": "m", "Sha1": "s1", "Sha256": "s256"},
+		"Event":         map[string]interface{}{"File": map[string]string{"Filename": "evil.exe"}},
+	})
+	return b
+}
+
+func eventTags(e mispEvent) []string {
+	var tags []string
+	for _, tag := range e.Tag {
+		tags = append(tags, tag.Name)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func TestMISPSubmitter(t *testing.T) {
+	ms := makeMISPServer(t)
+	defer ms.Close()
+	s, err := MakeMISPSubmitter(ms.URL+"/", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Tags = []string{"tlp:amber"}
+	defer s.Finish()
+
+	// clean verdicts are ignored
+	err = s.Submit([]byte(`{"Suspicious":false,"Hashes":{"Sha256":"s256"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Submit(mispVerdict("sensor1", "Rule1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms.Events) != 1 {
+		t.Fatalf("unexpected events %v", ms.Events)
+	}
+	e := ms.Events[0]
+	if e.Info != "Nightwatch: suspicious file s256" || e.Distribution != "0" || e.ThreatLevelID != "2" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	expected := `nightwatch:plugin="YARA",nightwatch:sensor="sensor1",tlp:amber,yara:rule="Rule1"`
+	if tags := strings.Join(eventTags(e), ","); tags != expected {
+		t.Fatalf("unexpected tags %s", tags)
+	}
+	if len(e.Object) != 1 || e.Object[0].Name != "file" {
+		t.Fatalf("unexpected objects %+v", e.Object)
+	}
+	var attrs []string
+	for _, a := range e.Object[0].Attribute {
+		attrs = append(attrs, a.ObjectRelation+"="+a.Value)
+	}
+	expected = "md5=m,sha1=s1,sha256=s256,filename=evil.exe,size-in-bytes=5,text=ASCII text"
+	if strings.Join(attrs, ",") != expected {
+		t.Fatalf("unexpected attributes %v", attrs)
+	}
+
+	// seen again on another sensor with another rule
+	err = s.Submit(mispVerdict("sensor2", "Rule1", "Rule2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms.Events) != 1 {
+		t.Fatalf("unexpected events %v", ms.Events)
+	}
+	expected = `nightwatch:plugin="YARA",nightwatch:sensor="sensor1",nightwatch:sensor="sensor2",` +
+		`tlp:amber,yara:rule="Rule1",yara:rule="Rule2"`
+	if tags := strings.Join(eventTags(ms.Events[0]), ","); tags != expected {
+		t.Fatalf("unexpected tags %s", tags)
+	}
+	if strings.Join(ms.Sightings, ",") != "[s256] nightwatch sensor2" {
+		t.Fatalf("unexpected sightings %v", ms.Sightings)
+	}
+
+	s.Key = "wrong"
+	if s.Submit(mispVerdict("sensor1")) == nil {
+		t.Fatal("failed request not reported")
+	}
+	if _, err := MakeMISPSubmitter("ftp://misp", "key"); err == nil {
+		t.Fatal("invalid URL accepted")
+	}
+}
+
+func TestMISPAttachSample(t *testing.T) {
+	ms := makeMISPServer(t)
+	defer ms.Close()
+	s, err := MakeMISPSubmitter(ms.URL, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AttachSamples = true
+
+	sample := filepath.Join(t.TempDir(), "abcd")
+	err = os.WriteFile(sample, []byte("evil\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	json.Unmarshal(mispVerdict("sensor1"), &v)
+	v["Filename"] = sample
+	v["Uploaded"] = true
+	v["UploadLocation"] = "s3/bucket/abcd"
+	b, _ := json.Marshal(v)
+	err = s.Submit(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := ms.Events[0].Object[0].Attribute
+	a := attrs[len(attrs)-1]
+	if a.Type != "malware-sample" || a.Value != "evil.exe" || !a.Encrypt ||
+		a.Data != base64.StdEncoding.EncodeToString([]byte("evil\n")) || a.Comment != "s3/bucket/abcd" {
+		t.Fatalf("unexpected attribute %+v", a)
+	}
+}
+
+func TestMISPAttachSampleGone(t *testing.T) {
+	ms := makeMISPServer(t)
+	defer ms.Close()
+	s, err := MakeMISPSubmitter(ms.URL, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AttachSamples = true
+
+	var v map[string]interface{}
+	json.Unmarshal(mispVerdict("sensor1"), &v)
+	v["Filename"] = filepath.Join(t.TempDir(), "gone")
+	v["Uploaded"] = true
+	b, _ := json.Marshal(v)
+	err = s.Submit(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ms.Events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(ms.Events))
+	}
+	for _, a := range ms.Events[0].Object[0].Attribute {
+		if a.Type == "malware-sample" {
+			t.Fatalf("attached sample which is gone: %+v", a)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/DCSO/nightwatch/sampledb"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// metricSinkSubmitted counts messages submitted successfully, by sink.
+	metricSinkSubmitted = expvar.NewMap("sink_submitted")
+	// metricSinkFailed counts failed submission attempts, by sink.
+	metricSinkFailed = expvar.NewMap("sink_failed")
+)
+
+// Filter decides whether a message is passed on to a sink.
+type Filter func(jsonData []byte) bool
+
+// ParseFilter returns the filter with the given name: all, suspicious (only
+// suspicious verdicts) or clean (only verdicts which are not suspicious).
+func ParseFilter(name string) (Filter, error) {
+	switch name {
+	case "all":
+		return func([]byte) bool { return true }, nil
+	case "suspicious":
+		return func(jsonData []byte) bool { return isSuspicious(jsonData) }, nil
+	case "clean":
+		return func(jsonData []byte) bool { return !isSuspicious(jsonData) }, nil
+	}
+	return nil, fmt.Errorf("invalid filter: %s", name)
+}
+
+func isSuspicious(jsonData []byte) bool {
+	var verdict struct {
+		Suspicious bool
+	}
+	json.Unmarshal(jsonData, &verdict)
+	return verdict.Suspicious
+}
+
+// Sink is a Submitter receiving messages from a MultiSubmitter.
+type Sink struct {
+	Name      string
+	Submitter Submitter
+	Filter    Filter
+	Outbox    *OutboxSubmitter
+}
+
+// Submit passes the jsonData payload on to the sink's Submitter, counting
+// the result.
+func (sink *Sink) Submit(jsonData []byte) error {
+	err := sink.Submitter.Submit(jsonData)
+	if err != nil {
+		metricSinkFailed.Add(sink.Name, 1)
+		return fmt.Errorf("%s: %s", sink.Name, err)
+	}
+	metricSinkSubmitted.Add(sink.Name, 1)
+	return nil
+}
+
+// SubmitBatch passes several messages on to the sink's Submitter at once,
+// counting the result.
+func (sink *Sink) SubmitBatch(batch [][]byte) error {
+	err := submitBatch(sink.Submitter, batch)
+	if err != nil {
+		metricSinkFailed.Add(sink.Name, int64(len(batch)))
+		return fmt.Errorf("%s: %s", sink.Name, err)
+	}
+	metricSinkSubmitted.Add(sink.Name, int64(len(batch)))
+	return nil
+}
+
+// MaxBatchSize returns the batch size of the sink's Submitter.
+func (sink *Sink) MaxBatchSize() int {
+	return maxBatchSize(sink.Submitter)
+}
+
+// Finish cleans up the sink's Submitter.
+func (sink *Sink) Finish() {
+	sink.Submitter.Finish()
+}
+
+// MultiSubmitter is a Submitter passing each message on to all sinks whose
+// filter matches it. If it is durable, each sink has its own outbox in the
+// sample database with its own background sender, so that a failing sink
+// does not hold up the others. Messages are added to the outboxes of all
+// matching sinks at once, and Submit only succeeds once they have been
+// stored. Otherwise, messages are submitted to the sinks right away, and
+// Submit only succeeds if all matching sinks took the message.
+type MultiSubmitter struct {
+	Sinks       []*Sink
+	Durable     bool
+	MaxAttempts int
+	Lock        sync.RWMutex
+	Finished    bool
+}
+
+// MakeMultiSubmitter returns a new MultiSubmitter without sinks, keeping
+// messages in per-sink outboxes if durable is set. In this case, the sample
+// database needs to be initialized.
+func MakeMultiSubmitter(durable bool) *MultiSubmitter {
+	return &MultiSubmitter{
+		Durable:     durable,
+		MaxAttempts: outboxMaxAttempts,
+	}
+}
+
+// sinkOutbox returns the name of the outbox for the sink with the given name.
+func sinkOutbox(name string) string {
+	return sampledb.DefaultOutbox + "_" + name
+}
+
+// AddSink adds a sink receiving the messages matched by filter. Sinks need to
+// be added before calling Run.
+func (m *MultiSubmitter) AddSink(name string, s Submitter, filter Filter) {
+	sink := &Sink{
+		Name:      name,
+		Submitter: s,
+		Filter:    filter,
+	}
+	if m.Durable {
+		sink.Outbox = MakeNamedOutboxSubmitter(sink, sinkOutbox(name))
+	}
+	m.Sinks = append(m.Sinks, sink)
+}
+
+// Run starts the background senders of durable sinks.
+func (m *MultiSubmitter) Run() {
+	for _, sink := range m.Sinks {
+		if sink.Outbox != nil {
+			sink.Outbox.MaxAttempts = m.MaxAttempts
+			sink.Outbox.Run()
+		}
+	}
+}
+
+// outboxes returns the outboxes of the durable sinks whose filter matches
+// the jsonData payload.
+func (m *MultiSubmitter) outboxes(jsonData []byte) []string {
+	var outboxes []string
+	for _, sink := range m.Sinks {
+		if sink.Outbox != nil && sink.Filter(jsonData) {
+			outboxes = append(outboxes, sink.Outbox.Outbox)
+		}
+	}
+	return outboxes
+}
+
+// distribute moves the messages in the default outbox, e.g. left there by a
+// version without per-sink outboxes, to the outboxes of the matching sinks.
+func (m *MultiSubmitter) distribute() error {
+	n, err := sampledb.MoveOutboxEntries(sampledb.DefaultOutbox, m.outboxes)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Infof("moved %d messages from %s to the sink outboxes", n, sampledb.DefaultOutbox)
+		for _, sink := range m.Sinks {
+			if sink.Outbox != nil {
+				sink.Outbox.notify()
+			}
+		}
+	}
+	return nil
+}
+
+// Sweep moves all verdicts in the sample database which were never reported,
+// and messages left in the default outbox, to the outboxes of the matching
+// durable sinks, to be submitted again.
+func (m *MultiSubmitter) Sweep() error {
+	n, err := sampledb.MoveUnreportedToOutbox()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Infof("resubmitting %d unreported verdicts", n)
+	}
+	return m.distribute()
+}
+
+// Requeue moves the messages given up on by durable sinks back into their
+// outboxes, to be submitted again, along with those given up on in the
+// default outbox.
+func (m *MultiSubmitter) Requeue() error {
+	n, err := sampledb.RequeueDeadLetters(sampledb.DefaultOutbox)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		if err = m.distribute(); err != nil {
+			return err
+		}
+	}
+	for _, sink := range m.Sinks {
+		if sink.Outbox == nil {
+			continue
+		}
+		if err := sink.Outbox.Requeue(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Submit passes the jsonData payload on to all sinks whose filter matches it,
+// returning an error unless all of them took it.
+func (m *MultiSubmitter) Submit(jsonData []byte) error {
+	m.Lock.RLock()
+	defer m.Lock.RUnlock()
+	if m.Finished {
+		return fmt.Errorf("submitter finished")
+	}
+	matching := make([]*Sink, 0, len(m.Sinks))
+	for _, sink := range m.Sinks {
+		if sink.Filter(jsonData) {
+			matching = append(matching, sink)
+		}
+	}
+	if len(matching) == 0 {
+		return nil
+	}
+
+	if m.Durable {
+		outboxes := make([]string, len(matching))
+		for i, sink := range matching {
+			outboxes[i] = sink.Outbox.Outbox
+		}
+		err := sampledb.AddOutboxEntries(outboxes, jsonData)
+		if err != nil {
+			return err
+		}
+		for _, sink := range matching {
+			sink.Outbox.notify()
+		}
+		return nil
+	}
+
+	errs := make([]string, 0)
+	for _, sink := range matching {
+		if err := sink.Submit(jsonData); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("submission to %d of %d sinks failed: %s", len(errs),
+			len(matching), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Finish stops the senders of durable sinks, leaving messages not submitted
+// yet in their outboxes, and cleans up all sinks.
+func (m *MultiSubmitter) Finish() {
+	m.Lock.Lock()
+	if m.Finished {
+		m.Lock.Unlock()
+		return
+	}
+	m.Finished = true
+	m.Lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, sink := range m.Sinks {
+		wg.Add(1)
+		go func(sink *Sink) {
+			defer wg.Done()
+			if sink.Outbox != nil {
+				sink.Outbox.Finish()
+			} else {
+				sink.Finish()
+			}
+		}(sink)
+	}
+	wg.Wait()
+}
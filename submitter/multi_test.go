@@ -0,0 +1,207 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+// blockingSubmitter blocks all submissions until it is finished.
+type blockingSubmitter struct {
+	FinishChan chan bool
+	FinishOnce sync.Once
+}
+
+func (s *blockingSubmitter) Submit(jsonData []byte) error {
+	<-s.FinishChan
+	return fmt.Errorf("submitter finished")
+}
+
+func (s *blockingSubmitter) Finish() {
+	s.FinishOnce.Do(func() {
+		close(s.FinishChan)
+	})
+}
+
+func makeMultiSubmitter(t *testing.T, sinks map[string]Submitter, filters map[string]string,
+	durable bool) *MultiSubmitter {
+	m := MakeMultiSubmitter(durable)
+	for _, name := range []string{"a", "b"} {
+		filter, err := ParseFilter(filters[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.AddSink(name, sinks[name], filter)
+	}
+	for _, sink := range m.Sinks {
+		if sink.Outbox != nil {
+			sink.Outbox.MinDelay = 10 * time.Millisecond
+			sink.Outbox.MaxDelay = 50 * time.Millisecond
+			sink.Outbox.FinishWait = 100 * time.Millisecond
+		}
+	}
+	m.Run()
+	return m
+}
+
+func initTestDB(t *testing.T) func() {
+	dbdir, err := os.MkdirTemp("", "dbdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sampledb.InitDB(dbdir)
+	if err != nil {
+		os.RemoveAll(dbdir)
+		t.Fatal(err)
+	}
+	return func() {
+		sampledb.CloseDB()
+		os.RemoveAll(dbdir)
+	}
+}
+
+func TestMultiSubmitterFilter(t *testing.T) {
+	defer initTestDB(t)()
+
+	a := &flakySubmitter{Failures: 2}
+	b := &flakySubmitter{}
+	m := makeMultiSubmitter(t, map[string]Submitter{"a": a, "b": b},
+		map[string]string{"a": "all", "b": "suspicious"}, true)
+
+	verdicts := []string{`{"Suspicious":false}`, `{"Suspicious":true}`, `{"Suspicious":false}`}
+	for _, v := range verdicts {
+		err := m.Submit([]byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// failed submissions to a are retried
+	waitForCount(t, a, 3)
+	waitForCount(t, b, 1)
+	m.Finish()
+
+	if !reflect.DeepEqual(a.Received, verdicts) {
+		t.Fatalf("unexpected messages %v", a.Received)
+	}
+	if !reflect.DeepEqual(b.Received, []string{`{"Suspicious":true}`}) {
+		t.Fatalf("unexpected messages %v", b.Received)
+	}
+	if !a.Finished || !b.Finished {
+		t.Fatal("sinks not finished")
+	}
+	if m.Submit([]byte(`{}`)) == nil {
+		t.Fatal("submission to finished submitter succeeded")
+	}
+
+	if _, err := ParseFilter("foo"); err == nil {
+		t.Fatal("invalid filter accepted")
+	}
+}
+
+func TestMultiSubmitterIsolation(t *testing.T) {
+	defer initTestDB(t)()
+
+	a := &blockingSubmitter{FinishChan: make(chan bool)}
+	b := &flakySubmitter{}
+	m := makeMultiSubmitter(t, map[string]Submitter{"a": a, "b": b},
+		map[string]string{"a": "all", "b": "clean"}, true)
+
+	// a blocks on the first message, while b keeps up
+	for i := 0; i < 5; i++ {
+		err := m.Submit([]byte(fmt.Sprintf(`{"Suspicious":false,"N":%d}`, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForCount(t, b, i+1)
+	}
+	err := m.Submit([]byte(`{"Suspicious":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finished := make(chan bool)
+	go func() {
+		m.Finish()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout finishing with blocked sink")
+	}
+	if !b.Finished {
+		t.Fatal("sink not finished")
+	}
+
+	// nothing is lost for a, and b does not get its messages again
+	n, err := sampledb.OutboxLen(sinkOutbox("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Fatalf("expected 6 messages left for a, got %d", n)
+	}
+	n, err = sampledb.OutboxLen(sinkOutbox("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no messages left for b, got %d", n)
+	}
+}
+
+func TestMultiSubmitterSync(t *testing.T) {
+	a := &flakySubmitter{Failures: 1}
+	b := &flakySubmitter{}
+	m := makeMultiSubmitter(t, map[string]Submitter{"a": a, "b": b},
+		map[string]string{"a": "all", "b": "all"}, false)
+	defer m.Finish()
+
+	if m.Submit([]byte(`{}`)) == nil {
+		t.Fatal("submission failing for one sink succeeded")
+	}
+	err := m.Submit([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.count() != 1 || b.count() != 2 {
+		t.Fatalf("unexpected submissions %d and %d", a.count(), b.count())
+	}
+}
+
+func TestMultiSubmitterSweep(t *testing.T) {
+	defer initTestDB(t)()
+
+	// messages left in the default outbox go to the matching sinks only
+	for _, msg := range []string{`{"Suspicious":true}`, `{"Suspicious":false}`} {
+		if _, err := sampledb.AddOutboxEntry(sampledb.DefaultOutbox, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &flakySubmitter{}
+	b := &flakySubmitter{}
+	m := makeMultiSubmitter(t, map[string]Submitter{"a": a, "b": b},
+		map[string]string{"a": "all", "b": "clean"}, true)
+	defer m.Finish()
+	err := m.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCount(t, a, 2)
+	waitForCount(t, b, 1)
+	n, err := sampledb.OutboxLen(sampledb.DefaultOutbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || b.Received[0] != `{"Suspicious":false}` {
+		t.Fatalf("unexpected messages %d, %v", n, b.Received)
+	}
+}
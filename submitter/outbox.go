@@ -0,0 +1,201 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	outboxMinDelay    = 1 * time.Second
+	outboxMaxDelay    = 1 * time.Minute
+	outboxMaxAttempts = 20
+	outboxFinishWait  = 5 * time.Second
+)
+
+// metricOutboxDeadLetters counts messages given up on by the outbox.
+var metricOutboxDeadLetters = expvar.NewInt("outbox_dead_letters")
+
+// OutboxSubmitter is a Submitter storing all messages in the outbox in the
+// sample database before they are passed on to another Submitter by a
+// background sender. Messages are only removed from the outbox once that
+// Submitter reports success, retrying with exponential backoff otherwise.
+// If that Submitter is a BatchSubmitter, the oldest messages are handed over
+// in batches of up to its MaxBatchSize, and retried and given up on together.
+// Messages which still fail after MaxAttempts tries are moved to the dead
+// letters, so they do not hold up later ones. A MaxAttempts of zero means
+// retrying forever.
+type OutboxSubmitter struct {
+	Submitter   Submitter
+	Outbox      string
+	MinDelay    time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int
+	FinishWait  time.Duration
+	NotifyChan  chan bool
+	StopChan    chan bool
+	StoppedChan chan bool
+	StopOnce    sync.Once
+}
+
+// MakeOutboxSubmitter returns a new OutboxSubmitter passing messages on to
+// the given Submitter. The sample database needs to be initialized.
+func MakeOutboxSubmitter(s Submitter) *OutboxSubmitter {
+	return MakeNamedOutboxSubmitter(s, sampledb.DefaultOutbox)
+}
+
+// MakeNamedOutboxSubmitter returns a new OutboxSubmitter like
+// MakeOutboxSubmitter, keeping messages in the outbox with the given name.
+func MakeNamedOutboxSubmitter(s Submitter, outbox string) *OutboxSubmitter {
+	return &OutboxSubmitter{
+		Submitter:   s,
+		Outbox:      outbox,
+		MinDelay:    outboxMinDelay,
+		MaxDelay:    outboxMaxDelay,
+		MaxAttempts: outboxMaxAttempts,
+		FinishWait:  outboxFinishWait,
+		NotifyChan:  make(chan bool, 1),
+		StopChan:    make(chan bool),
+		StoppedChan: make(chan bool),
+	}
+}
+
+func (s *OutboxSubmitter) notify() {
+	select {
+	case s.NotifyChan <- true:
+	default:
+	}
+}
+
+// Sweep moves all verdicts in the sample database which were never reported
+// into the outbox, to be submitted again.
+func (s *OutboxSubmitter) Sweep() error {
+	n, err := sampledb.MoveUnreportedToOutbox()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Infof("resubmitting %d unreported verdicts", n)
+		s.notify()
+	}
+	return nil
+}
+
+// Requeue moves all messages given up on before back into the outbox, to be
+// submitted again.
+func (s *OutboxSubmitter) Requeue() error {
+	n, err := sampledb.RequeueDeadLetters(s.Outbox)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Infof("requeueing %d dead letters in %s", n, s.Outbox)
+		s.notify()
+	}
+	return nil
+}
+
+// Run starts the background sender.
+func (s *OutboxSubmitter) Run() {
+	if n, err := sampledb.OutboxLen(s.Outbox); err == nil && n > 0 {
+		log.Infof("%d messages pending in %s", n, s.Outbox)
+	}
+	go func() {
+		defer close(s.StoppedChan)
+		delay := s.MinDelay
+		var lastID uint64
+		attempts := 0
+		for {
+			ids, batch, err := sampledb.FirstOutboxEntries(s.Outbox, maxBatchSize(s.Submitter))
+			if err != nil {
+				log.Errorf("could not read %s: %s", s.Outbox, err)
+			} else if len(batch) > 0 {
+				if ids[0] != lastID {
+					lastID = ids[0]
+					attempts = 0
+				}
+				err = submitBatch(s.Submitter, batch)
+				attempts++
+				if err == nil {
+					delay = s.MinDelay
+					err = sampledb.DeleteOutboxEntries(s.Outbox, ids)
+					if err != nil {
+						log.Errorf("could not remove %d messages from %s: %s", len(ids), s.Outbox, err)
+					}
+					continue
+				}
+				select {
+				case <-s.StopChan:
+					// interrupted by Finish, not a failed attempt
+					return
+				default:
+				}
+				if s.MaxAttempts > 0 && attempts >= s.MaxAttempts {
+					log.Errorf("submission of %d messages from %s starting at %d failed %d times, giving up: %s",
+						len(ids), s.Outbox, ids[0], attempts, err)
+					err = sampledb.DeadLetterOutboxEntries(s.Outbox, ids)
+					if err == nil {
+						metricOutboxDeadLetters.Add(int64(len(ids)))
+						continue
+					}
+					log.Errorf("could not move %d messages to dead letters: %s", len(ids), err)
+				} else {
+					log.Warnf("submission of %d messages from %s starting at %d failed, retrying in %v: %s",
+						len(ids), s.Outbox, ids[0], delay, err)
+				}
+			} else {
+				// outbox empty, wait for new messages
+				select {
+				case <-s.NotifyChan:
+					continue
+				case <-s.StopChan:
+					return
+				}
+			}
+			select {
+			case <-time.After(delay):
+				delay *= 2
+				if delay > s.MaxDelay {
+					delay = s.MaxDelay
+				}
+			case <-s.StopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Submit stores the jsonData payload in the outbox, to be passed on in the
+// background.
+func (s *OutboxSubmitter) Submit(jsonData []byte) error {
+	_, err := sampledb.AddOutboxEntry(s.Outbox, jsonData)
+	if err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// Finish stops the background sender started by Run, leaving messages not
+// submitted yet in the outbox, and cleans up the wrapped Submitter. A sender
+// still busy after FinishWait, for instance submitting to a Submitter which
+// blocks during an outage, is interrupted by finishing that Submitter.
+func (s *OutboxSubmitter) Finish() {
+	s.StopOnce.Do(func() {
+		close(s.StopChan)
+		select {
+		case <-s.StoppedChan:
+		case <-time.After(s.FinishWait):
+			log.Warnf("submission from %s still in progress, finishing it", s.Outbox)
+		}
+		s.Submitter.Finish()
+		<-s.StoppedChan
+	})
+}
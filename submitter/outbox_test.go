@@ -0,0 +1,226 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+type flakySubmitter struct {
+	Lock     sync.Mutex
+	Failures int
+	Received []string
+	Finished bool
+}
+
+func (s *flakySubmitter) Submit(jsonData []byte) error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.Failures > 0 {
+		s.Failures--
+		return fmt.Errorf("submission failed")
+	}
+	s.Received = append(s.Received, string(jsonData))
+	return nil
+}
+
+func (s *flakySubmitter) Finish() {
+	s.Finished = true
+}
+
+func (s *flakySubmitter) count() int {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return len(s.Received)
+}
+
+func waitForCount(t *testing.T, s *flakySubmitter, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.count() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %d messages, got %d", n, s.count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutboxSubmitter(t *testing.T) {
+	dbdir, err := os.MkdirTemp("", "dbdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbdir)
+	err = sampledb.InitDB(dbdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	fs := &flakySubmitter{
+		Failures: 3,
+	}
+	o := MakeOutboxSubmitter(fs)
+	o.MinDelay = 10 * time.Millisecond
+	o.Run()
+
+	for _, msg := range []string{"1", "2", "3"} {
+		err = o.Submit([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForCount(t, fs, 3)
+	if fmt.Sprint(fs.Received) != "[1 2 3]" {
+		t.Fatalf("wrong messages or order: %v", fs.Received)
+	}
+	o.Finish()
+	if !fs.Finished {
+		t.Fatal("wrapped submitter not finished")
+	}
+	n, err := sampledb.OutboxLen(sampledb.DefaultOutbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("%d messages left in outbox", n)
+	}
+
+	// messages not submitted before finishing are sent after a restart
+	fs = &flakySubmitter{
+		Failures: 1000,
+	}
+	o = MakeOutboxSubmitter(fs)
+	o.Run()
+	err = o.Submit([]byte("4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Finish()
+	fs = &flakySubmitter{}
+	o = MakeOutboxSubmitter(fs)
+	o.Run()
+	defer o.Finish()
+	waitForCount(t, fs, 1)
+	if fs.Received[0] != "4" {
+		t.Fatalf("wrong message %s", fs.Received[0])
+	}
+}
+
+func TestOutboxSweep(t *testing.T) {
+	dbdir, err := os.MkdirTemp("", "dbdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbdir)
+	err = sampledb.InitDB(dbdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	for i, reported := range []bool{true, false} {
+		err = sampledb.CreateSampleEntry(sampledb.FileVerdict{
+			Reported: reported,
+			Filename: fmt.Sprintf("file.%d", i),
+			Hashes: sampledb.HashInfo{
+				Sha512: fmt.Sprintf("hash%d", i),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := &flakySubmitter{}
+	o := MakeOutboxSubmitter(fs)
+	err = o.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Run()
+	defer o.Finish()
+	waitForCount(t, fs, 1)
+
+	fv, err := sampledb.GetSampleEntry("hash1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fv.Reported {
+		t.Fatal("resubmitted verdict not marked as reported")
+	}
+
+	// nothing left to sweep
+	err = o.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if fs.count() != 1 {
+		t.Fatalf("expected 1 resubmitted verdict, got %d", fs.count())
+	}
+}
+
+func TestOutboxDeadLetter(t *testing.T) {
+	dbdir, err := os.MkdirTemp("", "dbdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbdir)
+	err = sampledb.InitDB(dbdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	// the first message is rejected until it is given up on
+	fs := &flakySubmitter{
+		Failures: 3,
+	}
+	o := MakeOutboxSubmitter(fs)
+	o.MinDelay = 10 * time.Millisecond
+	o.MaxAttempts = 3
+	dead := metricOutboxDeadLetters.Value()
+	o.Run()
+	for _, msg := range []string{"1", "2"} {
+		err = o.Submit([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForCount(t, fs, 1)
+	if fs.Received[0] != "2" {
+		t.Fatalf("wrong message %s", fs.Received[0])
+	}
+	if metricOutboxDeadLetters.Value() != dead+1 {
+		t.Fatal("dead letter not counted")
+	}
+	o.Finish()
+
+	// dead letters are submitted again once requeued
+	fs = &flakySubmitter{}
+	o = MakeOutboxSubmitter(fs)
+	err = o.Requeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Run()
+	defer o.Finish()
+	waitForCount(t, fs, 1)
+	if fs.Received[0] != "1" {
+		t.Fatalf("wrong message %s", fs.Received[0])
+	}
+	n, err := sampledb.RequeueDeadLetters(sampledb.DefaultOutbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("%d dead letters left", n)
+	}
+}
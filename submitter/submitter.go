@@ -6,11 +6,7 @@ package submitter
 import (
 	"os"
 	"strings"
-	"sync"
-	"time"
 
-	"github.com/NeowayLabs/wabbit"
-	origamqp "github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -36,163 +32,46 @@ func getSensorID() (string, error) {
 	return strings.TrimSpace(string(b)), nil
 }
 
-const amqpReconnDelay = 2 * time.Second
-
 // Submitter is an interface for an entity that sends JSON data to an endpoint
 type Submitter interface {
 	Submit(jsonData []byte) error
 	Finish()
 }
 
-// AMQPSubmitter sends verdicts to a RabbitMQ exchange.
-type AMQPSubmitter struct {
-	URL              string
-	User             string
-	Pass             string
-	Exchange         string
-	Verbose          bool
-	Conn             wabbit.Conn
-	Channel          wabbit.Channel
-	StopReconnection chan bool
-	ChanMutex        sync.Mutex
-	ConnMutex        sync.Mutex
-	ErrorChan        chan wabbit.Error
-	Reconnector      func(string) (wabbit.Conn, string, error)
+// BatchSubmitter is a Submitter which can also take several messages at
+// once, e.g. to send them in one request. The outbox hands messages over in
+// batches of up to MaxBatchSize to such Submitters.
+type BatchSubmitter interface {
+	Submitter
+	// SubmitBatch submits all given messages, returning an error unless all
+	// of them were taken.
+	SubmitBatch(batch [][]byte) error
+	// MaxBatchSize returns the max number of messages SubmitBatch should be
+	// given at once.
+	MaxBatchSize() int
 }
 
-func reconnectOnFailure(s *AMQPSubmitter) {
-	for {
-		select {
-		case <-s.StopReconnection:
-			return
-		case rabbitErr := <-s.ErrorChan:
-			if rabbitErr != nil {
-				log.Warnf("RabbitMQ connection failed: %s", rabbitErr.Reason())
-				for {
-					time.Sleep(amqpReconnDelay)
-					connErr := s.connect()
-					if connErr != nil {
-						log.Warnf("RabbitMQ error: %s", connErr)
-					} else {
-						log.Infof("Reestablished connection to %s", s.URL)
-						s.ConnMutex.Lock()
-						s.Conn.NotifyClose(s.ErrorChan)
-						s.ConnMutex.Lock()
-						break
-					}
-				}
-			}
-		}
+// maxBatchSize returns the max number of messages s takes at once, which is
+// one unless it is a BatchSubmitter.
+func maxBatchSize(s Submitter) int {
+	if bs, ok := s.(BatchSubmitter); ok && bs.MaxBatchSize() > 1 {
+		return bs.MaxBatchSize()
 	}
+	return 1
 }
 
-func (s *AMQPSubmitter) connect() error {
-	var err error
-	var exchangeType string
-
-	s.ConnMutex.Lock()
-	s.Conn, exchangeType, err = s.Reconnector(s.URL)
-	s.ConnMutex.Unlock()
-	if err != nil {
-		return err
-	}
-	s.ChanMutex.Lock()
-	s.Channel, err = s.Conn.Channel()
-	s.ChanMutex.Unlock()
-	if err != nil {
-		s.ConnMutex.Lock()
-		s.Conn.Close()
-		s.ConnMutex.Unlock()
-		return err
+// submitBatch submits all messages of batch to s, at once if it is a
+// BatchSubmitter and one by one otherwise.
+func submitBatch(s Submitter, batch [][]byte) error {
+	if bs, ok := s.(BatchSubmitter); ok {
+		return bs.SubmitBatch(batch)
 	}
-	// We do not want to declare an exchange on non-default connection methods,
-	// as they may not support all exchange types. For instance amqptest does
-	// not support 'fanout'.
-	err = s.Channel.ExchangeDeclare(
-		s.Exchange,   // name
-		exchangeType, // type
-		wabbit.Option{
-			"durable":    true,
-			"autoDelete": false,
-			"internal":   false,
-			"noWait":     false,
-		},
-	)
-	if err != nil {
-		s.ChanMutex.Lock()
-		s.Channel.Close()
-		s.ChanMutex.Unlock()
-		s.ConnMutex.Lock()
-		s.Conn.Close()
-		s.ConnMutex.Unlock()
-		return err
-	}
-	log.Debugf("Submitter established connection to %s", s.URL)
-
-	return nil
-}
-
-// MakeAMQPSubmitterWithReconnector creates a new submitter connected to a
-// RabbitMQ server at the given URL, using the reconnector function as a means
-// to Dial() in order to obtain a Connection object.
-func MakeAMQPSubmitterWithReconnector(amqpURI string, amqpUser string,
-	amqpPass string, amqpExch string, verbose bool,
-	reconnector func(string) (wabbit.Conn, string, error)) (*AMQPSubmitter, error) {
-
-	mySubmitter := &AMQPSubmitter{
-		URL:              "amqp://" + amqpUser + ":" + amqpPass + "@" + amqpURI + "/",
-		Verbose:          verbose,
-		Reconnector:      reconnector,
-		User:             amqpUser,
-		Exchange:         amqpExch,
-		StopReconnection: make(chan bool),
-	}
-	if verbose {
-		log.Debugf("Initial connection to %s...", mySubmitter.URL)
-	}
-
-	mySubmitter.ErrorChan = make(chan wabbit.Error)
-	err := mySubmitter.connect()
-	if err != nil {
-		return nil, err
-	}
-	mySubmitter.Conn.NotifyClose(mySubmitter.ErrorChan)
-
-	go reconnectOnFailure(mySubmitter)
-
-	return mySubmitter, nil
-}
-
-// Submit sends the jsonData payload via the registered RabbitMQ connection.
-func (s *AMQPSubmitter) Submit(jsonData []byte) error {
-	s.ChanMutex.Lock()
-	err := s.Channel.Publish(
-		s.Exchange,   // exchange
-		"nightwatch", // routing key
-		jsonData,
-		wabbit.Option{
-			"contentType": "application/json",
-			"headers": origamqp.Table{
-				"sensor_id": SensorID,
-			},
-		})
-	s.ChanMutex.Unlock()
-	if err == nil {
-		if s.Verbose {
-			log.Debugf("RabbitMQ submission (%s) successful", s.URL)
+	for _, msg := range batch {
+		if err := s.Submit(msg); err != nil {
+			return err
 		}
-	} else {
-		log.Warnf("RabbitMQ submission not successful: %s", err.Error())
-	}
-	return err
-}
-
-// Finish cleans up the RMQ connection.
-func (s *AMQPSubmitter) Finish() {
-	close(s.StopReconnection)
-	if s.Verbose {
-		log.Debugf("Submitter closing connection...")
 	}
+	return nil
 }
 
 // DummySubmitter is a Submitter that just logs data to a logger.
@@ -0,0 +1,330 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+const (
+	syslogTimeout  = 5 * time.Second
+	syslogFacility = 16 // local0
+	syslogAppName  = "nightwatch"
+)
+
+// Version is the product version reported in CEF and LEEF headers.
+var Version = "1.0"
+
+// SyslogFormat is the format of the payload of syslog messages.
+type SyslogFormat string
+
+const (
+	// FormatCEF is the ArcSight Common Event Format.
+	FormatCEF SyslogFormat = "cef"
+	// FormatLEEF is the QRadar Log Event Extended Format, version 1.0.
+	FormatLEEF SyslogFormat = "leef"
+)
+
+// String returns the format name.
+func (f *SyslogFormat) String() string {
+	return string(*f)
+}
+
+// Set sets the format from its name.
+func (f *SyslogFormat) Set(s string) error {
+	switch SyslogFormat(s) {
+	case FormatCEF, FormatLEEF:
+		*f = SyslogFormat(s)
+		return nil
+	}
+	return fmt.Errorf("invalid syslog format: %s", s)
+}
+
+// SyslogSubmitter is a Submitter sending verdicts as RFC5424 syslog messages
+// with CEF or LEEF payload over UDP, TCP or a Unix datagram socket. Messages
+// sent over TCP are framed by octet counting as described in RFC6587.
+type SyslogSubmitter struct {
+	Network  string
+	Address  string
+	Format   SyslogFormat
+	Facility int
+	Hostname string
+	AppName  string
+	Conn     net.Conn
+	Lock     sync.Mutex
+}
+
+// MakeSyslogSubmitter returns a new SyslogSubmitter connected to the given
+// address. The network is udp, tcp or unix.
+func MakeSyslogSubmitter(network, address string, format SyslogFormat) (*SyslogSubmitter, error) {
+	switch network {
+	case "udp", "tcp", "unix":
+	default:
+		return nil, fmt.Errorf("invalid syslog network: %s", network)
+	}
+	if err := format.Set(string(format)); err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		hostname = "-"
+	}
+	s := &SyslogSubmitter{
+		Network:  network,
+		Address:  address,
+		Format:   format,
+		Facility: syslogFacility,
+		Hostname: hostname,
+		AppName:  syslogAppName,
+	}
+	err = s.connect()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SyslogSubmitter) connect() error {
+	network := s.Network
+	if network == "unix" {
+		// local syslog daemons listen on datagram sockets
+		network = "unixgram"
+	}
+	conn, err := net.DialTimeout(network, s.Address, syslogTimeout)
+	if err != nil {
+		return err
+	}
+	s.Conn = conn
+	return nil
+}
+
+// field is a key and value in a CEF extension or LEEF attribute list.
+type field struct {
+	Key   string
+	Value string
+}
+
+// verdictFields returns the values to be mapped to CEF and LEEF fields,
+// keyed by CEF name.
+func verdictFields(v *sampledb.FileVerdict) map[string]string {
+	f := map[string]string{
+		"deviceExternalId": v.SensorID,
+		"fname":            v.Filename,
+		"fileType":         v.Magic,
+		"fileHash":         v.Hashes.Sha256,
+		"md5":              v.Hashes.Md5,
+		"sha1":             v.Hashes.Sha1,
+		"suspiciousVia":    strings.Join(v.SuspiciousVia, ","),
+		"yaraRules":        strings.Join(v.MatchedRules(), ","),
+		"uploadLocation":   v.UploadLocation,
+	}
+	if v.Size > 0 {
+		f["fsize"] = strconv.FormatInt(v.Size, 10)
+	}
+	if e := v.Event; e != nil {
+		f["src"] = e.SrcIP
+		f["dst"] = e.DestIP
+		if e.SrcPort > 0 {
+			f["spt"] = strconv.Itoa(e.SrcPort)
+		}
+		if e.DestPort > 0 {
+			f["dpt"] = strconv.Itoa(e.DestPort)
+		}
+		f["proto"] = e.Proto
+		f["app"] = e.AppProto
+		if h := e.HTTP; h != nil {
+			f["dhost"] = h.Hostname
+			f["request"] = h.URL
+			f["requestMethod"] = h.Method
+			f["requestClientApplication"] = h.UserAgent
+		}
+	}
+	return f
+}
+
+// cefEscaper escapes CEF extension values.
+var cefEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+// cefHeaderEscaper escapes CEF header fields.
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+
+// CEF renders a verdict in Common Event Format.
+func CEF(v *sampledb.FileVerdict) string {
+	f := verdictFields(v)
+	sig, name, severity := "clean", "File scanned", "1"
+	if v.Suspicious {
+		sig, name, severity = "suspicious", "Suspicious file", "8"
+	}
+	ext := []field{
+		{"rt", strconv.FormatInt(v.Time.UnixMilli(), 10)},
+		{"deviceExternalId", f["deviceExternalId"]},
+		{"fname", f["fname"]},
+		{"fsize", f["fsize"]},
+		{"fileType", f["fileType"]},
+		{"fileHash", f["fileHash"]},
+		{"src", f["src"]},
+		{"spt", f["spt"]},
+		{"dst", f["dst"]},
+		{"dpt", f["dpt"]},
+		{"proto", f["proto"]},
+		{"app", f["app"]},
+		{"dhost", f["dhost"]},
+		{"request", f["request"]},
+		{"requestMethod", f["requestMethod"]},
+		{"requestClientApplication", f["requestClientApplication"]},
+	}
+	// hashes and scan results without standard fields go into custom ones
+	for i, custom := range []string{"md5", "sha1", "suspiciousVia", "yaraRules", "uploadLocation"} {
+		if len(f[custom]) > 0 {
+			n := strconv.Itoa(i + 1)
+			ext = append(ext, field{"cs" + n, f[custom]}, field{"cs" + n + "Label", custom})
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|DCSO|Nightwatch|%s|%s|%s|%s|", cefHeaderEscaper.Replace(Version),
+		sig, name, severity)
+	first := true
+	for _, e := range ext {
+		if len(e.Value) == 0 {
+			continue
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(e.Key + "=" + cefEscaper.Replace(e.Value))
+	}
+	return b.String()
+}
+
+// leefEscaper replaces characters which may not occur in LEEF values.
+var leefEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// LEEF renders a verdict in Log Event Extended Format 1.0.
+func LEEF(v *sampledb.FileVerdict) string {
+	f := verdictFields(v)
+	event, severity := "clean", "1"
+	if v.Suspicious {
+		event, severity = "suspicious", "8"
+	}
+	attrs := []field{
+		{"devTime", v.Time.UTC().Format("Jan 02 2006 15:04:05")},
+		{"sev", severity},
+		{"cat", event},
+		{"sensorID", f["deviceExternalId"]},
+		{"fileName", f["fname"]},
+		{"fileSize", f["fsize"]},
+		{"fileType", f["fileType"]},
+		{"md5", f["md5"]},
+		{"sha1", f["sha1"]},
+		{"sha256", f["fileHash"]},
+		{"src", f["src"]},
+		{"srcPort", f["spt"]},
+		{"dst", f["dst"]},
+		{"dstPort", f["dpt"]},
+		{"proto", f["proto"]},
+		{"appProto", f["app"]},
+		{"httpHost", f["dhost"]},
+		{"url", f["request"]},
+		{"httpMethod", f["requestMethod"]},
+		{"userAgent", f["requestClientApplication"]},
+		{"suspiciousVia", f["suspiciousVia"]},
+		{"yaraRules", f["yaraRules"]},
+		{"uploadLocation", f["uploadLocation"]},
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|DCSO|Nightwatch|%s|%s|", strings.ReplaceAll(Version, "|", ""), event)
+	first := true
+	for _, a := range attrs {
+		if len(a.Value) == 0 {
+			continue
+		}
+		if !first {
+			b.WriteByte('\t')
+		}
+		first = false
+		b.WriteString(a.Key + "=" + leefEscaper.Replace(a.Value))
+	}
+	return b.String()
+}
+
+// Message renders a verdict as RFC5424 syslog message.
+func (s *SyslogSubmitter) Message(v *sampledb.FileVerdict, now time.Time) string {
+	severity := 6 // informational
+	if v.Suspicious {
+		severity = 4 // warning
+	}
+	payload := CEF(v)
+	if s.Format == FormatLEEF {
+		payload = LEEF(v)
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %d verdict - %s", s.Facility*8+severity,
+		now.Format("2006-01-02T15:04:05.000000Z07:00"), s.Hostname, s.AppName,
+		os.Getpid(), payload)
+}
+
+func (s *SyslogSubmitter) write(msg []byte) error {
+	if s.Conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	s.Conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	_, err := s.Conn.Write(msg)
+	if err != nil {
+		s.Conn.Close()
+		s.Conn = nil
+	}
+	return err
+}
+
+// verdict parses the jsonData payload.
+func (s *SyslogSubmitter) verdict(jsonData []byte) (*sampledb.FileVerdict, error) {
+	var v sampledb.FileVerdict
+	err := json.Unmarshal(jsonData, &v)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Submit sends the verdict given as jsonData payload, reconnecting once if
+// sending fails.
+func (s *SyslogSubmitter) Submit(jsonData []byte) error {
+	v, err := s.verdict(jsonData)
+	if err != nil {
+		return err
+	}
+	msg := s.Message(v, time.Now())
+	if s.Network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	err = s.write([]byte(msg))
+	if err != nil {
+		err = s.write([]byte(msg))
+	}
+	return err
+}
+
+// Finish closes the connection.
+func (s *SyslogSubmitter) Finish() {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.Conn != nil {
+		s.Conn.Close()
+		s.Conn = nil
+	}
+}
@@ -0,0 +1,203 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+const testSyslogVerdict = `{"Suspicious":true,"SuspiciousVia":["YARA"],` +
+	`"Reasons":{"YARA":"{\"MatchedRules\":[\"Test_Rule\",\"Evil\"],\"RuleDetails\":{}}"},` +
+	`"SensorID":"sensor1","Time":"2025-01-02T03:04:05Z","Filename":"a=b.exe","Size":42,` +
+	`"Magic":"PE32 executable","Hashes":{"Md5":"m","Sha1":"s1","Sha256":"s256"},` +
+	`"Event":{"SrcIP":"10.0.0.1","SrcPort":80,"DestIP":"10.0.0.2","DestPort":1234,` +
+	`"Proto":"TCP","AppProto":"http","HTTP":{"Hostname":"example.com","URL":"/a?b=c",` +
+	`"Method":"GET","UserAgent":"curl"}}}`
+
+var syslogHeader = regexp.MustCompile(`^<(\d+)>1 \S+ \S+ nightwatch \d+ verdict - `)
+
+func testVerdict(t *testing.T) *sampledb.FileVerdict {
+	var s SyslogSubmitter
+	v, err := s.verdict([]byte(testSyslogVerdict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestSyslogCEF(t *testing.T) {
+	v := testVerdict(t)
+	expected := "CEF:0|DCSO|Nightwatch|" + Version + "|suspicious|Suspicious file|8|" +
+		"rt=1735787045000 deviceExternalId=sensor1 fname=a\\=b.exe fsize=42 " +
+		"fileType=PE32 executable fileHash=s256 src=10.0.0.1 spt=80 dst=10.0.0.2 " +
+		"dpt=1234 proto=TCP app=http dhost=example.com request=/a?b\\=c requestMethod=GET " +
+		"requestClientApplication=curl cs1=m cs1Label=md5 cs2=s1 cs2Label=sha1 " +
+		"cs3=YARA cs3Label=suspiciousVia cs4=Evil,Test_Rule cs4Label=yaraRules"
+	if cef := CEF(v); cef != expected {
+		t.Fatalf("unexpected CEF\n%s\nexpected\n%s", cef, expected)
+	}
+
+	v.Suspicious = false
+	v.Event = nil
+	if cef := CEF(v); !strings.HasPrefix(cef, "CEF:0|DCSO|Nightwatch|"+Version+"|clean|File scanned|1|") ||
+		strings.Contains(cef, "src=") {
+		t.Fatalf("unexpected CEF %s", cef)
+	}
+}
+
+func TestSyslogLEEF(t *testing.T) {
+	v := testVerdict(t)
+	v.Filename = "a\tb"
+	expected := "LEEF:1.0|DCSO|Nightwatch|" + Version + "|suspicious|" + strings.Join([]string{
+		"devTime=Jan 02 2025 03:04:05", "sev=8", "cat=suspicious", "sensorID=sensor1",
+		"fileName=a b", "fileSize=42", "fileType=PE32 executable", "md5=m", "sha1=s1",
+		"sha256=s256", "src=10.0.0.1", "srcPort=80", "dst=10.0.0.2", "dstPort=1234",
+		"proto=TCP", "appProto=http", "httpHost=example.com", "url=/a?b=c", "httpMethod=GET",
+		"userAgent=curl", "suspiciousVia=YARA", "yaraRules=Evil,Test_Rule"}, "\t")
+	if leef := LEEF(v); leef != expected {
+		t.Fatalf("unexpected LEEF\n%q\nexpected\n%q", leef, expected)
+	}
+}
+
+func checkSyslogMessage(t *testing.T, msg, prefix string) {
+	m := syslogHeader.FindStringSubmatch(msg)
+	if m == nil {
+		t.Fatalf("invalid syslog message %s", msg)
+	}
+	// local0.warning
+	if m[1] != "132" {
+		t.Fatalf("unexpected priority %s", m[1])
+	}
+	if !strings.HasPrefix(msg[len(m[0]):], prefix) {
+		t.Fatalf("unexpected payload %s", msg[len(m[0]):])
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s, err := MakeSyslogSubmitter("udp", conn.LocalAddr().String(), FormatLEEF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Finish()
+
+	err = s.Submit([]byte(testSyslogVerdict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSyslogMessage(t, string(buf[:n]), "LEEF:1.0|")
+
+	if s.Submit([]byte("no json")) == nil {
+		t.Fatal("invalid verdict accepted")
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	msgs := make(chan string)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					// octet counting framing
+					length, err := r.ReadString(' ')
+					if err != nil {
+						return
+					}
+					n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					buf := make([]byte, n)
+					if _, err := io.ReadFull(r, buf); err != nil {
+						return
+					}
+					msgs <- string(buf)
+				}
+			}(conn)
+		}
+	}()
+
+	s, err := MakeSyslogSubmitter("tcp", l.Addr().String(), FormatCEF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Finish()
+	for i := 0; i < 2; i++ {
+		err = s.Submit([]byte(testSyslogVerdict))
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-msgs:
+			checkSyslogMessage(t, msg, "CEF:0|")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for message")
+		}
+	}
+}
+
+func TestSyslogUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s, err := MakeSyslogSubmitter("unix", path, FormatCEF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Finish()
+
+	err = s.Submit([]byte(testSyslogVerdict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSyslogMessage(t, string(buf[:n]), "CEF:0|")
+
+	if _, err := MakeSyslogSubmitter("sctp", path, FormatCEF); err == nil {
+		t.Fatal("invalid network accepted")
+	}
+	if _, err := MakeSyslogSubmitter("unix", path, "json"); err == nil {
+		t.Fatal("invalid format accepted")
+	}
+}
@@ -0,0 +1,322 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	webhookTimeout     = 10 * time.Second
+	webhookMinDelay    = 1 * time.Second
+	webhookMaxDelay    = 1 * time.Minute
+	webhookMaxAttempts = 5
+)
+
+var (
+	// metricWebhookDelivered counts verdicts delivered to webhooks.
+	metricWebhookDelivered = expvar.NewInt("webhook_delivered")
+	// metricWebhookRetries counts failed webhook requests which were retried.
+	metricWebhookRetries = expvar.NewInt("webhook_retries")
+	// metricWebhookDeadLetters counts verdicts which could not be delivered
+	// to a webhook.
+	metricWebhookDeadLetters = expvar.NewInt("webhook_dead_letters")
+)
+
+// SignatureHeader is the request header carrying the HMAC-SHA256 signature
+// of the request body, as "sha256=" followed by the hex encoded MAC.
+const SignatureHeader = "X-Nightwatch-Signature"
+
+// HTTPHeaders is a set of request headers which can be given on the command
+// line, repeating the flag for each "Name: value" pair.
+type HTTPHeaders map[string]string
+
+// String returns the headers as a comma separated list.
+func (h *HTTPHeaders) String() string {
+	if h == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*h))
+	for k, v := range *h {
+		pairs = append(pairs, k+": "+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set adds a header given as "Name: value".
+func (h *HTTPHeaders) Set(s string) error {
+	k, v, ok := strings.Cut(s, ":")
+	k = strings.TrimSpace(k)
+	if !ok || len(k) == 0 || strings.ContainsAny(k, " \t") {
+		return fmt.Errorf("invalid header, need 'Name: value': %s", s)
+	}
+	if *h == nil {
+		*h = make(HTTPHeaders)
+	}
+	(*h)[http.CanonicalHeaderKey(k)] = strings.TrimSpace(v)
+	return nil
+}
+
+// webhookEndpoint is a URL verdicts are posted to.
+type webhookEndpoint struct {
+	URL  string
+	Name string
+}
+
+// WebhookSubmitter is a Submitter posting verdicts to one or more HTTP
+// endpoints. It is a BatchSubmitter, so the outbox hands over up to BatchSize
+// verdicts to be posted in one request. With a BatchSize of one, the request
+// body is the verdict itself, otherwise a JSON array of verdicts. Failed
+// requests are retried with exponential backoff up to MaxAttempts times,
+// after which the verdicts are written to DeadLetterDir, one per line, if
+// set. Submit only returns once the verdicts have been delivered to or dead
+// lettered for each endpoint.
+type WebhookSubmitter struct {
+	Endpoints     []*webhookEndpoint
+	Client        *http.Client
+	Secret        []byte
+	Headers       map[string]string
+	BatchSize     int
+	MaxAttempts   int
+	MinDelay      time.Duration
+	MaxDelay      time.Duration
+	DeadLetterDir string
+	Lock          sync.RWMutex
+	Running       bool
+	Finished      bool
+	Sends         sync.WaitGroup
+	StopChan      chan bool
+	ctx           context.Context
+	cancel        context.CancelFunc
+}
+
+var nonAlnum = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// MakeWebhookSubmitter returns a new WebhookSubmitter posting to the given
+// URLs.
+func MakeWebhookSubmitter(urls []string) (*WebhookSubmitter, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no webhook URL given")
+	}
+	s := &WebhookSubmitter{
+		Client:      &http.Client{Timeout: webhookTimeout},
+		BatchSize:   1,
+		MaxAttempts: webhookMaxAttempts,
+		MinDelay:    webhookMinDelay,
+		MaxDelay:    webhookMaxDelay,
+		StopChan:    make(chan bool),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid webhook URL: %s", RedactURL(rawURL))
+		}
+		s.Endpoints = append(s.Endpoints, &webhookEndpoint{
+			URL: rawURL,
+			// used in logs and dead letter file names, so leave out
+			// credentials and query parameters
+			Name: u.Host + u.Path,
+		})
+	}
+	return s, nil
+}
+
+// body returns the request body for a batch of verdicts.
+func (s *WebhookSubmitter) body(batch [][]byte) []byte {
+	if s.BatchSize <= 1 && len(batch) == 1 {
+		return batch[0]
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	buf.Write(bytes.Join(batch, []byte(",")))
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+// Sign returns the value of the signature header for the given body.
+func (s *WebhookSubmitter) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends a request, returning whether it may be retried if it failed.
+func (s *WebhookSubmitter) post(e *webhookEndpoint, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Nightwatch-Sensor", SensorID)
+	if len(s.Secret) > 0 {
+		req.Header.Set(SignatureHeader, s.Sign(body))
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %s", resp.Status)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout
+	return retry, err
+}
+
+// deliver posts a batch, retrying with backoff, and writes it to the dead
+// letter directory if that fails. It returns an error if the batch was
+// neither delivered nor written, or if delivery was interrupted by Finish.
+func (s *WebhookSubmitter) deliver(e *webhookEndpoint, batch [][]byte) error {
+	body := s.body(batch)
+	delay := s.MinDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(e, body)
+		if err == nil {
+			metricWebhookDelivered.Add(int64(len(batch)))
+			return nil
+		}
+		select {
+		case <-s.StopChan:
+			return fmt.Errorf("delivery to %s interrupted on shutdown: %w", e.Name, err)
+		default:
+		}
+		if !retry || attempt >= s.MaxAttempts {
+			log.Errorf("delivery of %d verdicts to %s failed after %d attempts: %s",
+				len(batch), e.Name, attempt, err)
+			return s.deadLetter(e, batch)
+		}
+		metricWebhookRetries.Add(1)
+		log.Warnf("delivery to %s failed, retrying in %v: %s", e.Name, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-s.StopChan:
+			return fmt.Errorf("delivery to %s interrupted on shutdown: %w", e.Name, err)
+		}
+		delay *= 2
+		if delay > s.MaxDelay {
+			delay = s.MaxDelay
+		}
+	}
+}
+
+// deadLetter writes verdicts which could not be delivered to a new file in
+// the dead letter directory.
+func (s *WebhookSubmitter) deadLetter(e *webhookEndpoint, batch [][]byte) error {
+	if len(s.DeadLetterDir) == 0 {
+		return fmt.Errorf("could not deliver %d verdicts to %s", len(batch), e.Name)
+	}
+	name := fmt.Sprintf("%s-%s.jsonl", time.Now().UTC().Format("20060102T150405.000000000"),
+		strings.Trim(nonAlnum.ReplaceAllString(e.Name, "_"), "_"))
+	path := filepath.Join(s.DeadLetterDir, name)
+	var buf bytes.Buffer
+	for _, msg := range batch {
+		buf.Write(msg)
+		buf.WriteByte('\n')
+	}
+	err := os.WriteFile(path+".tmp", buf.Bytes(), 0640)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %d verdicts for %s to dead letter directory: %w",
+			len(batch), e.Name, err)
+	}
+	metricWebhookDeadLetters.Add(int64(len(batch)))
+	log.Warnf("wrote %d verdicts for %s to %s", len(batch), e.Name, path)
+	return nil
+}
+
+// Run makes the submitter accept verdicts.
+func (s *WebhookSubmitter) Run() {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.Running = true
+}
+
+// Submit posts the jsonData payload to all endpoints, waiting until it has
+// been delivered to or dead lettered for each of them. It returns an error
+// if that failed for any endpoint, or if the submitter was finished in the
+// meantime, so the verdict is submitted again later. Endpoints which already
+// received it may then receive it twice.
+func (s *WebhookSubmitter) Submit(jsonData []byte) error {
+	return s.SubmitBatch([][]byte{jsonData})
+}
+
+// SubmitBatch posts all given payloads to all endpoints in one request each,
+// like Submit.
+func (s *WebhookSubmitter) SubmitBatch(batch [][]byte) error {
+	s.Lock.RLock()
+	ok := s.Running && !s.Finished
+	if ok {
+		s.Sends.Add(1)
+	}
+	s.Lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("webhook submitter not running")
+	}
+	defer s.Sends.Done()
+
+	errs := make([]error, len(s.Endpoints))
+	var wg sync.WaitGroup
+	for i, e := range s.Endpoints {
+		wg.Add(1)
+		go func(i int, e *webhookEndpoint) {
+			defer wg.Done()
+			errs[i] = s.deliver(e, batch)
+		}(i, e)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// MaxBatchSize returns BatchSize.
+func (s *WebhookSubmitter) MaxBatchSize() int {
+	return s.BatchSize
+}
+
+// Finish cancels requests in progress and waits for the submissions they
+// belong to, which are reported as failed.
+func (s *WebhookSubmitter) Finish() {
+	s.Lock.Lock()
+	if s.Finished {
+		s.Lock.Unlock()
+		return
+	}
+	s.Finished = true
+	s.Lock.Unlock()
+
+	close(s.StopChan)
+	s.cancel()
+	s.Sends.Wait()
+}
@@ -0,0 +1,262 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package submitter
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+// webhookServer records the bodies of requests, answering with the given
+// status codes in turn and with 200 once they are used up.
+type webhookServer struct {
+	*httptest.Server
+	t        *testing.T
+	Lock     sync.Mutex
+	Statuses []int
+	Bodies   []string
+	Headers  []http.Header
+}
+
+func makeWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	ws := &webhookServer{t: t, Statuses: statuses}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		ws.Lock.Lock()
+		defer ws.Lock.Unlock()
+		status := http.StatusOK
+		if len(ws.Statuses) > 0 {
+			status, ws.Statuses = ws.Statuses[0], ws.Statuses[1:]
+		}
+		if status == http.StatusOK {
+			ws.Bodies = append(ws.Bodies, string(body))
+			ws.Headers = append(ws.Headers, r.Header)
+		}
+		w.WriteHeader(status)
+	}))
+	return ws
+}
+
+func (ws *webhookServer) waitBodies(n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ws.Lock.Lock()
+		bodies := append([]string(nil), ws.Bodies...)
+		ws.Lock.Unlock()
+		if len(bodies) >= n {
+			return bodies
+		}
+		if time.Now().After(deadline) {
+			ws.t.Fatalf("timeout waiting for %d requests, got %d", n, len(bodies))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func makeTestWebhookSubmitter(t *testing.T, urls ...string) *WebhookSubmitter {
+	s, err := MakeWebhookSubmitter(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MinDelay = 10 * time.Millisecond
+	s.MaxDelay = 50 * time.Millisecond
+	s.DeadLetterDir = t.TempDir()
+	return s
+}
+
+func deadLetters(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, f := range files {
+		lines = append(lines, readLines(t, f)...)
+	}
+	return lines
+}
+
+func TestWebhookSubmitter(t *testing.T) {
+	ws1 := makeWebhookServer(t)
+	defer ws1.Close()
+	ws2 := makeWebhookServer(t)
+	defer ws2.Close()
+
+	s := makeTestWebhookSubmitter(t, ws1.URL+"/hook", ws2.URL)
+	s.Secret = []byte("secret")
+	var headers HTTPHeaders
+	if err := headers.Set("authorization: Bearer token"); err != nil {
+		t.Fatal(err)
+	}
+	if headers.Set("no header") == nil {
+		t.Fatal("invalid header accepted")
+	}
+	s.Headers = headers
+	s.Run()
+
+	err := s.Submit([]byte(`{"N":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ws := range []*webhookServer{ws1, ws2} {
+		bodies := ws.waitBodies(1)
+		if bodies[0] != `{"N":1}` {
+			t.Fatalf("unexpected body %s", bodies[0])
+		}
+		h := ws.Headers[0]
+		// signature of the body computed independently
+		if h.Get(SignatureHeader) != "sha256=b49f5475cd887663c731ae822cd00a57461e883f825a02e089cc68f3d4d5275c" {
+			t.Fatalf("unexpected signature %s", h.Get(SignatureHeader))
+		}
+		if h.Get("Authorization") != "Bearer token" || h.Get("Content-Type") != "application/json" ||
+			h.Get("X-Nightwatch-Sensor") != SensorID {
+			t.Fatalf("unexpected headers %v", h)
+		}
+	}
+	s.Finish()
+	if s.Submit([]byte(`{"N":2}`)) == nil {
+		t.Fatal("submission to finished submitter succeeded")
+	}
+	if _, err := MakeWebhookSubmitter([]string{"ftp://example.com"}); err == nil {
+		t.Fatal("invalid URL accepted")
+	}
+}
+
+func TestWebhookBatching(t *testing.T) {
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	ws := makeWebhookServer(t)
+	defer ws.Close()
+	s := makeTestWebhookSubmitter(t, ws.URL)
+	s.BatchSize = 3
+	s.Run()
+
+	// verdicts piling up in the outbox are posted in batches
+	o := MakeOutboxSubmitter(s)
+	for _, msg := range []string{`{"N":1}`, `{"N":2}`, `{"N":3}`, `{"N":4}`} {
+		if err := o.Submit([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.Run()
+	bodies := ws.waitBodies(2)
+	o.Finish()
+
+	var batch []map[string]int
+	if err := json.Unmarshal([]byte(bodies[0]), &batch); err != nil || len(batch) != 3 {
+		t.Fatalf("unexpected body %s", bodies[0])
+	}
+	if bodies[1] != `[{"N":4}]` {
+		t.Fatalf("unexpected body %s", bodies[1])
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	ws := makeWebhookServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests,
+		http.StatusOK, http.StatusBadRequest)
+	defer ws.Close()
+	s := makeTestWebhookSubmitter(t, ws.URL)
+	s.Run()
+
+	// delivered on the third attempt
+	err := s.Submit([]byte(`{"N":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.waitBodies(1)
+	// rejected without retrying
+	err = s.Submit([]byte(`{"N":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Submit([]byte(`{"N":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := ws.waitBodies(2)
+	s.Finish()
+
+	if strings.Join(bodies, ",") != `{"N":1},{"N":3}` {
+		t.Fatalf("unexpected bodies %v", bodies)
+	}
+	if lines := deadLetters(t, s.DeadLetterDir); strings.Join(lines, ",") != `{"N":2}` {
+		t.Fatalf("unexpected dead letters %v", lines)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	ws := makeWebhookServer(t, http.StatusInternalServerError, http.StatusInternalServerError,
+		http.StatusInternalServerError, http.StatusInternalServerError)
+	defer ws.Close()
+	s := makeTestWebhookSubmitter(t, ws.URL)
+	s.MaxAttempts = 2
+	s.Run()
+
+	// given up after two attempts
+	err := s.Submit([]byte(`{"N":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := deadLetters(t, s.DeadLetterDir); strings.Join(lines, ",") != `{"N":1}` {
+		t.Fatalf("unexpected dead letters %v", lines)
+	}
+	s.Finish()
+
+	// failed without dead letter directory
+	s = makeTestWebhookSubmitter(t, ws.URL)
+	s.MaxAttempts = 1
+	s.DeadLetterDir = ""
+	s.Run()
+	if s.Submit([]byte(`{"N":2}`)) == nil {
+		t.Fatal("undelivered verdict reported as submitted")
+	}
+	s.Finish()
+}
+
+func TestWebhookFinish(t *testing.T) {
+	ws := makeWebhookServer(t, http.StatusInternalServerError)
+	defer ws.Close()
+	s := makeTestWebhookSubmitter(t, ws.URL)
+	s.MinDelay = time.Hour
+	s.Run()
+
+	// interrupted on shutdown, without writing a dead letter
+	result := make(chan error)
+	go func() {
+		result <- s.Submit([]byte(`{"N":1}`))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	finished := make(chan bool)
+	go func() {
+		s.Finish()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout finishing submitter")
+	}
+	if <-result == nil {
+		t.Fatal("interrupted verdict reported as submitted")
+	}
+	if lines := deadLetters(t, s.DeadLetterDir); len(lines) > 0 {
+		t.Fatalf("unexpected dead letters %v", lines)
+	}
+}
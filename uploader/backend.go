@@ -0,0 +1,45 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ObjectInfo describes an object to be stored by a Backend.
+type ObjectInfo struct {
+	ContentType string
+	// Metadata is stored with the object if the backend supports it.
+	Metadata map[string]string
+}
+
+// Backend is a storage for uploaded samples and verdicts, addressed by
+// slash separated object keys.
+type Backend interface {
+	// Exists returns whether an object with the given key is stored.
+	Exists(ctx context.Context, key string) (bool, error)
+	// Put stores size bytes read from r under the given key, replacing any
+	// object stored there before. The reader is rewound if the request
+	// needs to be repeated.
+	Put(ctx context.Context, key string, r io.ReadSeeker, size int64, info ObjectInfo) error
+	// Location returns where the object with the given key is stored, as
+	// recorded in verdicts.
+	Location(key string) string
+	// Close releases the connections of the backend.
+	Close() error
+}
+
+// cleanKey returns the key as relative path which cannot point outside the
+// directory or collection the backend stores objects in.
+func cleanKey(key string) (string, error) {
+	clean := strings.TrimPrefix(path.Clean("/"+key), "/")
+	if len(clean) == 0 {
+		return "", fmt.Errorf("invalid object key: %q", key)
+	}
+	return clean, nil
+}
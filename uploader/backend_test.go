@@ -0,0 +1,104 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+// testBackend uploads a sample through an Uploader with the given backend,
+// using read to check the stored objects, and then uploads it again for
+// another verdict to check that both sample and verdict are skipped. The
+// sample database needs to be initialized.
+func testBackend(t *testing.T, backend Backend, read func(key string) ([]byte, error)) {
+	t.Helper()
+	indir := t.TempDir()
+	err := os.WriteFile(filepath.Join(indir, "sample"), []byte("foo bar"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultUploadConfig()
+	config.Key, err = ParseKey("sensor/{{.SensorID}}/{{.Hashes.Sha256}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &recordingSubmitter{}
+	u, err := MakeUploader(backend, indir, t.TempDir(), s, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	key := "sensor/s1/a256"
+	exists, err := backend.Exists(t.Context(), key)
+	if err != nil || exists {
+		t.Fatalf("unexpected existence of %s: %v %v", key, exists, err)
+	}
+	for _, hash := range []string{"a512", "b512"} {
+		err = u.Enqueue(sampledb.FileVerdict{
+			Suspicious: true,
+			SensorID:   "s1",
+			Hashes:     sampledb.HashInfo{Sha256: "a256", Sha512: hash},
+		}, filepath.Join(indir, "sample"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForJob(t, hash, sampledb.UploadDone)
+	}
+
+	data, err := read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "foo bar" {
+		t.Fatalf("unexpected sample %q", data)
+	}
+	data, err = read(key + ".verdict.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v sampledb.FileVerdict
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the verdict of the first upload was kept
+	if v.Hashes.Sha512 != "a512" {
+		t.Fatalf("unexpected verdict %s", data)
+	}
+	exists, err = backend.Exists(t.Context(), key)
+	if err != nil || !exists {
+		t.Fatalf("unexpected existence of %s: %v %v", key, exists, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.received) != 2 || !s.received[0].Uploaded || s.received[0].UploadLocation != backend.Location(key) {
+		t.Fatalf("unexpected submissions %+v", s.received)
+	}
+}
+
+func TestCleanKey(t *testing.T) {
+	for key, expected := range map[string]string{
+		"a/b":          "a/b",
+		"/a//b/":       "a/b",
+		"../../a":      "a",
+		"a/../../b/./": "b",
+	} {
+		clean, err := cleanKey(key)
+		if err != nil || clean != expected {
+			t.Errorf("unexpected key %q for %q: %v", clean, key, err)
+		}
+	}
+	for _, key := range []string{"", "/", ".."} {
+		if _, err := cleanKey(key); err == nil {
+			t.Errorf("invalid key %q accepted", key)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// LocalBackend stores objects as files in a local directory, which may be a
+// mounted network share such as NFS. Object keys are used as paths relative
+// to the directory; metadata is not stored.
+type LocalBackend struct {
+	// Dir is the directory files are stored in.
+	Dir string
+	// FileMode and DirMode are the permissions of created files and
+	// directories.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+}
+
+// MakeLocalBackend returns a new LocalBackend storing files in the given
+// directory. The directory needs to exist, so that samples are not written to
+// the local disk if a share is not mounted.
+func MakeLocalBackend(dir string) (*LocalBackend, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &LocalBackend{
+		Dir:      dir,
+		FileMode: 0640,
+		DirMode:  0750,
+	}, nil
+}
+
+func (b *LocalBackend) path(key string) (string, error) {
+	clean, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(b.Dir, filepath.FromSlash(clean)), nil
+}
+
+// Exists returns whether a file with the given key exists.
+func (b *LocalBackend) Exists(ctx context.Context, key string) (bool, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put writes the file with the given key, creating missing directories. The
+// content is written to a temporary file first, so that readers never see
+// partial files.
+func (b *LocalBackend) Put(ctx context.Context, key string, r io.ReadSeeker, size int64, info ObjectInfo) error {
+	p, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), b.DirMode)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, &contextReader{ctx: ctx, r: r})
+	if err == nil && n != size {
+		err = fmt.Errorf("wrote %d instead of %d bytes", n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(b.FileMode)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// Location returns the path of the file.
+func (b *LocalBackend) Location(key string) string {
+	p, err := b.path(key)
+	if err != nil {
+		return filepath.Join(b.Dir, key)
+	}
+	return p
+}
+
+// Close does nothing.
+func (b *LocalBackend) Close() error {
+	return nil
+}
+
+// contextReader stops reading once the context is done, so that copies can
+// be aborted on shutdown.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,64 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+func TestLocalBackend(t *testing.T) {
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	if _, err := MakeLocalBackend(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("missing directory accepted")
+	}
+	dir := t.TempDir()
+	backend, err := MakeLocalBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, backend, func(key string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(dir, key))
+	})
+	if backend.Location("sensor/s1/a256") != filepath.Join(dir, "sensor", "s1", "a256") {
+		t.Fatalf("unexpected location %s", backend.Location("sensor/s1/a256"))
+	}
+	fi, err := os.Stat(filepath.Join(dir, "sensor", "s1", "a256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("unexpected mode %v", fi.Mode())
+	}
+
+	// keys cannot point outside the directory
+	err = backend.Put(t.Context(), "../escape", bytes.NewReader([]byte("x")), 1, ObjectInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	// partial files are not kept
+	err = backend.Put(t.Context(), "short", bytes.NewReader([]byte("x")), 2, ObjectInfo{})
+	if err == nil {
+		t.Fatal("short write accepted")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected files %v", entries)
+	}
+}
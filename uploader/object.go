@@ -0,0 +1,119 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+// DefaultKey is the object key template used if no other one is configured,
+// storing samples in the bucket root named by their sha512 hash.
+const DefaultKey = "{{.Hashes.Sha512}}"
+
+var keyFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// ParseKey parses an object key template. The template is executed on the
+// verdict of each sample, so for instance
+//
+//	sensor/{{.SensorID}}/{{.Time.UTC.Format "2006/01/02"}}/{{.Hashes.Sha256}}
+//
+// stores samples by sensor and day. The functions lower and upper are
+// available. The verdict is stored next to the sample, with .verdict.json
+// appended to the key.
+func ParseKey(text string) (*template.Template, error) {
+	return template.New("key").Funcs(keyFuncs).Option("missingkey=error").Parse(text)
+}
+
+// objectKey returns the key of the sample with the given verdict.
+func (u *Uploader) objectKey(v *sampledb.FileVerdict) (string, error) {
+	tmpl := u.Config.Key
+	if tmpl == nil {
+		tmpl = template.Must(ParseKey(DefaultKey))
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, v)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimLeft(buf.String(), "/")
+	if len(key) == 0 {
+		return "", fmt.Errorf("empty object key for %s", v.Hashes.Sha512)
+	}
+	return key, nil
+}
+
+// metadataValue restricts s to the printable ASCII characters allowed in
+// HTTP headers.
+func metadataValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// objectMetadata returns the user metadata stored with the uploaded sample
+// and its verdict.
+func objectMetadata(v *sampledb.FileVerdict) map[string]string {
+	wrapping := v.UploadWrapping
+	if wrapping == WrapNone {
+		wrapping = "none"
+	}
+	meta := map[string]string{
+		"wrapping":       wrapping,
+		"sensor-id":      metadataValue(v.SensorID),
+		"suspicious-via": metadataValue(strings.Join(v.SuspiciousVia, ",")),
+	}
+	for name, hash := range map[string]string{
+		"md5":    v.Hashes.Md5,
+		"sha1":   v.Hashes.Sha1,
+		"sha256": v.Hashes.Sha256,
+		"sha512": v.Hashes.Sha512,
+	} {
+		if len(hash) > 0 {
+			meta[name] = hash
+		}
+	}
+	return meta
+}
+
+// Tags is a set of object tags which can be given on the command line,
+// repeating the flag for each key=value pair.
+type Tags map[string]string
+
+// String returns the tags as a comma separated list of key=value pairs.
+func (t *Tags) String() string {
+	if t == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*t))
+	for k, v := range *t {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set adds a tag given as key=value.
+func (t *Tags) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || len(k) == 0 {
+		return fmt.Errorf("invalid tag, need key=value: %s", s)
+	}
+	if *t == nil {
+		*t = make(Tags)
+	}
+	(*t)[k] = v
+	return nil
+}
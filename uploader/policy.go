@@ -0,0 +1,172 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"expvar"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+// metricPolicy counts the decisions of upload policies: samples uploaded as
+// suspicious or sampled, and clean samples not uploaded by the reason.
+var metricPolicy = expvar.NewMap("upload_policy")
+
+// Policy decides which samples are uploaded. Suspicious samples are always
+// uploaded. Of the other samples, the given percentage is picked at random
+// among those passing the filters, as long as the hourly budget allows. The
+// zero Policy uploads suspicious samples only.
+type Policy struct {
+	// Percent is the percentage of clean samples to upload.
+	Percent float64
+	// FirstSeen restricts the upload of clean samples to those whose hashes
+	// were not seen before.
+	FirstSeen bool
+	// Magic restricts the upload of clean samples to those whose file type
+	// as determined by libmagic contains one of these, ignoring case.
+	Magic []string
+	// MinSize and MaxSize restrict the upload of clean samples to those of
+	// the given size range, if not 0.
+	MinSize int64
+	MaxSize int64
+	// Budget is the number of bytes which may be uploaded per hour, 0 for no
+	// limit. Suspicious samples count towards the budget, but are uploaded
+	// even if it is exhausted; clean samples are only uploaded if it allows.
+	// The budget is refilled continuously, so that at most one hour's worth
+	// of uploads is sent at once. Samples which are selected but not uploaded
+	// after all, e.g. as they are present already, are given back.
+	Budget int64
+
+	lock       sync.Mutex
+	available  float64
+	lastRefill time.Time
+	now        func() time.Time
+	random     func() float64
+}
+
+// validate checks the settings of the policy.
+func (p *Policy) validate() error {
+	if p.Percent < 0 || p.Percent > 100 {
+		return fmt.Errorf("invalid upload percentage: %v", p.Percent)
+	}
+	if p.MinSize < 0 || p.MaxSize < 0 || (p.MaxSize > 0 && p.MinSize > p.MaxSize) {
+		return fmt.Errorf("invalid upload size range: %d-%d", p.MinSize, p.MaxSize)
+	}
+	if p.Budget < 0 {
+		return fmt.Errorf("invalid upload budget: %d", p.Budget)
+	}
+	return nil
+}
+
+// Select returns whether the sample with the given verdict is to be
+// uploaded. firstSeen is whether its hashes were not seen before.
+func (p *Policy) Select(v *sampledb.FileVerdict, firstSeen bool) bool {
+	if v.Suspicious {
+		p.spend(v.Size, true)
+		metricPolicy.Add("suspicious", 1)
+		return true
+	}
+	if p.Percent <= 0 {
+		return false
+	}
+	reason := p.filter(v, firstSeen)
+	if len(reason) == 0 && !p.pick() {
+		reason = "random"
+	}
+	if len(reason) == 0 && !p.spend(v.Size, false) {
+		reason = "budget"
+	}
+	if len(reason) > 0 {
+		metricPolicy.Add(reason, 1)
+		return false
+	}
+	metricPolicy.Add("sampled", 1)
+	return true
+}
+
+// filter returns why a clean sample is not eligible for upload, or an empty
+// string if it is.
+func (p *Policy) filter(v *sampledb.FileVerdict, firstSeen bool) string {
+	// partial samples are of no use for a corpus
+	if v.Truncated {
+		return "truncated"
+	}
+	if p.FirstSeen && !firstSeen {
+		return "seen"
+	}
+	if len(p.Magic) > 0 {
+		magic := strings.ToLower(v.Magic)
+		matched := false
+		for _, m := range p.Magic {
+			if strings.Contains(magic, strings.ToLower(m)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "magic"
+		}
+	}
+	if v.Size < p.MinSize || (p.MaxSize > 0 && v.Size > p.MaxSize) {
+		return "size"
+	}
+	return ""
+}
+
+func (p *Policy) pick() bool {
+	if p.Percent >= 100 {
+		return true
+	}
+	random := p.random
+	if random == nil {
+		random = rand.Float64
+	}
+	return random()*100 < p.Percent
+}
+
+// spend takes size bytes from the budget and returns true if they were
+// available. With force, they are taken even if not, delaying later clean
+// samples.
+func (p *Policy) spend(size int64, force bool) bool {
+	if p.Budget <= 0 {
+		return true
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now
+	if p.now != nil {
+		now = p.now
+	}
+	t := now()
+	if p.lastRefill.IsZero() {
+		p.available = float64(p.Budget)
+	} else {
+		p.available += t.Sub(p.lastRefill).Hours() * float64(p.Budget)
+		if p.available > float64(p.Budget) {
+			p.available = float64(p.Budget)
+		}
+	}
+	p.lastRefill = t
+	if !force && float64(size) > p.available {
+		return false
+	}
+	p.available -= float64(size)
+	return true
+}
+
+// refund gives size bytes taken by spend back to the budget, for samples which
+// were selected but not uploaded after all.
+func (p *Policy) refund(size int64) {
+	if p.Budget <= 0 {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.available = min(p.available+float64(size), float64(p.Budget))
+}
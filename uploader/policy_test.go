@@ -0,0 +1,118 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DCSO/nightwatch/sampledb"
+)
+
+func TestPolicy(t *testing.T) {
+	pe := sampledb.FileVerdict{Magic: "PE32 executable (GUI) Intel 80386, for MS Windows", Size: 1000}
+	suspicious := sampledb.FileVerdict{Suspicious: true, Magic: "data", Size: 5000}
+
+	// by default only suspicious samples are uploaded
+	var p Policy
+	if !p.Select(&suspicious, false) || p.Select(&pe, true) {
+		t.Fatal("unexpected default policy")
+	}
+
+	p = Policy{
+		Percent:   100,
+		FirstSeen: true,
+		Magic:     []string{"pe32", "ELF"},
+		MinSize:   100,
+		MaxSize:   2000,
+	}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Select(&pe, true) {
+		t.Fatal("eligible sample not selected")
+	}
+	for name, tc := range map[string]struct {
+		v         sampledb.FileVerdict
+		firstSeen bool
+	}{
+		"seen":      {pe, false},
+		"magic":     {sampledb.FileVerdict{Magic: "ASCII text", Size: 1000}, true},
+		"small":     {sampledb.FileVerdict{Magic: pe.Magic, Size: 10}, true},
+		"large":     {sampledb.FileVerdict{Magic: pe.Magic, Size: 3000}, true},
+		"truncated": {sampledb.FileVerdict{Magic: pe.Magic, Size: 1000, Truncated: true}, true},
+	} {
+		if p.Select(&tc.v, tc.firstSeen) {
+			t.Errorf("%s sample selected", name)
+		}
+	}
+	// filters do not apply to suspicious samples
+	if !p.Select(&suspicious, false) {
+		t.Fatal("suspicious sample not selected")
+	}
+
+	// samples are picked at random
+	p = Policy{Percent: 10}
+	p.random = func() float64 { return 0.05 }
+	if !p.Select(&pe, true) {
+		t.Fatal("sample not picked")
+	}
+	p.random = func() float64 { return 0.5 }
+	if p.Select(&pe, true) {
+		t.Fatal("sample picked")
+	}
+
+	for _, invalid := range []*Policy{{Percent: -1}, {Percent: 101}, {MinSize: 10, MaxSize: 5}, {Budget: -1}} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("invalid policy %+v accepted", invalid)
+		}
+	}
+}
+
+func TestPolicyBudget(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+	p := Policy{Percent: 100, Budget: 3000}
+	p.now = func() time.Time { return now }
+	pe := sampledb.FileVerdict{Magic: "PE32", Size: 1000}
+	suspicious := sampledb.FileVerdict{Suspicious: true, Size: 1500}
+
+	if !p.Select(&pe, true) || !p.Select(&pe, true) {
+		t.Fatal("samples within budget not selected")
+	}
+	// suspicious samples are uploaded beyond the budget
+	if !p.Select(&suspicious, true) {
+		t.Fatal("suspicious sample not selected")
+	}
+	if p.Select(&pe, true) {
+		t.Fatal("sample beyond budget selected")
+	}
+	// 1500 bytes are missing, refilled after 30 minutes
+	now = now.Add(29 * time.Minute)
+	if p.Select(&pe, true) {
+		t.Fatal("sample beyond budget selected")
+	}
+	now = now.Add(2 * time.Minute)
+	if !p.Select(&pe, true) {
+		t.Fatal("sample within refilled budget not selected")
+	}
+	// the budget does not accumulate beyond one hour
+	now = now.Add(10 * time.Hour)
+	for i := 0; i < 3; i++ {
+		if !p.Select(&pe, true) {
+			t.Fatalf("sample %d within budget not selected", i)
+		}
+	}
+	if p.Select(&pe, true) {
+		t.Fatal("sample beyond budget selected")
+	}
+	// budget given back is available again, up to one hour's worth
+	p.refund(1000)
+	if !p.Select(&pe, true) {
+		t.Fatal("sample within given back budget not selected")
+	}
+	p.refund(5000)
+	if p.available != 3000 {
+		t.Fatalf("budget exceeds one hour's worth: %v", p.available)
+	}
+}
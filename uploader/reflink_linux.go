@@ -0,0 +1,33 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink creates destPath as copy-on-write clone of srcPath, which is only
+// supported by some file systems such as Btrfs and XFS.
+func reflink(srcPath, destPath string) error {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlFileClone(int(destFile.Fd()), int(srcFile.Fd()))
+	if closeErr := destFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(destPath)
+	}
+	return err
+}
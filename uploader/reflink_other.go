@@ -0,0 +1,13 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+//go:build !linux
+
+package uploader
+
+import "errors"
+
+// reflink is not supported on this platform.
+func reflink(srcPath, destPath string) error {
+	return errors.New("reflinks not supported")
+}
@@ -0,0 +1,116 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// S3Credentials represents a set of data required to access an S3 resource.
+type S3Credentials struct {
+	Endpoint        string
+	AccessKey       string
+	SecretAccessKey string
+	// SessionToken is used with temporary access keys.
+	SessionToken string
+	BucketName   string
+	Region       string
+	// SharedCredentialsFile and Profile select the credentials to use from
+	// an AWS shared credentials file if no keys are given. They default to
+	// ~/.aws/credentials and the default profile.
+	SharedCredentialsFile string
+	Profile               string
+}
+
+// S3Backend stores objects in an S3 bucket.
+type S3Backend struct {
+	// Creds contains the required credentials for the S3 connection.
+	Creds S3Credentials
+	// UseSSL is true if SSL should be used for upload.
+	UseSSL bool
+	// Client is a Minio client connecting to the given endpoint.
+	Client *minio.Client
+	// PartSize is the size of the parts of multipart uploads.
+	PartSize uint64
+	// Tags are added to all stored objects.
+	Tags map[string]string
+	// SSE is the server-side encryption of stored objects, if any.
+	SSE encrypt.ServerSide
+	// StorageClass is the storage class of stored objects, the default of
+	// the bucket if empty.
+	StorageClass string
+}
+
+// MakeS3Backend returns a new S3Backend for the given credentials, storing
+// objects with the part size, tags, encryption and storage class given in
+// the config.
+func MakeS3Backend(creds S3Credentials, ssl bool, config UploadConfig) (*S3Backend, error) {
+	if config.PartSize != 0 && config.PartSize < MinPartSize {
+		return nil, fmt.Errorf("part size %d below minimum of %d", config.PartSize, MinPartSize)
+	}
+	client, err := minio.New(creds.Endpoint, &minio.Options{
+		Creds:  creds.Credentials(),
+		Secure: ssl,
+		Region: creds.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Backend{
+		Creds:        creds,
+		UseSSL:       ssl,
+		Client:       client,
+		PartSize:     config.PartSize,
+		Tags:         config.Tags,
+		SSE:          config.SSE,
+		StorageClass: config.StorageClass,
+	}, nil
+}
+
+// Exists returns whether an object with the given key is in the bucket.
+func (b *S3Backend) Exists(ctx context.Context, key string) (bool, error) {
+	var opts minio.StatObjectOptions
+	if b.SSE != nil && b.SSE.Type() == encrypt.SSEC {
+		// only needed to read objects encrypted with the client's key
+		opts.ServerSideEncryption = b.SSE
+	}
+	_, err := b.Client.StatObject(ctx, b.Creds.BucketName, key, opts)
+	if err != nil {
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Put stores an object in the bucket, with the metadata as user metadata.
+// Objects larger than PartSize are uploaded in parts.
+func (b *S3Backend) Put(ctx context.Context, key string, r io.ReadSeeker, size int64, info ObjectInfo) error {
+	_, err := b.Client.PutObject(ctx, b.Creds.BucketName, key, r, size, minio.PutObjectOptions{
+		ContentType:          info.ContentType,
+		UserMetadata:         info.Metadata,
+		UserTags:             b.Tags,
+		PartSize:             b.PartSize,
+		ServerSideEncryption: b.SSE,
+		StorageClass:         b.StorageClass,
+	})
+	return err
+}
+
+// Location returns the endpoint, bucket and key of the object.
+func (b *S3Backend) Location(key string) string {
+	return fmt.Sprintf("%s/%s/%s", b.Creds.Endpoint, b.Creds.BucketName, key)
+}
+
+// Close does nothing, as the client does not need to be closed.
+func (b *S3Backend) Close() error {
+	return nil
+}
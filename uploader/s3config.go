@@ -0,0 +1,89 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Server-side encryption modes for uploaded objects.
+const (
+	SSENone = ""
+	// SSES3 has objects encrypted with keys managed by the storage.
+	SSES3 = "s3"
+	// SSEKMS has objects encrypted with a key from the key management
+	// service of the storage.
+	SSEKMS = "kms"
+	// SSEC has objects encrypted with a key provided by the uploader, which
+	// is needed to read them again.
+	SSEC = "c"
+)
+
+// sseKeySize is the size of SSE-C keys.
+const sseKeySize = 32
+
+// MakeSSE returns the server-side encryption for the given mode, or nil for
+// SSENone. SSEKMS uses the key with the given ID, or the default key of the
+// storage if it is empty. SSEC reads the key from keyFile, containing the 32
+// key bytes either as they are or base64 encoded.
+func MakeSSE(mode, kmsKeyID, keyFile string) (encrypt.ServerSide, error) {
+	switch mode {
+	case SSENone, "none":
+		return nil, nil
+	case SSES3:
+		return encrypt.NewSSE(), nil
+	case SSEKMS:
+		return encrypt.NewSSEKMS(kmsKeyID, nil)
+	case SSEC:
+		if len(keyFile) == 0 {
+			return nil, fmt.Errorf("no key file given for SSE-C")
+		}
+		key, err := readSSEKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return encrypt.NewSSEC(key)
+	}
+	return nil, fmt.Errorf("invalid server-side encryption mode: %s", mode)
+}
+
+func readSSEKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == sseKeySize {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != sseKeySize {
+		return nil, fmt.Errorf("SSE-C key in %s is not %d bytes, raw or base64 encoded", path, sseKeySize)
+	}
+	return key, nil
+}
+
+// Credentials returns the credentials to access the bucket with. Keys given
+// explicitly take precedence. Otherwise, they are taken from the environment
+// (AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or MINIO_ROOT_USER and
+// MINIO_ROOT_PASSWORD) or the profile in the AWS shared credentials file,
+// in that order. If none of these are found, requests are anonymous.
+func (c *S3Credentials) Credentials() *credentials.Credentials {
+	if len(c.AccessKey) > 0 || len(c.SecretAccessKey) > 0 {
+		return credentials.NewStaticV4(c.AccessKey, c.SecretAccessKey, c.SessionToken)
+	}
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{
+			Filename: c.SharedCredentialsFile,
+			Profile:  c.Profile,
+		},
+	})
+}
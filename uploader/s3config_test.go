@@ -0,0 +1,204 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DCSO/nightwatch/sampledb"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+func TestMakeSSE(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{0x42}, sseKeySize)
+	rawPath := filepath.Join(dir, "raw")
+	b64Path := filepath.Join(dir, "b64")
+	shortPath := filepath.Join(dir, "short")
+	os.WriteFile(rawPath, key, 0600)
+	os.WriteFile(b64Path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	os.WriteFile(shortPath, []byte("c2hvcnQ="), 0600)
+
+	for _, mode := range []string{SSENone, "none"} {
+		sse, err := MakeSSE(mode, "", "")
+		if err != nil || sse != nil {
+			t.Fatalf("unexpected encryption for %q: %v %v", mode, sse, err)
+		}
+	}
+	sse, err := MakeSSE(SSES3, "", "")
+	if err != nil || sse.Type() != encrypt.S3 {
+		t.Fatalf("unexpected SSE-S3: %v %v", sse, err)
+	}
+	sse, err = MakeSSE(SSEKMS, "my-key", "")
+	if err != nil || sse.Type() != encrypt.KMS {
+		t.Fatalf("unexpected SSE-KMS: %v %v", sse, err)
+	}
+	for _, path := range []string{rawPath, b64Path} {
+		sse, err = MakeSSE(SSEC, "", path)
+		if err != nil || sse.Type() != encrypt.SSEC {
+			t.Fatalf("unexpected SSE-C from %s: %v %v", path, sse, err)
+		}
+		h := make(http.Header)
+		sse.Marshal(h)
+		if h.Get(encrypt.SseCustomerKey) != base64.StdEncoding.EncodeToString(key) {
+			t.Fatalf("unexpected key headers %v", h)
+		}
+	}
+	for _, path := range []string{"", shortPath, filepath.Join(dir, "missing")} {
+		if _, err = MakeSSE(SSEC, "", path); err == nil {
+			t.Errorf("invalid key file %q accepted", path)
+		}
+	}
+	if _, err = MakeSSE("foo", "", ""); err == nil {
+		t.Error("invalid mode accepted")
+	}
+}
+
+func TestS3Credentials(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY",
+		"AWS_SECRET_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_SHARED_CREDENTIALS_FILE",
+		"MINIO_ROOT_USER", "MINIO_ROOT_PASSWORD", "MINIO_ACCESS_KEY", "MINIO_SECRET_KEY"} {
+		t.Setenv(name, "")
+	}
+	credsFile := filepath.Join(t.TempDir(), "credentials")
+	err := os.WriteFile(credsFile, []byte(`[default]
+aws_access_key_id = DEFAULTKEY
+aws_secret_access_key = defaultsecret
+
+[nightwatch]
+aws_access_key_id = PROFILEKEY
+aws_secret_access_key = profilesecret
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(c S3Credentials, accessKey string) {
+		t.Helper()
+		v, err := c.Credentials().Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.AccessKeyID != accessKey {
+			t.Fatalf("unexpected access key %q instead of %q", v.AccessKeyID, accessKey)
+		}
+	}
+	check(S3Credentials{SharedCredentialsFile: credsFile + ".missing"}, "")
+	check(S3Credentials{SharedCredentialsFile: credsFile}, "DEFAULTKEY")
+	check(S3Credentials{SharedCredentialsFile: credsFile, Profile: "nightwatch"}, "PROFILEKEY")
+	t.Setenv("AWS_ACCESS_KEY_ID", "ENVKEY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+	check(S3Credentials{SharedCredentialsFile: credsFile}, "ENVKEY")
+	check(S3Credentials{AccessKey: "STATICKEY", SecretAccessKey: "staticsecret"}, "STATICKEY")
+}
+
+func TestUploadEncrypted(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_ACCESS_KEY", "")
+	t.Setenv("MINIO_ROOT_USER", "")
+	t.Setenv("MINIO_ACCESS_KEY", "")
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	credsFile := filepath.Join(t.TempDir(), "credentials")
+	err = os.WriteFile(credsFile, []byte("[nightwatch]\naws_access_key_id = FILEKEY\naws_secret_access_key = filesecret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var headHeader http.Header
+	puts := make(map[string]http.Header)
+	var apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.Method {
+		case http.MethodHead:
+			headHeader = r.Header
+			w.WriteHeader(http.StatusNotFound)
+		case http.MethodPut:
+			puts[r.URL.Path] = r.Header
+		}
+	}))
+	defer apiStub.Close()
+
+	indir := t.TempDir()
+	err = os.WriteFile(filepath.Join(indir, "sample"), []byte("foo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "ssec.key")
+	err = os.WriteFile(keyFile, bytes.Repeat([]byte{0x42}, sseKeySize), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, mode := range []string{SSES3, SSEC} {
+		config := DefaultUploadConfig()
+		config.StorageClass = "STANDARD_IA"
+		config.SSE, err = MakeSSE(mode, "", keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := MakeS3UploaderWithConfig(S3Credentials{
+			Endpoint:              strings.Replace(apiStub.URL, "http://", "", -1),
+			BucketName:            "incoming",
+			Region:                "TEST",
+			SharedCredentialsFile: credsFile,
+			Profile:               "nightwatch",
+		}, false, indir, t.TempDir(), nil, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := string(rune('a'+i)) + "512"
+		err = u.Enqueue(sampledb.FileVerdict{
+			Hashes: sampledb.HashInfo{Sha512: hash},
+		}, filepath.Join(indir, "sample"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForJob(t, hash, sampledb.UploadDone)
+		u.Stop()
+
+		lock.Lock()
+		for _, path := range []string{"/incoming/" + hash, "/incoming/" + hash + ".verdict.json"} {
+			h := puts[path]
+			if h == nil {
+				t.Fatalf("%s not uploaded", path)
+			}
+			if h.Get("X-Amz-Storage-Class") != "STANDARD_IA" ||
+				!strings.Contains(h.Get("Authorization"), "Credential=FILEKEY/") {
+				t.Fatalf("unexpected headers for %s: %v", path, h)
+			}
+			switch mode {
+			case SSES3:
+				if h.Get(encrypt.SseGenericHeader) != "AES256" {
+					t.Fatalf("no SSE-S3 for %s: %v", path, h)
+				}
+			case SSEC:
+				if h.Get(encrypt.SseCustomerAlgorithm) != "AES256" || h.Get(encrypt.SseCustomerKey) == "" {
+					t.Fatalf("no SSE-C for %s: %v", path, h)
+				}
+			}
+		}
+		// the key is needed to check for objects encrypted with it
+		if (headHeader.Get(encrypt.SseCustomerKey) != "") != (mode == SSEC) {
+			t.Fatalf("unexpected stat headers for %s: %v", mode, headHeader)
+		}
+		lock.Unlock()
+	}
+}
@@ -0,0 +1,242 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const sftpDialTimeout = 30 * time.Second
+
+// SFTPConfig contains the settings for connecting to an SFTP server.
+type SFTPConfig struct {
+	// Address is the host and port of the server, port 22 if not given.
+	Address string
+	User    string
+	// Password and the unencrypted private key in KeyFile are used to
+	// authenticate, whichever are given.
+	Password string
+	KeyFile  string
+	// KnownHostsFile contains the accepted host keys of the server,
+	// ~/.ssh/known_hosts if empty. With InsecureIgnoreHostKey, the host key
+	// is not checked at all.
+	KnownHostsFile        string
+	InsecureIgnoreHostKey bool
+	// Dir is the directory files are stored in, relative to the login
+	// directory unless absolute.
+	Dir string
+}
+
+// SFTPBackend stores objects as files on an SFTP server. Object keys are used
+// as paths relative to the configured directory; metadata is not stored. The
+// connection is established on first use and again after errors.
+type SFTPBackend struct {
+	Config       SFTPConfig
+	ClientConfig *ssh.ClientConfig
+	lock         sync.Mutex
+	conn         *ssh.Client
+	client       *sftp.Client
+}
+
+// MakeSFTPBackend returns a new SFTPBackend for the given settings. It does
+// not connect yet, so that uploads are retried if the server is not
+// available.
+func MakeSFTPBackend(config SFTPConfig) (*SFTPBackend, error) {
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		config.Address = net.JoinHostPort(config.Address, "22")
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:    config.User,
+		Timeout: sftpDialTimeout,
+	}
+	if len(config.Password) > 0 {
+		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(config.Password))
+	}
+	if len(config.KeyFile) > 0 {
+		key, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH key %s: %w", config.KeyFile, err)
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if len(clientConfig.Auth) == 0 {
+		return nil, fmt.Errorf("no SFTP password or key given")
+	}
+	if config.InsecureIgnoreHostKey {
+		log.Warn("not checking SFTP host key")
+		clientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		knownHosts := config.KnownHostsFile
+		if len(knownHosts) == 0 {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		callback, err := knownhosts.New(knownHosts)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.HostKeyCallback = callback
+	}
+	return &SFTPBackend{
+		Config:       config,
+		ClientConfig: clientConfig,
+	}, nil
+}
+
+// connect returns the current client, connecting if needed. The lock needs
+// to be held.
+func (b *SFTPBackend) connect() (*sftp.Client, error) {
+	if b.client != nil {
+		return b.client, nil
+	}
+	conn, err := ssh.Dial("tcp", b.Config.Address, b.ClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Debugf("connected to SFTP server %s", b.Config.Address)
+	b.conn = conn
+	b.client = client
+	return client, nil
+}
+
+// disconnect closes the connection, if any. The lock needs to be held.
+func (b *SFTPBackend) disconnect() error {
+	if b.client == nil {
+		return nil
+	}
+	b.client.Close()
+	err := b.conn.Close()
+	b.client = nil
+	b.conn = nil
+	return err
+}
+
+func (b *SFTPBackend) path(key string) (string, error) {
+	clean, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(b.Config.Dir, clean), nil
+}
+
+// Exists returns whether a file with the given key exists.
+func (b *SFTPBackend) Exists(ctx context.Context, key string) (bool, error) {
+	p, err := b.path(key)
+	if err != nil {
+		return false, err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	client, err := b.connect()
+	if err != nil {
+		return false, err
+	}
+	_, err = client.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		b.disconnect()
+		return false, err
+	}
+	return true, nil
+}
+
+// Put writes the file with the given key, creating missing directories. The
+// content is written to a temporary file first, so that readers never see
+// partial files.
+func (b *SFTPBackend) Put(ctx context.Context, key string, r io.ReadSeeker, size int64, info ObjectInfo) error {
+	p, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	client, err := b.connect()
+	if err != nil {
+		return err
+	}
+	err = b.put(ctx, client, p, r, size)
+	if err != nil {
+		b.disconnect()
+	}
+	return err
+}
+
+func (b *SFTPBackend) put(ctx context.Context, client *sftp.Client, p string, r io.Reader, size int64) error {
+	err := client.MkdirAll(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(p), "."+path.Base(p)+".part")
+	f, err := client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, &contextReader{ctx: ctx, r: r})
+	if err == nil && n != size {
+		err = fmt.Errorf("wrote %d instead of %d bytes", n, size)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return err
+	}
+	// plain SFTP renames fail if the target exists
+	if client.PosixRename(tmp, p) != nil {
+		client.Remove(p)
+		err = client.Rename(tmp, p)
+	}
+	return err
+}
+
+// Location returns the sftp URL of the file.
+func (b *SFTPBackend) Location(key string) string {
+	p, err := b.path(key)
+	if err != nil {
+		p = path.Join(b.Config.Dir, key)
+	}
+	u := url.URL{
+		Scheme: "sftp",
+		User:   url.User(b.Config.User),
+		Host:   b.Config.Address,
+		Path:   p,
+	}
+	return u.String()
+}
+
+// Close closes the connection to the server.
+func (b *SFTPBackend) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.disconnect()
+}
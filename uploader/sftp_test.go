@@ -0,0 +1,158 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DCSO/nightwatch/sampledb"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSFTPServer runs an SSH server on a local port which serves the given
+// directory via SFTP to user "user" with password "secret". It returns the
+// address of the server and a known_hosts file containing its key.
+func startSFTPServer(t *testing.T, root string) (string, string) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(pass) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config, root)
+		}
+	}()
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{l.Addr().String()}, signer.PublicKey())
+	err = os.WriteFile(knownHosts, []byte(line+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.Addr().String(), knownHosts
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig, root string) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				// the payload is the length-prefixed subsystem name
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(root))
+					if err != nil {
+						channel.Close()
+						return
+					}
+					server.Serve()
+					server.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTPBackend(t *testing.T) {
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	root := t.TempDir()
+	addr, knownHosts := startSFTPServer(t, root)
+
+	if _, err := MakeSFTPBackend(SFTPConfig{Address: addr, User: "user"}); err == nil {
+		t.Fatal("missing credentials accepted")
+	}
+	backend, err := MakeSFTPBackend(SFTPConfig{
+		Address:        addr,
+		User:           "user",
+		Password:       "secret",
+		KnownHostsFile: knownHosts,
+		Dir:            "samples",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, backend, func(key string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(root, "samples", key))
+	})
+	if backend.Location("sensor/s1/a256") != "sftp://user@"+addr+"/samples/sensor/s1/a256" {
+		t.Fatalf("unexpected location %s", backend.Location("sensor/s1/a256"))
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "samples", "sensor", "s1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected files %v", entries)
+	}
+
+	// servers with unknown host keys are rejected
+	otherAddr, _ := startSFTPServer(t, root)
+	other, err := MakeSFTPBackend(SFTPConfig{
+		Address:        otherAddr,
+		User:           "user",
+		Password:       "secret",
+		KnownHostsFile: knownHosts,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.Exists(t.Context(), "foo"); err == nil {
+		t.Fatal("unknown host key accepted")
+	}
+	other.Config.Address = addr
+	other.ClientConfig.Auth = []ssh.AuthMethod{ssh.Password("wrong")}
+	if _, err = other.Exists(t.Context(), "foo"); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+}
@@ -0,0 +1,97 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"bufio"
+	"expvar"
+	"io"
+	"os"
+)
+
+// metricStaged counts samples staged for upload by method (link, reflink,
+// copy or the name of the wrapping).
+var metricStaged = expvar.NewMap("upload_staged")
+
+// stage makes the sample at srcPath available for upload at destPath. If a
+// wrapper is given, the wrapped sample is written there, to be extracted as
+// name. Otherwise, if link is set, it is hard linked or, if that is not
+// possible, reflinked, so that it does not need to be copied but is kept
+// even if the original is removed. Otherwise, or if the scratch directory is
+// on another volume, the sample is copied. It returns the method used.
+func stage(srcPath, destPath string, link bool, wrapper Wrapper, name string) (string, error) {
+	// a previous copy of the same sample would prevent linking
+	os.Remove(destPath)
+	if wrapper != nil {
+		err := wrapFile(srcPath, destPath, wrapper, name)
+		if err != nil {
+			os.Remove(destPath)
+			return "", err
+		}
+		metricStaged.Add(wrapper.Name(), 1)
+		return wrapper.Name(), nil
+	}
+	if link {
+		if os.Link(srcPath, destPath) == nil {
+			metricStaged.Add("link", 1)
+			return "link", nil
+		}
+		if reflink(srcPath, destPath) == nil {
+			metricStaged.Add("reflink", 1)
+			return "reflink", nil
+		}
+	}
+	err := copyFile(srcPath, destPath)
+	if err != nil {
+		return "", err
+	}
+	metricStaged.Add("copy", 1)
+	return "copy", nil
+}
+
+func copyFile(srcPath, destPath string) error {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(destFile, srcFile)
+	if err == nil {
+		err = destFile.Sync()
+	}
+	if closeErr := destFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func wrapFile(srcPath, destPath string, wrapper Wrapper, name string) error {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(destFile)
+	err = wrapper.Wrap(bw, srcFile, name)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = destFile.Sync()
+	}
+	if closeErr := destFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStage(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "sample")
+	err := os.WriteFile(src, []byte("foo bar"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		link   bool
+		method string
+	}{
+		// source and scratch directory are on the same volume
+		{true, "link"},
+		{false, "copy"},
+	} {
+		dest := filepath.Join(dir, "staged-"+tc.method)
+		// stale copies are replaced
+		os.WriteFile(dest, []byte("old"), 0644)
+		method, err := stage(src, dest, tc.link, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if method != tc.method {
+			t.Fatalf("sample staged by %s instead of %s", method, tc.method)
+		}
+		srcInfo, _ := os.Stat(src)
+		destInfo, _ := os.Stat(dest)
+		if os.SameFile(srcInfo, destInfo) != tc.link {
+			t.Fatalf("%s: unexpected file identity", method)
+		}
+	}
+
+	// linked samples outlive the original
+	err = os.Remove(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "staged-link"))
+	if err != nil || string(data) != "foo bar" {
+		t.Fatalf("unexpected staged sample %q: %v", data, err)
+	}
+
+	if _, err := stage(src, filepath.Join(dir, "missing"), true, nil, ""); err == nil {
+		t.Fatal("missing sample staged")
+	}
+}
@@ -4,166 +4,423 @@
 package uploader
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
-	"io"
 	"os"
 	"path"
 	"regexp"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/DCSO/nightwatch/sampledb"
 	"github.com/DCSO/nightwatch/submitter"
 
-	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 	log "github.com/sirupsen/logrus"
 )
 
-// S3Credentials represents a set of data required to access an S3 resource.
-type S3Credentials struct {
-	Endpoint        string
-	AccessKey       string
-	SecretAccessKey string
-	BucketName      string
-	Region          string
+// metricSkipped counts samples not uploaded as they were already present.
+var metricSkipped = expvar.NewInt("upload_skipped")
+
+const (
+	uploadMinDelay  = 10 * time.Second
+	uploadMaxDelay  = 10 * time.Minute
+	uploadRetention = 24 * time.Hour
+	uploadAttempts  = 20
+	// MinPartSize is the smallest part size S3 accepts for multipart uploads.
+	MinPartSize = 5 * 1024 * 1024
+)
+
+// UploadConfig contains settings for how samples are uploaded.
+type UploadConfig struct {
+	// Link makes the uploader hard link or reflink samples into the scratch
+	// directory where possible, instead of copying them.
+	Link bool
+	// PartSize is the size of the parts of multipart uploads to S3. Samples
+	// larger than this are uploaded in parts.
+	PartSize uint64
+	// Wrapper protects samples before upload, if set. Wrapped samples are
+	// never linked.
+	Wrapper Wrapper
+	// Key is executed on the verdict of each sample to obtain its object
+	// key, DefaultKey if nil.
+	Key *template.Template
+	// SkipExisting avoids uploading samples already stored, e.g. by other
+	// sensors.
+	SkipExisting bool
+	// Policy decides which samples are uploaded, only suspicious ones if
+	// nil.
+	Policy *Policy
+	// Tags are added to all objects uploaded to S3, e.g. for lifecycle
+	// rules.
+	Tags map[string]string
+	// SSE is the server-side encryption of objects uploaded to S3, if any.
+	SSE encrypt.ServerSide
+	// StorageClass is the storage class of objects uploaded to S3, the
+	// default of the bucket if empty.
+	StorageClass string
+	// MinDelay and MaxDelay bound the delay before failed uploads are
+	// retried, ten seconds and ten minutes if not set.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// MaxAttempts is the number of failed attempts after which an upload is
+	// given up on, 0 for no limit.
+	MaxAttempts int
+	// Retention is how long jobs which are done or were given up on are
+	// kept in the database before they are removed, one day if not set.
+	Retention time.Duration
 }
 
-// UploadJob contains all data required to locate a file to be uploaded and its metadata.
-type UploadJob struct {
-	verdict          sampledb.FileVerdict
-	localFilePath    string
-	localVerdictPath string
+// DefaultUploadConfig returns the settings used if no other ones are given,
+// linking samples, uploading samples larger than 64 MB in parts, skipping
+// those already present under DefaultKey, retrying failed uploads after ten
+// seconds to ten minutes up to 20 times and keeping finished jobs for a day.
+func DefaultUploadConfig() UploadConfig {
+	return UploadConfig{
+		Link:         true,
+		PartSize:     64 * 1024 * 1024,
+		Key:          template.Must(ParseKey(DefaultKey)),
+		SkipExisting: true,
+		MinDelay:     uploadMinDelay,
+		MaxDelay:     uploadMaxDelay,
+		MaxAttempts:  uploadAttempts,
+		Retention:    uploadRetention,
+	}
 }
 
 // Uploader is a component that facilitates the queued upload of samples to a
-// S3 endpoint, for example for later inspection.
+// storage backend such as S3, for example for later inspection. Upload jobs
+// are kept in the sample database, so they survive restarts, and failed
+// uploads are retried with exponential backoff.
 type Uploader struct {
-	// Creds contains the required credentials for the S3 connection.
-	Creds S3Credentials
-	// UseSSL is true if SSL should be used for upload.
-	UseSSL bool
+	// Backend stores the uploaded samples and verdicts.
+	Backend Backend
 	// Where Suricata stores its extracted files.
 	FileBaseDir string
 	// Where the uploader queues files ready for upload.
 	ScratchDir string
-	// InChan is the channel to enqueue files for upload.
-	InChan chan UploadJob
+	// Config determines how samples are staged and uploaded.
+	Config UploadConfig
+	// NotifyChan is used to signal new upload jobs.
+	NotifyChan chan bool
+	// StopChan is used to request uploader shutdown.
+	StopChan chan bool
 	// CloseChan is used to signal uploader shutdown.
 	ClosedChan chan bool
-	// Client is a Minio client connecting to the given endpoint.
-	Client *minio.Client
+	StopOnce   sync.Once
+	// EnqueueLock serializes the creation of upload jobs.
+	EnqueueLock sync.Mutex
 	// Submitter is used to send verdicts after upload
 	Submitter submitter.Submitter
 }
 
 // Enqueue adds a new file to the set of files to be uploaded. It also records the metadata
-// given by the verdict.
+// given by the verdict. Files which are already queued, being uploaded or
+// waiting to be retried are skipped, keeping the verdict of the existing job.
+// The upload budget spent on files which are not queued is given back.
 func (u *Uploader) Enqueue(verdict sampledb.FileVerdict, localpath string) error {
-	srcFile, err := os.Open(localpath)
+	u.EnqueueLock.Lock()
+	defer u.EnqueueLock.Unlock()
+	queued := false
+	defer func() {
+		if !queued {
+			u.refund(&verdict)
+		}
+	}()
+	job, err := sampledb.GetUploadJob(verdict.Hashes.Sha512)
 	if err != nil {
 		return err
 	}
+	if len(job.State) > 0 && !job.Finished() {
+		log.Debugf("upload of %s already %s, skipping", verdict.Hashes.Sha512, job.State)
+		return nil
+	}
 
 	destPath := path.Join(u.ScratchDir, verdict.Hashes.Sha512)
-	destFile, err := os.Create(destPath)
+	name := verdict.Hashes.Sha256
+	if len(name) == 0 {
+		name = verdict.Hashes.Sha512
+	}
+	method, err := stage(localpath, destPath, u.Config.Link, u.Config.Wrapper, name)
 	if err != nil {
-		srcFile.Close()
 		return err
 	}
-
-	_, err = io.Copy(destFile, srcFile)
+	log.Debugf("staged %s for upload (%s)", localpath, method)
+	if u.Config.Wrapper != nil {
+		verdict.UploadWrapping = u.Config.Wrapper.Name()
+	}
+	// the key is fixed now, so that it does not change between attempts
+	key, err := u.objectKey(&verdict)
 	if err != nil {
-		srcFile.Close()
-		destFile.Close()
+		os.Remove(destPath)
 		return err
 	}
 
-	err = destFile.Sync()
+	err = sampledb.PutUploadJob(sampledb.UploadJob{
+		Verdict:   verdict,
+		LocalPath: destPath,
+		Key:       key,
+		State:     sampledb.UploadPending,
+	})
 	if err != nil {
-		srcFile.Close()
-		destFile.Close()
 		return err
 	}
+	queued = true
+	u.notify()
+	return nil
+}
+
+// ShouldUpload returns whether the sample with the given verdict is to be
+// uploaded according to the upload policy. firstSeen is whether its hashes
+// were not seen before.
+func (u *Uploader) ShouldUpload(verdict *sampledb.FileVerdict, firstSeen bool) bool {
+	if u.Config.Policy == nil {
+		return verdict.Suspicious
+	}
+	return u.Config.Policy.Select(verdict, firstSeen)
+}
+
+// refund gives the upload budget spent on the sample with the given verdict
+// back, as it is not uploaded after all.
+func (u *Uploader) refund(verdict *sampledb.FileVerdict) {
+	if u.Config.Policy != nil {
+		u.Config.Policy.refund(verdict.Size)
+	}
+}
+
+func (u *Uploader) notify() {
+	select {
+	case u.NotifyChan <- true:
+	default:
+	}
+}
+
+// backoff returns the delay before the next attempt of a job which failed
+// the given number of times.
+func (u *Uploader) backoff(attempts int) time.Duration {
+	d := u.Config.MinDelay
+	for i := 1; i < attempts && d < u.Config.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > u.Config.MaxDelay {
+		d = u.Config.MaxDelay
+	}
+	return d
+}
 
-	srcFile.Close()
-	destFile.Close()
+// upload stores the sample and its verdict, returning the key of the
+// sample and whether it was present already. Samples already present are not
+// uploaded again if SkipExisting is set, and neither are their verdicts, so that the verdict stored by the
+// sensor which uploaded the sample first is kept. A verdict missing next to
+// an existing sample, e.g. after an interrupted upload, is stored though.
+func (u *Uploader) upload(ctx context.Context, job *sampledb.UploadJob) (string, bool, error) {
+	key := job.Key
+	if len(key) == 0 {
+		// jobs created by previous versions
+		var err error
+		key, err = u.objectKey(&job.Verdict)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	verdictKey := key + ".verdict.json"
+	meta := objectMetadata(&job.Verdict)
 
-	var outJSON []byte
-	verdictPath := path.Join(u.ScratchDir, fmt.Sprintf("%s.verdict.json", verdict.Hashes.Sha512))
-	outJSON, err = json.Marshal(verdict)
+	// upload sample
+	exists := false
+	if u.Config.SkipExisting {
+		var err error
+		exists, err = u.Backend.Exists(ctx, key)
+		if err != nil {
+			log.Debugf("could not check for %s, uploading: %s", key, err)
+		}
+	}
+	if exists {
+		metricSkipped.Add(1)
+		log.Infof("%s already uploaded, skipping", key)
+	} else {
+		log.Debugf("uploading %s to %s", job.LocalPath, u.Backend.Location(key))
+		size, err := u.putFile(ctx, key, job.LocalPath, ObjectInfo{
+			ContentType: ContentType(job.Verdict.UploadWrapping),
+			Metadata:    meta,
+		})
+		if err != nil {
+			return "", false, fmt.Errorf("upload of %s failed: %w", key, err)
+		}
+		log.Infof("successfully uploaded %s (size %d)", key, size)
+	}
+
+	// upload verdict JSON
+	if exists {
+		verdictExists, err := u.Backend.Exists(ctx, verdictKey)
+		if err != nil {
+			log.Debugf("could not check for %s, uploading: %s", verdictKey, err)
+		}
+		if verdictExists {
+			log.Infof("%s already uploaded, skipping", verdictKey)
+			return key, exists, nil
+		}
+	}
+	verdictJSON, err := json.Marshal(job.Verdict)
 	if err != nil {
-		return err
+		return "", false, err
 	}
-	err = os.WriteFile(verdictPath, outJSON, 0644)
+	log.Debugf("uploading verdict to %s", u.Backend.Location(verdictKey))
+	err = u.Backend.Put(ctx, verdictKey, bytes.NewReader(verdictJSON), int64(len(verdictJSON)),
+		ObjectInfo{
+			ContentType: "application/json",
+			Metadata:    meta,
+		})
 	if err != nil {
-		return err
+		return "", false, fmt.Errorf("upload of %s failed: %w", verdictKey, err)
 	}
+	log.Infof("successfully uploaded %s (size %d)", verdictKey, len(verdictJSON))
+	return key, exists, nil
+}
 
-	u.InChan <- UploadJob{
-		verdict:          verdict,
-		localFilePath:    destPath,
-		localVerdictPath: verdictPath,
+// putFile stores the local file under the given key and returns its size.
+func (u *Uploader) putFile(ctx context.Context, key, localPath string, info ObjectInfo) (int64, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), u.Backend.Put(ctx, key, f, fi.Size(), info)
 }
 
-func (u *Uploader) processUpload() {
-	for file := range u.InChan {
-		verdictFileName := fmt.Sprintf("%s.verdict.json", file.verdict.Hashes.Sha512)
-		sampleFileName := file.verdict.Hashes.Sha512
-
-		// upload sample
-		log.Debugf("bucket %s object '%s' localpath %s", u.Creds.BucketName, sampleFileName,
-			file.localFilePath)
-		size, err := u.Client.FPutObject(u.Creds.BucketName, sampleFileName,
-			file.localFilePath, minio.PutObjectOptions{
-				ContentType: "application/octet-stream",
-			})
-		if err != nil {
-			log.Errorf("upload of %s failed: %s ", sampleFileName, err)
-			continue
+// process attempts the given job and records the outcome in the database.
+func (u *Uploader) process(ctx context.Context, job sampledb.UploadJob) {
+	job.State = sampledb.UploadUploading
+	job.Attempts++
+	err := sampledb.PutUploadJob(job)
+	if err != nil {
+		log.Errorf("could not update upload job %s: %s", job.Verdict.Hashes.Sha512, err)
+		return
+	}
+
+	key, skipped, err := u.upload(ctx, &job)
+	if err != nil {
+		job.State = sampledb.UploadFailed
+		job.LastError = err.Error()
+		if _, statErr := os.Stat(job.LocalPath); os.IsNotExist(statErr) {
+			// retrying would not help, give up on the job
+			job.NextAttempt = time.Time{}
+			job.Expires = time.Now().Add(u.Config.Retention)
+			log.Errorf("giving up upload of %s, local file is gone: %s", job.Verdict.Hashes.Sha512, err)
+		} else if u.Config.MaxAttempts > 0 && job.Attempts >= u.Config.MaxAttempts {
+			job.NextAttempt = time.Time{}
+			job.Expires = time.Now().Add(u.Config.Retention)
+			log.Errorf("giving up upload of %s after %d attempts: %s", job.Verdict.Hashes.Sha512, job.Attempts, err)
+			if rmErr := os.Remove(job.LocalPath); rmErr != nil {
+				log.Errorf("could not remove staged file %s: %s", job.LocalPath, rmErr)
+			}
 		} else {
-			log.Infof("successfully uploaded %s (size %d)", sampleFileName, size)
+			delay := u.backoff(job.Attempts)
+			job.NextAttempt = time.Now().Add(delay)
+			log.Warnf("%s, retrying in %v (attempt %d)", err, delay, job.Attempts)
 		}
+		err = sampledb.PutUploadJob(job)
+		if err != nil {
+			log.Errorf("could not update upload job %s: %s", job.Verdict.Hashes.Sha512, err)
+		}
+		return
+	}
 
-		// upload verdict JSON
-		log.Infof("bucket %s object '%s' localpath %s", u.Creds.BucketName, verdictFileName,
-			file.localVerdictPath)
-		size, err = u.Client.FPutObject(u.Creds.BucketName, verdictFileName,
-			file.localVerdictPath, minio.PutObjectOptions{
-				ContentType: "application/json",
-			})
+	err = os.Remove(job.LocalPath)
+	if err != nil {
+		log.Errorf("could not remove uploaded file %s: %s", job.LocalPath, err)
+	}
+	if skipped {
+		u.refund(&job.Verdict)
+	}
+
+	// submit JSON with added location of sample
+	job.Verdict.Uploaded = true
+	job.Verdict.UploadLocation = u.Backend.Location(key)
+	job.State = sampledb.UploadDone
+	job.NextAttempt = time.Time{}
+	job.Expires = time.Now().Add(u.Config.Retention)
+	job.LastError = ""
+	err = sampledb.PutUploadJob(job)
+	if err != nil {
+		log.Errorf("could not update upload job %s: %s", job.Verdict.Hashes.Sha512, err)
+	}
+	if u.Submitter != nil {
+		var submitJSON []byte
+		submitJSON, err = json.Marshal(job.Verdict)
 		if err != nil {
-			log.Errorf("upload of %s failed: %s ", verdictFileName, err)
-			continue
-		} else {
-			log.Infof("successfully uploaded %s (size %d)", verdictFileName, size)
-			err = os.Remove(file.localFilePath)
-			if err != nil {
-				log.Errorf("could not remove uploaded file %s: %s", file.localFilePath, err)
-			}
-			err = os.Remove(file.localVerdictPath)
-			if err != nil {
-				log.Errorf("could not remove uploaded file %s: %s", file.localVerdictPath, err)
-			}
+			log.Error(err)
+		} else if err = u.Submitter.Submit(submitJSON); err != nil {
+			log.Errorf("submission of uploaded verdict failed: %s", err)
 		}
+	}
+}
 
-		// submit JSON with added location of sample
-		file.verdict.Uploaded = true
-		file.verdict.UploadLocation = fmt.Sprintf("%s/%s/%s", u.Creds.Endpoint, u.Creds.BucketName, file.verdict.Hashes.Sha512)
-		if u.Submitter != nil {
-			var submitJSON []byte
-			submitJSON, err = json.Marshal(file.verdict)
+// processDue attempts all jobs which are due, removes finished jobs which
+// have expired and returns the time until the next job is due, at most
+// MaxDelay.
+func (u *Uploader) processDue(ctx context.Context) time.Duration {
+	wait := u.Config.MaxDelay
+	jobs, next, err := sampledb.DueUploadJobs(time.Now())
+	if err != nil {
+		log.Errorf("could not read upload jobs: %s", err)
+		return u.Config.MinDelay
+	}
+	for _, job := range jobs {
+		select {
+		case <-u.StopChan:
+			return 0
+		default:
+		}
+		if job.Finished() {
+			err = sampledb.DeleteUploadJob(job.Verdict.Hashes.Sha512)
 			if err != nil {
-				log.Error(err)
-			} else {
-				u.Submitter.Submit(submitJSON)
+				log.Errorf("could not remove upload job %s: %s", job.Verdict.Hashes.Sha512, err)
 			}
+			continue
+		}
+		u.process(ctx, job)
+		// failed jobs are retried after MinDelay at the earliest
+		wait = min(wait, u.Config.MinDelay)
+	}
+	if !next.IsZero() {
+		wait = min(wait, time.Until(next))
+	}
+	return wait
+}
+
+func (u *Uploader) processUpload() {
+	defer close(u.ClosedChan)
+	// abort running uploads on shutdown, to be resumed later
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-u.StopChan
+		cancel()
+	}()
+	for {
+		wait := u.processDue(ctx)
+		select {
+		case <-u.NotifyChan:
+		case <-time.After(wait):
+		case <-u.StopChan:
+			return
 		}
 	}
-	close(u.ClosedChan)
 }
 
-func (u *Uploader) enqueueBacklog() error {
+// importScratchDir creates upload jobs for the files queued in the scratch
+// directory by previous versions, which stored the verdict of each sample
+// next to it.
+func (u *Uploader) importScratchDir() error {
 	re := regexp.MustCompile(`.+\.verdict\.json$`)
 	files, err := os.ReadDir(u.ScratchDir)
 	if err != nil {
@@ -173,26 +430,27 @@ func (u *Uploader) enqueueBacklog() error {
 	for _, f := range files {
 		if re.Match([]byte(f.Name())) {
 			var verdict sampledb.FileVerdict
-			jsonFile, err := os.Open(path.Join(u.ScratchDir, f.Name()))
+			verdictPath := path.Join(u.ScratchDir, f.Name())
+			byteValue, err := os.ReadFile(verdictPath)
 			if err != nil {
 				return err
 			}
-			byteValue, _ := io.ReadAll(jsonFile)
-			jsonFile.Close()
 			err = json.Unmarshal(byteValue, &verdict)
 			if err != nil {
 				return err
 			}
-			fi, err := f.Info()
-			var size = 0
+			log.Debugf("importing scratch file %s", f.Name())
+			err = sampledb.PutUploadJob(sampledb.UploadJob{
+				Verdict:   verdict,
+				LocalPath: path.Join(u.ScratchDir, verdict.Hashes.Sha512),
+				State:     sampledb.UploadPending,
+			})
 			if err != nil {
-				size = int(fi.Size())
+				return err
 			}
-			log.Debugf("enqueuing scratch file %s, %d bytes", f.Name(), size)
-			u.InChan <- UploadJob{
-				verdict:          verdict,
-				localFilePath:    path.Join(u.ScratchDir, verdict.Hashes.Sha512),
-				localVerdictPath: path.Join(u.ScratchDir, f.Name()),
+			err = os.Remove(verdictPath)
+			if err != nil {
+				return err
 			}
 		}
 	}
@@ -200,39 +458,82 @@ func (u *Uploader) enqueueBacklog() error {
 	return nil
 }
 
-// MakeS3Uploader returns a new Uploader for the given credentials and environment settings.
-// If a submitter is given, it will be used to submit the verdict metadata for each queued
-// file as well.
-func MakeS3Uploader(creds S3Credentials, ssl bool, basedir string, scratchdir string,
-	submitter submitter.Submitter) (*Uploader, error) {
+// MakeUploader returns a new Uploader storing samples in the given backend,
+// staging and uploading them according to the given config. If a submitter
+// is given, it will be used to submit the verdict metadata for each queued
+// file as well. The sample database needs to be initialized.
+func MakeUploader(backend Backend, basedir string, scratchdir string,
+	submitter submitter.Submitter, config UploadConfig) (*Uploader, error) {
+	if config.Policy != nil {
+		if err := config.Policy.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.MinDelay <= 0 {
+		config.MinDelay = uploadMinDelay
+	}
+	if config.MaxDelay < config.MinDelay {
+		config.MaxDelay = max(uploadMaxDelay, config.MinDelay)
+	}
+	if config.Retention <= 0 {
+		config.Retention = uploadRetention
+	}
 	uploader := &Uploader{
-		Creds:       creds,
-		UseSSL:      ssl,
+		Backend:     backend,
 		FileBaseDir: basedir,
 		ScratchDir:  scratchdir,
+		Config:      config,
+		NotifyChan:  make(chan bool, 1),
+		StopChan:    make(chan bool),
 		ClosedChan:  make(chan bool),
-		InChan:      make(chan UploadJob, 10000),
 		Submitter:   submitter,
 	}
 
-	client, err := minio.New(creds.Endpoint, creds.AccessKey, creds.SecretAccessKey, ssl)
+	err := uploader.importScratchDir()
 	if err != nil {
 		return nil, err
 	}
-	uploader.Client = client
-
-	err = uploader.enqueueBacklog()
+	// uploads interrupted by a restart are started over
+	n, err := sampledb.ResetUploadJobs()
 	if err != nil {
 		return nil, err
 	}
+	if n > 0 {
+		log.Infof("restarting %d interrupted uploads", n)
+	}
 
 	go uploader.processUpload()
 
 	return uploader, nil
 }
 
-// Stop causes the uploader to cease processing enqueued files.
+// MakeS3Uploader returns a new Uploader for the given credentials and environment settings.
+// If a submitter is given, it will be used to submit the verdict metadata for each queued
+// file as well. The sample database needs to be initialized.
+func MakeS3Uploader(creds S3Credentials, ssl bool, basedir string, scratchdir string,
+	submitter submitter.Submitter) (*Uploader, error) {
+	return MakeS3UploaderWithConfig(creds, ssl, basedir, scratchdir, submitter, DefaultUploadConfig())
+}
+
+// MakeS3UploaderWithConfig returns a new Uploader like MakeS3Uploader,
+// staging and uploading samples according to the given config.
+func MakeS3UploaderWithConfig(creds S3Credentials, ssl bool, basedir string, scratchdir string,
+	submitter submitter.Submitter, config UploadConfig) (*Uploader, error) {
+	backend, err := MakeS3Backend(creds, ssl, config)
+	if err != nil {
+		return nil, err
+	}
+	return MakeUploader(backend, basedir, scratchdir, submitter, config)
+}
+
+// Stop causes the uploader to cease processing upload jobs. Jobs not done
+// yet are resumed by the next Uploader.
 func (u *Uploader) Stop() {
-	close(u.InChan)
-	<-u.ClosedChan
+	u.StopOnce.Do(func() {
+		close(u.StopChan)
+		<-u.ClosedChan
+		if err := u.Backend.Close(); err != nil {
+			log.Errorf("could not close upload backend: %s", err)
+		}
+	})
 }
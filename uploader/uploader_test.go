@@ -4,6 +4,9 @@
 package uploader
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -11,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -24,6 +28,26 @@ var regionReturn = `
 <LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">TEST</LocationConstraint>
 `
 
+// waitForJob waits until the upload job for the given hash reaches the given
+// state.
+func waitForJob(t *testing.T, hash string, state sampledb.UploadState) sampledb.UploadJob {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		job, err := sampledb.GetUploadJob(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State == state {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upload job %s in state %q instead of %q", hash, job.State, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestUpload(t *testing.T) {
 	hasFile := false
 	hasVerdict := false
@@ -31,6 +55,11 @@ func TestUpload(t *testing.T) {
 	s := submitter.MakeDummySubmitter()
 
 	var apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// no object exists yet
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		buf, _ := io.ReadAll(r.Body)
 		if strings.Contains(r.URL.String(), "12345.verdict.json") {
 			w.WriteHeader(http.StatusOK)
@@ -55,6 +84,12 @@ func TestUpload(t *testing.T) {
 	}))
 	defer apiStub.Close()
 
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
 	indir, err := os.MkdirTemp("", "indir")
 	if err != nil {
 		t.Fatal(err)
@@ -97,6 +132,7 @@ func TestUpload(t *testing.T) {
 		Size:          8,
 	}, filepath.Join(indir, "file.2"))
 
+	waitForJob(t, "12345", sampledb.UploadDone)
 	u.Stop()
 
 	os.RemoveAll(indir)
@@ -114,6 +150,11 @@ func TestUploaderBacklog(t *testing.T) {
 	s := submitter.MakeDummySubmitter()
 
 	var apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// no object exists yet
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		buf, _ := io.ReadAll(r.Body)
 		if strings.Contains(r.URL.String(), "12345.verdict.json") {
 			w.WriteHeader(http.StatusOK)
@@ -138,6 +179,12 @@ func TestUploaderBacklog(t *testing.T) {
 	}))
 	defer apiStub.Close()
 
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
 	indir, err := os.MkdirTemp("", "indir")
 	if err != nil {
 		t.Fatal(err)
@@ -182,9 +229,11 @@ func TestUploaderBacklog(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	time.Sleep(2 * time.Second)
-
+	waitForJob(t, "12345", sampledb.UploadDone)
 	u.Stop()
+	if _, err := os.Stat(filepath.Join(scratchdir, "12345.verdict.json")); !os.IsNotExist(err) {
+		t.Fatal("legacy verdict file not removed")
+	}
 
 	os.RemoveAll(indir)
 	os.RemoveAll(scratchdir)
@@ -193,3 +242,654 @@ func TestUploaderBacklog(t *testing.T) {
 		t.Fatal("no complete set of file and verdict")
 	}
 }
+
+type recordingSubmitter struct {
+	lock     sync.Mutex
+	received []sampledb.FileVerdict
+}
+
+func (s *recordingSubmitter) Submit(jsonData []byte) error {
+	var v sampledb.FileVerdict
+	err := json.Unmarshal(jsonData, &v)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.received = append(s.received, v)
+	return nil
+}
+
+func (s *recordingSubmitter) Finish() {}
+
+func TestUploadRetry(t *testing.T) {
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	var lock sync.Mutex
+	failures := 2
+	var apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// no object exists yet
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.ReadAll(r.Body)
+		if strings.Contains(r.URL.String(), "location") {
+			w.Write([]byte(regionReturn))
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/12345") && failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer apiStub.Close()
+
+	indir := t.TempDir()
+	scratchdir := t.TempDir()
+	s := &recordingSubmitter{}
+	config := DefaultUploadConfig()
+	config.MinDelay = 50 * time.Millisecond
+	config.MaxDelay = 100 * time.Millisecond
+	config.Retention = 500 * time.Millisecond
+	u, err := MakeS3UploaderWithConfig(S3Credentials{
+		Endpoint:   strings.Replace(apiStub.URL, "http://", "", -1),
+		BucketName: "incoming",
+		Region:     "TEST",
+	}, false, indir, scratchdir, s, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	util.CreateFilePair(2, []byte("foo bar2"), 10, indir)
+	err = u.Enqueue(sampledb.FileVerdict{
+		Hashes:     sampledb.HashInfo{Sha512: "12345"},
+		Suspicious: true,
+	}, filepath.Join(indir, "file.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := waitForJob(t, "12345", sampledb.UploadDone)
+	if job.Attempts != 3 || job.LastError != "" || !job.Verdict.Uploaded {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if _, err := os.Stat(job.LocalPath); !os.IsNotExist(err) {
+		t.Fatal("uploaded file not removed")
+	}
+	s.lock.Lock()
+	if len(s.received) != 1 || !strings.HasSuffix(s.received[0].UploadLocation, "/incoming/12345") {
+		t.Fatalf("unexpected submissions %+v", s.received)
+	}
+	s.lock.Unlock()
+
+	// finished jobs are removed once they expire
+	waitForJob(t, "12345", "")
+}
+
+func TestUploadMaxAttempts(t *testing.T) {
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	var apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// no object exists yet
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.ReadAll(r.Body)
+		if strings.Contains(r.URL.String(), "location") {
+			w.Write([]byte(regionReturn))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer apiStub.Close()
+
+	indir := t.TempDir()
+	scratchdir := t.TempDir()
+	s := &recordingSubmitter{}
+	config := DefaultUploadConfig()
+	config.MinDelay = 50 * time.Millisecond
+	config.MaxDelay = 100 * time.Millisecond
+	config.MaxAttempts = 2
+	u, err := MakeS3UploaderWithConfig(S3Credentials{
+		Endpoint:   strings.Replace(apiStub.URL, "http://", "", -1),
+		BucketName: "incoming",
+		Region:     "TEST",
+	}, false, indir, scratchdir, s, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	util.CreateFilePair(2, []byte("foo bar2"), 10, indir)
+	err = u.Enqueue(sampledb.FileVerdict{
+		Hashes:     sampledb.HashInfo{Sha512: "12345"},
+		Suspicious: true,
+	}, filepath.Join(indir, "file.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the job is given up on after two attempts instead of being retried
+	deadline := time.Now().Add(10 * time.Second)
+	var job sampledb.UploadJob
+	for {
+		job, err = sampledb.GetUploadJob("12345")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !job.Expires.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upload job not given up on: %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if job.State != sampledb.UploadFailed || job.Attempts != 2 || !job.NextAttempt.IsZero() ||
+		job.LastError == "" {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if _, err := os.Stat(job.LocalPath); !os.IsNotExist(err) {
+		t.Fatal("staged file of given up job not removed")
+	}
+	time.Sleep(200 * time.Millisecond)
+	job, err = sampledb.GetUploadJob("12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Attempts != 2 {
+		t.Fatalf("job given up on attempted again: %+v", job)
+	}
+	s.lock.Lock()
+	if len(s.received) != 0 {
+		t.Fatalf("unexpected submissions %+v", s.received)
+	}
+	s.lock.Unlock()
+}
+
+func TestUploadResume(t *testing.T) {
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	var apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// no object exists yet
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.ReadAll(r.Body)
+		if strings.Contains(r.URL.String(), "location") {
+			w.Write([]byte(regionReturn))
+		}
+	}))
+	defer apiStub.Close()
+
+	// jobs interrupted by a restart are attempted again, jobs which were
+	// given up on by previous versions are removed
+	scratchdir := t.TempDir()
+	os.WriteFile(filepath.Join(scratchdir, "1"), []byte("foo"), 0644)
+	for _, job := range []sampledb.UploadJob{
+		{
+			Verdict:   sampledb.FileVerdict{Hashes: sampledb.HashInfo{Sha512: "1"}},
+			LocalPath: filepath.Join(scratchdir, "1"),
+			State:     sampledb.UploadUploading,
+			Attempts:  1,
+		},
+		{
+			Verdict:   sampledb.FileVerdict{Hashes: sampledb.HashInfo{Sha512: "2"}},
+			LocalPath: filepath.Join(scratchdir, "2"),
+			State:     sampledb.UploadFailed,
+			Attempts:  1,
+		},
+	} {
+		err = sampledb.PutUploadJob(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, err := MakeS3Uploader(S3Credentials{
+		Endpoint:   strings.Replace(apiStub.URL, "http://", "", -1),
+		BucketName: "incoming",
+		Region:     "TEST",
+	}, false, t.TempDir(), scratchdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	if job := waitForJob(t, "1", sampledb.UploadDone); job.Attempts != 2 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	waitForJob(t, "2", "")
+}
+
+// blockingBackend is a Backend whose uploads wait until Release is closed
+// or they are cancelled, signalling on Started when one begins.
+type blockingBackend struct {
+	Backend
+	Started chan bool
+	Release chan bool
+}
+
+func (b *blockingBackend) Put(ctx context.Context, key string, r io.ReadSeeker, size int64, info ObjectInfo) error {
+	select {
+	case b.Started <- true:
+	default:
+	}
+	select {
+	case <-b.Release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return b.Backend.Put(ctx, key, r, size, info)
+}
+
+func TestUploadEnqueueActive(t *testing.T) {
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	indir := t.TempDir()
+	err = os.WriteFile(filepath.Join(indir, "sample"), []byte("foo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := MakeLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &blockingBackend{
+		Backend: local,
+		Started: make(chan bool, 1),
+		Release: make(chan bool),
+	}
+	u, err := MakeUploader(backend, indir, t.TempDir(), nil, DefaultUploadConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	enqueue := func(sensorID string) {
+		err := u.Enqueue(sampledb.FileVerdict{
+			SensorID: sensorID,
+			Hashes:   sampledb.HashInfo{Sha512: "12345"},
+		}, filepath.Join(indir, "sample"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	enqueue("s1")
+	<-backend.Started
+
+	// a sample being uploaded is neither staged again nor queued again
+	enqueue("s2")
+	job, err := sampledb.GetUploadJob("12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != sampledb.UploadUploading || job.Verdict.SensorID != "s1" {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	close(backend.Release)
+	job = waitForJob(t, "12345", sampledb.UploadDone)
+	if job.Verdict.SensorID != "s1" || job.Attempts != 1 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if _, err := os.Stat(job.LocalPath); !os.IsNotExist(err) {
+		t.Fatal("uploaded file not removed")
+	}
+
+	// once done, it can be uploaded again
+	enqueue("s3")
+	deadline := time.Now().Add(10 * time.Second)
+	for job.Verdict.SensorID != "s3" || job.State != sampledb.UploadDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected job %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		job, err = sampledb.GetUploadJob("12345")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUploadRefund(t *testing.T) {
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	indir := t.TempDir()
+	err = os.WriteFile(filepath.Join(indir, "sample"), []byte("foo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sample is present in the storage already
+	storedir := t.TempDir()
+	err = os.WriteFile(filepath.Join(storedir, "12345"), []byte("foo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := MakeLocalBackend(storedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+	config := DefaultUploadConfig()
+	config.Policy = &Policy{Percent: 100, Budget: 1000}
+	config.Policy.now = func() time.Time { return now }
+	u, err := MakeUploader(local, indir, t.TempDir(), nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	available := func() float64 {
+		config.Policy.lock.Lock()
+		defer config.Policy.lock.Unlock()
+		return config.Policy.available
+	}
+	enqueue := func(hash string) {
+		v := sampledb.FileVerdict{Hashes: sampledb.HashInfo{Sha512: hash}, Size: 600}
+		if !u.ShouldUpload(&v, true) {
+			t.Fatal("sample within budget not selected")
+		}
+		if available() != 400 {
+			t.Fatalf("unexpected budget %v after selection", available())
+		}
+		err := u.Enqueue(v, filepath.Join(indir, "sample"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// samples which are present already are not uploaded and not paid for
+	enqueue("12345")
+	waitForJob(t, "12345", sampledb.UploadDone)
+	if available() != 1000 {
+		t.Fatalf("budget of skipped sample not given back: %v", available())
+	}
+
+	// neither are samples whose upload is pending already
+	err = sampledb.PutUploadJob(sampledb.UploadJob{
+		Verdict:     sampledb.FileVerdict{Hashes: sampledb.HashInfo{Sha512: "67890"}},
+		LocalPath:   filepath.Join(indir, "sample"),
+		State:       sampledb.UploadFailed,
+		Attempts:    1,
+		NextAttempt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueue("67890")
+	if available() != 1000 {
+		t.Fatalf("budget of queued sample not given back: %v", available())
+	}
+}
+
+func TestUploadMultipart(t *testing.T) {
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	var lock sync.Mutex
+	parts := make(map[string][]byte)
+	completed := false
+	var apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// no object exists yet
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		buf, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		q := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			w.Write([]byte(`<InitiateMultipartUploadResult><Bucket>incoming</Bucket>` +
+				`<Key>12345</Key><UploadId>u1</UploadId></InitiateMultipartUploadResult>`))
+		case r.Method == http.MethodPut && q.Get("uploadId") == "u1":
+			parts[q.Get("partNumber")] = buf
+			w.Header().Set("ETag", `"part`+q.Get("partNumber")+`"`)
+		case r.Method == http.MethodPost && q.Get("uploadId") == "u1":
+			completed = true
+			w.Write([]byte(`<CompleteMultipartUploadResult><Bucket>incoming</Bucket>` +
+				`<Key>12345</Key><ETag>"done"</ETag></CompleteMultipartUploadResult>`))
+		}
+	}))
+	defer apiStub.Close()
+
+	indir := t.TempDir()
+	sample := bytes.Repeat([]byte("x"), MinPartSize+1)
+	err = os.WriteFile(filepath.Join(indir, "sample"), sample, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultUploadConfig()
+	config.PartSize = MinPartSize
+	u, err := MakeS3UploaderWithConfig(S3Credentials{
+		Endpoint:   strings.Replace(apiStub.URL, "http://", "", -1),
+		BucketName: "incoming",
+		Region:     "TEST",
+	}, false, indir, t.TempDir(), nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	err = u.Enqueue(sampledb.FileVerdict{
+		Hashes: sampledb.HashInfo{Sha512: "12345"},
+		Size:   int64(len(sample)),
+	}, filepath.Join(indir, "sample"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the original may be removed once the sample is enqueued
+	os.Remove(filepath.Join(indir, "sample"))
+	waitForJob(t, "12345", sampledb.UploadDone)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !completed || len(parts) != 2 || len(parts["1"]) != MinPartSize ||
+		!bytes.Equal(append(parts["1"], parts["2"]...), sample) {
+		t.Fatalf("unexpected multipart upload of %d parts", len(parts))
+	}
+
+	if _, err := MakeS3UploaderWithConfig(S3Credentials{Endpoint: "localhost"}, false, indir,
+		t.TempDir(), nil, UploadConfig{PartSize: 1024}); err == nil {
+		t.Fatal("too small part size accepted")
+	}
+}
+
+func TestUploadWrapped(t *testing.T) {
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	var lock sync.Mutex
+	var sampleHeader http.Header
+	var sampleBody []byte
+	var apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// no object exists yet
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		buf, _ := io.ReadAll(r.Body)
+		if strings.HasSuffix(r.URL.Path, "/12345") {
+			lock.Lock()
+			sampleHeader = r.Header
+			sampleBody = buf
+			lock.Unlock()
+		}
+	}))
+	defer apiStub.Close()
+
+	indir := t.TempDir()
+	scratchdir := t.TempDir()
+	err = os.WriteFile(filepath.Join(indir, "sample"), []byte("foo bar"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultUploadConfig()
+	config.Wrapper = &ZIPWrapper{Password: "infected"}
+	s := &recordingSubmitter{}
+	u, err := MakeS3UploaderWithConfig(S3Credentials{
+		Endpoint:   strings.Replace(apiStub.URL, "http://", "", -1),
+		BucketName: "incoming",
+		Region:     "TEST",
+	}, false, indir, scratchdir, s, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	err = u.Enqueue(sampledb.FileVerdict{
+		Hashes: sampledb.HashInfo{Sha256: "abc", Sha512: "12345"},
+	}, filepath.Join(indir, "sample"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := waitForJob(t, "12345", sampledb.UploadDone)
+	if job.Verdict.UploadWrapping != WrapZIP {
+		t.Fatalf("wrapping not recorded in %+v", job.Verdict)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if sampleHeader.Get("X-Amz-Meta-Wrapping") != WrapZIP || sampleHeader.Get("Content-Type") != "application/zip" {
+		t.Fatalf("unexpected headers %v", sampleHeader)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(sampleBody), int64(len(sampleBody)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != "abc" {
+		t.Fatalf("unexpected archive entries %+v", zr.File)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.received) != 1 || s.received[0].UploadWrapping != WrapZIP {
+		t.Fatalf("unexpected submissions %+v", s.received)
+	}
+}
+
+func TestUploadLayout(t *testing.T) {
+	err := sampledb.InitDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampledb.CloseDB()
+
+	var lock sync.Mutex
+	puts := make(map[string]http.Header)
+	var apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.Method {
+		case http.MethodHead:
+			// the second sample was already uploaded by another sensor
+			if r.URL.Path != "/incoming/sensor/s1/2025/01/03/b256" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("ETag", `"x"`)
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("Content-Length", "3")
+		case http.MethodPut:
+			puts[r.URL.Path] = r.Header
+		}
+	}))
+	defer apiStub.Close()
+
+	indir := t.TempDir()
+	err = os.WriteFile(filepath.Join(indir, "sample"), []byte("foo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultUploadConfig()
+	config.Key, err = ParseKey(`/sensor/{{.SensorID}}/{{.Time.UTC.Format "2006/01/02"}}/{{.Hashes.Sha256}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Tags = Tags{"retention": "short"}
+	s := &recordingSubmitter{}
+	u, err := MakeS3UploaderWithConfig(S3Credentials{
+		Endpoint:   strings.Replace(apiStub.URL, "http://", "", -1),
+		BucketName: "incoming",
+		Region:     "TEST",
+	}, false, indir, t.TempDir(), s, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	for _, hash := range []string{"a", "b"} {
+		err = u.Enqueue(sampledb.FileVerdict{
+			Suspicious:    true,
+			SuspiciousVia: []string{"YARA", "other"},
+			SensorID:      "s1",
+			Time:          time.Date(2025, 1, 2, 23, 0, 0, 0, time.FixedZone("", -3600)),
+			Hashes:        sampledb.HashInfo{Sha256: hash + "256", Sha512: hash + "512"},
+		}, filepath.Join(indir, "sample"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForJob(t, hash+"512", sampledb.UploadDone)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(puts) != 3 || puts["/incoming/sensor/s1/2025/01/03/a256"] == nil ||
+		puts["/incoming/sensor/s1/2025/01/03/a256.verdict.json"] == nil ||
+		puts["/incoming/sensor/s1/2025/01/03/b256.verdict.json"] == nil {
+		t.Fatalf("unexpected uploads %v", puts)
+	}
+	h := puts["/incoming/sensor/s1/2025/01/03/a256"]
+	if h.Get("X-Amz-Meta-Sha256") != "a256" || h.Get("X-Amz-Meta-Sensor-Id") != "s1" ||
+		h.Get("X-Amz-Meta-Suspicious-Via") != "YARA,other" || h.Get("X-Amz-Meta-Wrapping") != "none" ||
+		h.Get("X-Amz-Tagging") != "retention=short" {
+		t.Fatalf("unexpected headers %v", h)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.received) != 2 || !strings.HasSuffix(s.received[0].UploadLocation, "/incoming/sensor/s1/2025/01/03/a256") {
+		t.Fatalf("unexpected submissions %+v", s.received)
+	}
+
+	// keys which cannot be built are rejected right away
+	u.Config.Key, _ = ParseKey(`{{.Missing}}`)
+	if err := u.Enqueue(sampledb.FileVerdict{Hashes: sampledb.HashInfo{Sha512: "c512"}},
+		filepath.Join(indir, "sample")); err == nil {
+		t.Fatal("invalid key accepted")
+	}
+}
@@ -0,0 +1,176 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// WebDAVBackend stores objects with HTTP PUT requests below a base URL, as
+// supported by WebDAV servers and many plain HTTP upload services. Object
+// keys are used as paths relative to the base URL. If the server reports
+// that the parent collection of an object is missing, it is created with
+// MKCOL. Metadata is not stored.
+type WebDAVBackend struct {
+	// URL is the collection objects are stored in.
+	URL *url.URL
+	// User and Password are used for basic authentication, if given.
+	User     string
+	Password string
+	Client   *http.Client
+}
+
+// MakeWebDAVBackend returns a new WebDAVBackend storing objects below the
+// given URL.
+func MakeWebDAVBackend(rawURL, user, password string) (*WebDAVBackend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid WebDAV URL: %s", rawURL)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("WebDAV URL must not contain credentials")
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &WebDAVBackend{
+		URL:      u,
+		User:     user,
+		Password: password,
+		Client:   &http.Client{},
+	}, nil
+}
+
+func (b *WebDAVBackend) objectURL(key string) (*url.URL, error) {
+	clean, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.URL.JoinPath(clean), nil
+}
+
+func (b *WebDAVBackend) do(ctx context.Context, method string, u *url.URL, body io.Reader,
+	size int64, contentType string) (*http.Response, error) {
+	if body != nil && size == 0 {
+		// empty bodies would otherwise be sent chunked
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+	}
+	if len(b.User) > 0 || len(b.Password) > 0 {
+		req.SetBasicAuth(b.User, b.Password)
+	}
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+// Exists returns whether the object with the given key exists.
+func (b *WebDAVBackend) Exists(ctx context.Context, key string) (bool, error) {
+	u, err := b.objectURL(key)
+	if err != nil {
+		return false, err
+	}
+	resp, err := b.do(ctx, http.MethodHead, u, nil, 0, "")
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("HEAD %s: %s", u.Redacted(), resp.Status)
+}
+
+// Put stores the object with the given key, creating missing collections.
+func (b *WebDAVBackend) Put(ctx context.Context, key string, r io.ReadSeeker, size int64, info ObjectInfo) error {
+	u, err := b.objectURL(key)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		var resp *http.Response
+		resp, err = b.do(ctx, http.MethodPut, u, io.LimitReader(r, size), size, info.ContentType)
+		if err != nil {
+			return err
+		}
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode == http.StatusConflict && attempt == 0:
+			// the parent collection is missing
+			err = b.mkcol(ctx, key)
+			if err != nil {
+				return err
+			}
+			_, err = r.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("PUT %s: %s", u.Redacted(), resp.Status)
+		}
+	}
+}
+
+// mkcol creates the collections containing the object with the given key.
+func (b *WebDAVBackend) mkcol(ctx context.Context, key string) error {
+	clean, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	dir := path.Dir(clean)
+	if dir == "." {
+		return nil
+	}
+	col := b.URL
+	for _, name := range strings.Split(dir, "/") {
+		col = col.JoinPath(name + "/")
+		resp, err := b.do(ctx, "MKCOL", col, nil, 0, "")
+		if err != nil {
+			return err
+		}
+		// existing collections are reported as not allowed
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("MKCOL %s: %s", col.Redacted(), resp.Status)
+		}
+	}
+	return nil
+}
+
+// Location returns the URL of the object.
+func (b *WebDAVBackend) Location(key string) string {
+	u, err := b.objectURL(key)
+	if err != nil {
+		return b.URL.String() + key
+	}
+	return u.String()
+}
+
+// Close closes idle connections.
+func (b *WebDAVBackend) Close() error {
+	b.Client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,195 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"filippo.io/age"
+)
+
+// Names of sample wrappings, as recorded in verdicts and object metadata.
+const (
+	WrapNone = ""
+	WrapZIP  = "zip"
+	WrapAge  = "age"
+)
+
+// Wrapper protects samples before they are stored for upload, so that live
+// malware is never put on shared storage as it is.
+type Wrapper interface {
+	// Name identifies the wrapping.
+	Name() string
+	// Wrap writes the wrapped content of src, to be extracted as a file
+	// with the given name, to w.
+	Wrap(w io.Writer, src *os.File, name string) error
+}
+
+// ContentType returns the MIME type of samples with the given wrapping.
+func ContentType(wrapping string) string {
+	if wrapping == WrapZIP {
+		return "application/zip"
+	}
+	return "application/octet-stream"
+}
+
+// ZIPWrapper stores samples in password-protected ZIP archives, using the
+// traditional PKWARE encryption supported by virtually all unzip tools.
+// This does not keep the content secret from anyone knowing the
+// conventional password, but prevents accidental execution and detection by
+// storage-side virus scanners.
+type ZIPWrapper struct {
+	Password string
+}
+
+// Name returns WrapZIP.
+func (z *ZIPWrapper) Name() string {
+	return WrapZIP
+}
+
+// Wrap writes a ZIP archive containing the sample stored uncompressed.
+func (z *ZIPWrapper) Wrap(w io.Writer, src *os.File, name string) error {
+	// the checksum needs to be known before the data is written
+	crc := crc32.NewIEEE()
+	size, err := io.Copy(crc, src)
+	if err != nil {
+		return err
+	}
+	_, err = src.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	fw, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		Flags:              0x1, // encrypted
+		CRC32:              crc.Sum32(),
+		CompressedSize64:   uint64(size) + zipCryptoHeaderLen,
+		UncompressedSize64: uint64(size),
+	})
+	if err != nil {
+		return err
+	}
+	ew, err := newZipCryptoWriter(fw, z.Password, crc.Sum32())
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(ew, src)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("sample changed while wrapping (%d instead of %d bytes)", n, size)
+	}
+	return zw.Close()
+}
+
+const zipCryptoHeaderLen = 12
+
+// zipCryptoWriter encrypts data with the traditional PKWARE stream cipher.
+type zipCryptoWriter struct {
+	w    io.Writer
+	keys [3]uint32
+	buf  []byte
+}
+
+func crc32Update(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ (crc >> 8)
+}
+
+func (z *zipCryptoWriter) update(b byte) {
+	z.keys[0] = crc32Update(z.keys[0], b)
+	z.keys[1] = (z.keys[1]+z.keys[0]&0xff)*134775813 + 1
+	z.keys[2] = crc32Update(z.keys[2], byte(z.keys[1]>>24))
+}
+
+func (z *zipCryptoWriter) encrypt(b byte) byte {
+	t := z.keys[2] | 2
+	c := b ^ byte((t*(t^1))>>8)
+	z.update(b)
+	return c
+}
+
+// newZipCryptoWriter initializes the cipher with the password and writes
+// the encryption header, whose last byte allows checking the password
+// against the checksum of the file.
+func newZipCryptoWriter(w io.Writer, password string, crc uint32) (*zipCryptoWriter, error) {
+	z := &zipCryptoWriter{
+		w:    w,
+		keys: [3]uint32{0x12345678, 0x23456789, 0x34567890},
+	}
+	for i := 0; i < len(password); i++ {
+		z.update(password[i])
+	}
+	header := make([]byte, zipCryptoHeaderLen)
+	_, err := rand.Read(header[:zipCryptoHeaderLen-1])
+	if err != nil {
+		return nil, err
+	}
+	header[zipCryptoHeaderLen-1] = byte(crc >> 24)
+	_, err = z.Write(header)
+	return z, err
+}
+
+func (z *zipCryptoWriter) Write(p []byte) (int, error) {
+	if cap(z.buf) < len(p) {
+		z.buf = make([]byte, len(p))
+	}
+	buf := z.buf[:len(p)]
+	for i, b := range p {
+		buf[i] = z.encrypt(b)
+	}
+	return z.w.Write(buf)
+}
+
+// AgeWrapper encrypts samples to the public keys of analysts using age
+// (https://age-encryption.org), so that they can only be read by the
+// holders of the corresponding private keys.
+type AgeWrapper struct {
+	Recipients []age.Recipient
+}
+
+// MakeAgeWrapper returns a new AgeWrapper for the given X25519 public keys
+// (age1...).
+func MakeAgeWrapper(recipients []string) (*AgeWrapper, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no age recipients given")
+	}
+	a := &AgeWrapper{}
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, err
+		}
+		a.Recipients = append(a.Recipients, recipient)
+	}
+	return a, nil
+}
+
+// Name returns WrapAge.
+func (a *AgeWrapper) Name() string {
+	return WrapAge
+}
+
+// Wrap writes the sample encrypted to all recipients. As age encrypts a
+// single stream, the name is not recorded.
+func (a *AgeWrapper) Wrap(w io.Writer, src *os.File, name string) error {
+	ew, err := age.Encrypt(w, a.Recipients...)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ew, bufio.NewReader(src))
+	if err != nil {
+		return err
+	}
+	return ew.Close()
+}
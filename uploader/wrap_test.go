@@ -0,0 +1,113 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package uploader
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func wrapTestSample(t *testing.T) (*os.File, []byte) {
+	content := bytes.Repeat([]byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR"), 5000)
+	path := filepath.Join(t.TempDir(), "sample")
+	err := os.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, content
+}
+
+func TestZIPWrapper(t *testing.T) {
+	src, content := wrapTestSample(t)
+	var buf bytes.Buffer
+	w := &ZIPWrapper{Password: "infected"}
+	err := w.Wrap(&buf, src, "abc.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), content[:100]) {
+		t.Fatal("sample not encrypted")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != "abc.bin" || zr.File[0].Flags&0x1 == 0 ||
+		zr.File[0].UncompressedSize64 != uint64(len(content)) {
+		t.Fatalf("unexpected archive entries %+v", zr.File)
+	}
+
+	// extract with an independent implementation, if available
+	unzip, err := exec.LookPath("unzip")
+	if err != nil {
+		t.Skip("unzip not available")
+	}
+	archive := filepath.Join(t.TempDir(), "sample.zip")
+	err = os.WriteFile(archive, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(unzip, "-P", "infected", "-p", archive).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, content) {
+		t.Fatal("extracted sample differs")
+	}
+	if err = exec.Command(unzip, "-P", "wrong", "-p", archive).Run(); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+}
+
+func TestAgeWrapper(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := MakeAgeWrapper([]string{identity.Recipient().String(), other.Recipient().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, content := wrapTestSample(t)
+	var buf bytes.Buffer
+	err = w.Wrap(&buf, src, "abc.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(buf.Bytes()), identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, content) {
+		t.Fatal("decrypted sample differs")
+	}
+
+	for _, recipients := range [][]string{nil, {"age1invalid"}} {
+		if _, err := MakeAgeWrapper(recipients); err == nil {
+			t.Errorf("invalid recipients %v accepted", recipients)
+		}
+	}
+}
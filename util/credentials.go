@@ -0,0 +1,69 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LoadTLSConfig returns a TLS client configuration verifying the server with
+// the certificates in caFile, or the system ones if not given, and presenting
+// the client certificate in certFile and keyFile if given. It returns nil if
+// TLS is not enabled.
+func LoadTLSConfig(enabled bool, caFile, serverName, certFile, keyFile string) (*tls.Config, error) {
+	if !enabled {
+		if len(caFile) > 0 || len(certFile) > 0 || len(keyFile) > 0 {
+			return nil, fmt.Errorf("certificates given but TLS not enabled")
+		}
+		return nil, nil
+	}
+	tc := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		if len(certFile) == 0 || len(keyFile) == 0 {
+			return nil, fmt.Errorf("client certificate needs both certificate and key file")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// ReadCredentialFile returns the contents of a file containing a user name or
+// password, without trailing newline.
+func ReadCredentialFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		log.Warnf("credential file %s is accessible by other users", path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,29 @@
+// Nightwatch
+// Copyright (c) 2016, 2025, DCSO GmbH
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadCredentialFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pass")
+	err := os.WriteFile(path, []byte("s3cret pass\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pass, err := ReadCredentialFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pass != "s3cret pass" {
+		t.Fatalf("unexpected password '%s'", pass)
+	}
+	_, err = ReadCredentialFile(path + ".missing")
+	if err == nil {
+		t.Fatal("missing credential file accepted")
+	}
+}